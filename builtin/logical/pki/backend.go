@@ -24,7 +24,10 @@ func Backend() *framework.Backend {
 			Root: []string{
 				"config/*",
 				"revoke/*",
+				"revoke-by-name",
+				"root/sign-self-issued",
 				"crl/rotate",
+				"tidy",
 			},
 			Unauthenticated: []string{
 				"cert/*",
@@ -32,29 +35,54 @@ func Backend() *framework.Backend {
 				"ca",
 				"crl/pem",
 				"crl",
+				"ca/previous/pem",
+				"ca/previous",
+				"crl/previous/pem",
+				"crl/previous",
+				"crl/delta/pem",
+				"crl/delta",
+				"ocsp",
+				"ocsp/*",
 			},
 		},
 
 		Paths: []*framework.Path{
 			pathRoles(&b),
 			pathConfigCA(&b),
+			pathConfigCANext(&b),
+			pathConfigCAPromote(&b),
 			pathConfigCRL(&b),
+			pathConfigSANWebhook(&b),
+			pathConfigIssuanceLog(&b),
+			pathConfigFIPS(&b),
 			pathIssue(&b),
 			pathRotateCRL(&b),
 			pathFetchCA(&b),
 			pathFetchCRL(&b),
 			pathFetchCRLViaCertPath(&b),
 			pathFetchValid(&b),
+			pathFetchListCerts(&b),
+			pathArchive(&b),
+			pathCertMetadata(&b),
 			pathRevoke(&b),
+			pathRevokeByName(&b),
+			pathOCSP(&b),
+			pathOCSPPost(&b),
+			pathTidy(&b),
+			pathSignSelfIssued(&b),
 		},
 
 		Secrets: []*framework.Secret{
 			secretCerts(&b),
 		},
+
+		Clean: b.cleanup,
 	}
 
 	b.crlLifetime = time.Hour * 72
 	b.revokeStorageLock = &sync.Mutex{}
+	b.issuanceLogQueue = make(chan *queuedIssuanceEvent, issuanceLogQueueSize)
+	b.issuanceLogStop = make(chan struct{})
 
 	return b.Backend
 }
@@ -64,6 +92,20 @@ type backend struct {
 
 	crlLifetime       time.Duration
 	revokeStorageLock *sync.Mutex
+
+	issuanceLogQueue      chan *queuedIssuanceEvent
+	issuanceLogStop       chan struct{}
+	issuanceLogWorkerOnce sync.Once
+	issuanceLogFileLock   sync.Mutex
+
+	tidyStatus     *tidyStatus
+	tidyStatusLock sync.Mutex
+}
+
+// Stops the background issuance log worker; any events still queued are
+// dropped
+func (b *backend) cleanup() {
+	close(b.issuanceLogStop)
 }
 
 const backendHelp = `
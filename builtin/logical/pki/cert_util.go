@@ -1,19 +1,30 @@
 package pki
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"net/url"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/hashicorp/vault/helper/certutil"
 	"github.com/hashicorp/vault/logical"
@@ -25,28 +36,430 @@ const (
 	serverUsage certUsage = 1 << iota
 	clientUsage
 	codeSigningUsage
+	anyExtKeyUsage
 )
 
 type certCreationBundle struct {
+	// If unset, a random serial number is generated without checking it
+	// against those already issued
+	SerialNumber *big.Int
+
 	SigningBundle *certutil.ParsedCertBundle
 	CACert        *x509.Certificate
 	CommonNames   []string
-	IPSANs        []net.IP
-	KeyType       string
-	KeyBits       int
-	TTL           time.Duration
-	Usage         certUsage
+	// If set, the subject has no common name and CommonNames only holds
+	// the alt names, if any
+	NoCommonName bool
+	// If set, the common name is left out of the DNS SANs
+	ExcludeCNFromSANs bool
+	IPSANs            []net.IP
+	URISANs           []*url.URL
+	OtherSANs         []otherSAN
+	KeyType           string
+	KeyBits           int
+	SignatureBits     int
+	UsePSS            bool
+	TTL               time.Duration
+	NotBeforeDuration time.Duration
+
+	// If set, the validity period, from the backdated start to the end,
+	// may not be longer than this
+	MaxValidity time.Duration
+
+	// If set, the certificate expires at this time rather than after the TTL
+	NotAfter time.Time
+
+	Usage                    certUsage
+	KeyUsage                 x509.KeyUsage
+	ExtKeyUsageOIDs          []asn1.ObjectIdentifier
+	PolicyIdentifiers        []asn1.ObjectIdentifier
+	PrivateKeyUsageNotBefore string
+	PrivateKeyUsageNotAfter  string
+
+	// If set, the validity period is aligned to midnight in this location
+	ValidityLocation *time.Location
+
+	// If set, the nonce is added as an extension with the given OID
+	NonceOID asn1.ObjectIdentifier
+	Nonce    []byte
+
+	// 1 for a bare X.509 v1 certificate without extensions; otherwise v3
+	X509Version int
+
+	// If set, subject attributes are encoded as UTF8String
+	UTF8Subject bool
+
+	// Attributes set here replace those copied from the CA's subject
+	SubjectAttributes pkix.Name
+
+	// The RFC 5280 section 4.2.1.2 method used for the subject key ID
+	SubjectKeyIDMethod int
+
+	// Whether the basic constraints extension is marked critical
+	BasicConstraintsCritical bool
+
+	// If set, the TLS feature extension requiring OCSP stapling is added
+	RequireOCSPStapling bool
+
+	// If set, the provenance string is added as an extension with the
+	// given OID
+	ProvenanceOID asn1.ObjectIdentifier
+	Provenance    string
+}
+
+var oidExtensionPrivateKeyUsagePeriod = asn1.ObjectIdentifier{2, 5, 29, 16}
+
+var oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// The TLS feature extension from RFC 7633, which the standard library
+// does not know of
+var oidExtensionTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// The status_request TLS extension, which asks for a stapled OCSP
+// response; listing it in the TLS feature extension is known as
+// OCSP Must-Staple
+const tlsFeatureStatusRequest = 5
+
+// The ASN.1 structure of the basic constraints extension of a certificate
+// that is not a CA; the standard library always marks the extension
+// critical, so it is marshalled by hand to allow otherwise
+type leafBasicConstraints struct {
+	IsCA bool `asn1:"optional"`
+}
+
+// privateKeyUsagePeriod is the ASN.1 structure of the PrivateKeyUsagePeriod
+// extension from RFC 3280; an unset time is omitted
+type privateKeyUsagePeriod struct {
+	NotBefore time.Time `asn1:"generalized,optional,tag:0"`
+	NotAfter  time.Time `asn1:"generalized,optional,tag:1"`
+}
+
+// The standard certificate extensions, which custom extensions such as the
+// nonce must not be added under
+var oidCertificateExtensions = asn1.ObjectIdentifier{2, 5, 29}
+
+// Parses a dotted-decimal OID, such as "1.3.6.1.4.1.12345.1", for use as a
+// custom extension
+func parseExtensionOID(value string) (asn1.ObjectIdentifier, error) {
+	oid, err := parseOID(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(oid) >= len(oidCertificateExtensions) && oid[:len(oidCertificateExtensions)].Equal(oidCertificateExtensions) {
+		return nil, fmt.Errorf("%q is reserved for standard certificate extensions", value)
+	}
+
+	return oid, nil
+}
+
+// An otherName Subject Alternative Name with a UTF8String value, such as
+// the Microsoft user principal name used for smartcard logon
+type otherSAN struct {
+	OID   asn1.ObjectIdentifier
+	Value string
+}
+
+// Returns the other SAN in the form parseOtherSAN accepts
+func (s otherSAN) String() string {
+	return fmt.Sprintf("%s;UTF8:%s", s.OID, s.Value)
+}
+
+// Parses an other SAN given as "<oid>;UTF8:<value>"; UTF8 is the only type
+// supported
+func parseOtherSAN(value string) (otherSAN, error) {
+	parts := strings.SplitN(value, ";", 2)
+	if len(parts) != 2 {
+		return otherSAN{}, fmt.Errorf("%q must be of the form <oid>;UTF8:<value>", value)
+	}
+	oid, err := parseOID(parts[0])
+	if err != nil {
+		return otherSAN{}, err
+	}
+	typedValue := strings.SplitN(parts[1], ":", 2)
+	if len(typedValue) != 2 || (!strings.EqualFold(typedValue[0], "UTF8") && !strings.EqualFold(typedValue[0], "UTF-8")) {
+		return otherSAN{}, fmt.Errorf("%q must have a value of the form UTF8:<value>", value)
+	}
+	if len(typedValue[1]) == 0 {
+		return otherSAN{}, fmt.Errorf("%q has an empty value", value)
+	}
+	return otherSAN{OID: oid, Value: typedValue[1]}, nil
+}
+
+// Reports whether the other SAN matches any of the allowed entries, each
+// either "*" or of the form "<oid>;UTF8:<pattern>", in which "*" in the
+// pattern matches any run of characters
+func otherSANAllowed(allowed []string, san otherSAN) bool {
+	for _, entry := range allowed {
+		if entry == "*" {
+			return true
+		}
+		pattern, err := parseOtherSAN(entry)
+		if err == nil && pattern.OID.Equal(san.OID) && globMatch(pattern.Value, san.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Marshals a Subject Alternative Name extension value holding the given
+// names, in the order the standard library uses for the first three,
+// followed by the other SANs, which it cannot marshal
+func marshalSubjectAltNames(dnsNames []string, ips []net.IP, uris []*url.URL, others []otherSAN) ([]byte, error) {
+	var names []asn1.RawValue
+	for _, name := range dnsNames {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte(name)})
+	}
+	for _, ip := range ips {
+		ipBytes := ip.To4()
+		if ipBytes == nil {
+			ipBytes = ip
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 7, Bytes: ipBytes})
+	}
+	for _, uri := range uris {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(uri.String())})
+	}
+	for _, other := range others {
+		// otherName ::= SEQUENCE { type-id OID, value [0] EXPLICIT ANY },
+		// itself tagged [0] IMPLICIT in the GeneralName
+		oidBytes, err := asn1.Marshal(other.OID)
+		if err != nil {
+			return nil, err
+		}
+		valueBytes, err := asn1.MarshalWithParams(other.Value, "utf8")
+		if err != nil {
+			return nil, err
+		}
+		explicitValue, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: valueBytes})
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: append(oidBytes, explicitValue...)})
+	}
+	return asn1.Marshal(names)
+}
+
+// Returns the otherName Subject Alternative Names of the given certificate,
+// in the form otherSAN.String gives. Values that are not UTF8Strings, which
+// this backend does not issue but another CA may have, are given as the hex
+// of their DER encoding instead; malformed entries are skipped.
+func certOtherSANs(cert *x509.Certificate) []string {
+	result := []string{}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			continue
+		}
+		for _, name := range names {
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var other struct {
+				OID   asn1.ObjectIdentifier
+				Value asn1.RawValue `asn1:"explicit,tag:0"`
+			}
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &other, "tag:0"); err != nil {
+				continue
+			}
+			var value string
+			if _, err := asn1.UnmarshalWithParams(other.Value.Bytes, &value, "utf8"); err != nil {
+				result = append(result, fmt.Sprintf("%s;HEX:%x", other.OID, other.Value.Bytes))
+				continue
+			}
+			result = append(result, otherSAN{OID: other.OID, Value: value}.String())
+		}
+	}
+	return result
+}
+
+// Parses a comma-delimited list of dotted-decimal OIDs
+func parseOIDList(list string) ([]asn1.ObjectIdentifier, error) {
+	var result []asn1.ObjectIdentifier
+	for _, value := range splitCommaList(list) {
+		oid, err := parseOID(value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, oid)
+	}
+	return result, nil
+}
+
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%q must have at least two components", value)
+	}
+
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not a dotted-decimal OID", value)
+		}
+		oid[i] = n
+	}
+	if oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		return nil, fmt.Errorf("%q is not a valid OID", value)
+	}
+
+	return oid, nil
+}
+
+// The values available to a role's provenance_extension_template
+type provenanceData struct {
+	Role        string
+	CommonName  string
+	DisplayName string
+	MountPoint  string
+	Time        string
+}
+
+// Parses a provenance_extension_template, and renders it once against empty
+// data so that references to unknown fields are caught when the role is
+// written rather than at issuance
+func parseProvenanceTemplate(value string) (*template.Template, error) {
+	tmpl, err := template.New("provenance").Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(ioutil.Discard, provenanceData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// Renders a role's provenance_extension_template against the given data
+func renderProvenance(value string, data provenanceData) (string, error) {
+	tmpl, err := parseProvenanceTemplate(value)
+	if err != nil {
+		return "", certutil.InternalError{Err: fmt.Sprintf("Error parsing provenance template: %s", err)}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", certutil.UserError{Err: fmt.Sprintf("Error rendering provenance template: %s", err)}
+	}
+	if !utf8.Valid(buf.Bytes()) {
+		return "", certutil.UserError{Err: "The rendered provenance is not valid UTF-8"}
+	}
+	return buf.String(), nil
+}
+
+var (
+	oidAttributeCountry      = asn1.ObjectIdentifier{2, 5, 4, 6}
+	oidAttributeSerialNumber = asn1.ObjectIdentifier{2, 5, 4, 5}
+)
+
+// Marshals the given name with every attribute encoded as a UTF8String,
+// rather than as a PrintableString where possible as the standard library
+// does. RFC 5280 requires the country and serial number attributes to be
+// PrintableStrings, so those are left alone.
+func marshalUTF8Subject(name pkix.Name) ([]byte, error) {
+	rdns := name.ToRDNSequence()
+	for _, rdn := range rdns {
+		for i, atv := range rdn {
+			value, ok := atv.Value.(string)
+			if !ok || atv.Type.Equal(oidAttributeCountry) || atv.Type.Equal(oidAttributeSerialNumber) {
+				continue
+			}
+			rdn[i].Value = asn1.RawValue{
+				Tag:   asn1.TagUTF8String,
+				Bytes: []byte(value),
+			}
+		}
+	}
+	return asn1.Marshal(rdns)
+}
+
+// Parses a PrivateKeyUsagePeriod bound, which is either an RFC 3339
+// timestamp or a duration relative to the given base time. An empty value
+// returns the zero time.
+func parsePrivateKeyUsageTime(value string, base time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Truncate(time.Second), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 timestamp nor a duration", value)
+	}
+	return base.Add(d).UTC().Truncate(time.Second), nil
+}
+
+// Builds the PrivateKeyUsagePeriod extension for the given certificate, if
+// the creation bundle asks for one. The period must fall within the
+// validity of the certificate.
+func privateKeyUsagePeriodExtension(creationInfo *certCreationBundle, certTemplate *x509.Certificate) (*pkix.Extension, error) {
+	if len(creationInfo.PrivateKeyUsageNotBefore) == 0 && len(creationInfo.PrivateKeyUsageNotAfter) == 0 {
+		return nil, nil
+	}
+
+	certNotBefore := certTemplate.NotBefore.UTC().Truncate(time.Second)
+	certNotAfter := certTemplate.NotAfter.UTC().Truncate(time.Second)
+
+	var period privateKeyUsagePeriod
+	var err error
+	period.NotBefore, err = parsePrivateKeyUsageTime(creationInfo.PrivateKeyUsageNotBefore, certNotBefore)
+	if err != nil {
+		return nil, certutil.UserError{Err: fmt.Sprintf("Invalid private key usage start: %s", err)}
+	}
+	period.NotAfter, err = parsePrivateKeyUsageTime(creationInfo.PrivateKeyUsageNotAfter, certNotBefore)
+	if err != nil {
+		return nil, certutil.UserError{Err: fmt.Sprintf("Invalid private key usage end: %s", err)}
+	}
+
+	if !period.NotBefore.IsZero() && (period.NotBefore.Before(certNotBefore) || period.NotBefore.After(certNotAfter)) {
+		return nil, certutil.UserError{Err: "The private key usage period must start within the validity of the certificate"}
+	}
+	if !period.NotAfter.IsZero() && (period.NotAfter.Before(certNotBefore) || period.NotAfter.After(certNotAfter)) {
+		return nil, certutil.UserError{Err: "The private key usage period must end within the validity of the certificate"}
+	}
+	if !period.NotBefore.IsZero() && !period.NotAfter.IsZero() && !period.NotBefore.Before(period.NotAfter) {
+		return nil, certutil.UserError{Err: "The private key usage period must start before it ends"}
+	}
+
+	value, err := asn1.Marshal(period)
+	if err != nil {
+		return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling private key usage period: %s", err)}
+	}
+
+	return &pkix.Extension{
+		Id:    oidExtensionPrivateKeyUsagePeriod,
+		Value: value,
+	}, nil
 }
 
 // Fetches the CA info. Unlike other certificates, the CA info is stored
 // in the backend as a CertBundle, because we are storing its private key
 func fetchCAInfo(req *logical.Request) (*certutil.ParsedCertBundle, error) {
-	bundleEntry, err := req.Storage.Get("config/ca_bundle")
+	parsedBundle, err := fetchStoredCABundle(req.Storage, "config/ca_bundle")
+	if err != nil {
+		return nil, err
+	}
+	if parsedBundle == nil {
+		return nil, certutil.UserError{Err: fmt.Sprintf("Backend must be configured with a CA certificate/key")}
+	}
+
+	return parsedBundle, nil
+}
+
+// Fetches a CA bundle stored at the given key, which may be the active,
+// next, or previous CA. Returns nil if there is none.
+func fetchStoredCABundle(s logical.Storage, key string) (*certutil.ParsedCertBundle, error) {
+	bundleEntry, err := s.Get(key)
 	if err != nil {
 		return nil, certutil.InternalError{Err: fmt.Sprintf("Unable to fetch local CA certificate/key: %s", err)}
 	}
 	if bundleEntry == nil {
-		return nil, certutil.UserError{Err: fmt.Sprintf("Backend must be configured with a CA certificate/key")}
+		return nil, nil
 	}
 
 	var bundle certutil.CertBundle
@@ -63,9 +476,33 @@ func fetchCAInfo(req *logical.Request) (*certutil.ParsedCertBundle, error) {
 		return nil, certutil.InternalError{Err: "Stored CA information not able to be parsed"}
 	}
 
+	// Bundles stored before the chain was kept have none, but an
+	// intermediate CA is at least its own chain
+	if len(parsedBundle.CAChain) == 0 && !isSelfSigned(parsedBundle.Certificate) {
+		parsedBundle.CAChain = []*x509.Certificate{parsedBundle.Certificate}
+		parsedBundle.CAChainBytes = [][]byte{parsedBundle.CertificateBytes}
+	}
+
 	return parsedBundle, nil
 }
 
+// Returns true if the two given public keys are of the same type and
+// have identical values
+func publicKeysMatch(a, b crypto.PublicKey) bool {
+	switch aKey := a.(type) {
+	case *rsa.PublicKey:
+		bKey, ok := b.(*rsa.PublicKey)
+		return ok && aKey.E == bKey.E && aKey.N.Cmp(bKey.N) == 0
+	case *ecdsa.PublicKey:
+		bKey, ok := b.(*ecdsa.PublicKey)
+		return ok && aKey.Curve == bKey.Curve && aKey.X.Cmp(bKey.X) == 0 && aKey.Y.Cmp(bKey.Y) == 0
+	case ed25519.PublicKey:
+		return aKey.Equal(b)
+	default:
+		return false
+	}
+}
+
 // Allows fetching certificates from the backend; it handles the slightly
 // separate pathing for CA, CRL, and revoked certificates.
 func fetchCertBySerial(req *logical.Request, prefix, serial string) (*logical.StorageEntry, error) {
@@ -76,6 +513,12 @@ func fetchCertBySerial(req *logical.Request, prefix, serial string) (*logical.St
 		path = "ca"
 	case serial == "crl":
 		path = "crl"
+	case serial == "ca_previous":
+		path = "ca_previous"
+	case serial == "crl_previous":
+		path = "crl_previous"
+	case serial == "crl_delta":
+		path = "crl_delta"
 	case strings.HasPrefix(prefix, "revoked/"):
 		path = "revoked/" + strings.Replace(strings.ToLower(serial), "-", ":", -1)
 	default:
@@ -94,19 +537,97 @@ func fetchCertBySerial(req *logical.Request, prefix, serial string) (*logical.St
 	return certEntry, nil
 }
 
+// As fetchCertBySerial, also returning the metadata recorded when an issued
+// certificate was stored. The metadata is nil for the CA and CRLs, and for
+// certificates issued before metadata was kept.
+func fetchCertBySerialWithMetadata(req *logical.Request, prefix, serial string) (*logical.StorageEntry, *certMetadata, error) {
+	certEntry, err := fetchCertBySerial(req, prefix, serial)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch serial {
+	case "ca", "crl", "ca_previous", "crl_previous", "crl_delta":
+		return certEntry, nil, nil
+	}
+
+	metadata, err := fetchCertMetadata(req, serial)
+	if err != nil {
+		return nil, nil, certutil.InternalError{Err: fmt.Sprintf("Error fetching metadata of certificate with serial %s: %s", serial, err)}
+	}
+
+	return certEntry, metadata, nil
+}
+
+// Reasons a requested name can be refused. They are included in the error
+// returned to the client, so that automation can tell the cases apart
+// without matching on the message.
+const (
+	nameReasonNotAllowed  = "name_not_allowed"
+	nameReasonHostname    = "invalid_hostname"
+	nameReasonWildcard    = "wildcard_not_allowed"
+	nameReasonSingleLabel = "single_label_not_allowed"
+	nameReasonIP          = "ip_not_allowed"
+	nameReasonURI         = "uri_not_allowed"
+	nameReasonOtherSAN    = "other_san_not_allowed"
+	nameReasonCharacters  = "invalid_characters"
+)
+
+// Describes why a requested name was refused
+type nameRejection struct {
+	Name    string
+	Reason  string
+	Message string
+}
+
+func (r *nameRejection) Error() string {
+	return fmt.Sprintf("%s (reason: %s)", r.Message, r.Reason)
+}
+
+// Returns whether the name is valid UTF-8 made only of printable
+// characters, so with no null bytes or control characters
+func isPrintableName(name string) bool {
+	if !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
 // Given a set of requested names for a certificate, verifies that all of them
 // match the various toggles set in the role for controlling issuance.
-// If one does not pass, it is returned in the string argument.
-func validateCommonNames(req *logical.Request, commonNames []string, role *roleEntry) (string, error) {
+// If one does not pass, it is returned in the string argument, along with a
+// UserError if there is a more specific reason than the name not matching.
+func validateCommonNames(req *logical.Request, commonNames []string, role *roleEntry) (*nameRejection, error) {
 	hostnameRegex, err := regexp.Compile(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\-]*[A-Za-z0-9])$`)
 	if err != nil {
-		return "", fmt.Errorf("Error compiling hostname regex: %s", err)
+		return nil, fmt.Errorf("Error compiling hostname regex: %s", err)
 	}
 	subdomainRegex, err := regexp.Compile(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]*[a-zA-Z0-9]))*$`)
 	if err != nil {
-		return "", fmt.Errorf("Error compiling subdomain regex: %s", err)
+		return nil, fmt.Errorf("Error compiling subdomain regex: %s", err)
 	}
-	for _, name := range commonNames {
+	for _, requestedName := range commonNames {
+		// Null bytes and control characters are refused before anything
+		// else, as some libraries truncate or otherwise mishandle names
+		// containing them; the hostname regex only runs when
+		// enforce_hostnames is set
+		if !isPrintableName(requestedName) {
+			return &nameRejection{
+				Name:    requestedName,
+				Reason:  nameReasonCharacters,
+				Message: fmt.Sprintf("Name %q not allowed, as it contains non-printable characters", requestedName),
+			}, nil
+		}
+
+		// A fully-qualified name with a single trailing dot is checked as
+		// if the dot were absent
+		name := strings.TrimSuffix(requestedName, ".")
+
 		if role.AllowLocalhost && name == "localhost" {
 			continue
 		}
@@ -118,9 +639,29 @@ func validateCommonNames(req *logical.Request, commonNames []string, role *roleE
 			isWildcard = true
 		}
 
+		if isWildcard && !role.AllowWildcardCertificates {
+			return &nameRejection{
+				Name:    requestedName,
+				Reason:  nameReasonWildcard,
+				Message: fmt.Sprintf("Name %s not allowed, as this role does not allow wildcard certificates", requestedName),
+			}, nil
+		}
+
+		if !role.AllowSingleLabelDomains && !strings.Contains(sanitizedName, ".") {
+			return &nameRejection{
+				Name:    requestedName,
+				Reason:  nameReasonSingleLabel,
+				Message: fmt.Sprintf("Name %s not allowed, as this role requires fully-qualified names", requestedName),
+			}, nil
+		}
+
 		if role.EnforceHostnames {
 			if !hostnameRegex.MatchString(sanitizedName) {
-				return name, nil
+				return &nameRejection{
+					Name:    requestedName,
+					Reason:  nameReasonHostname,
+					Message: fmt.Sprintf("Name %s not allowed, as it is not a valid hostname", requestedName),
+				}, nil
 			}
 		}
 
@@ -140,26 +681,530 @@ func validateCommonNames(req *logical.Request, commonNames []string, role *roleE
 			}
 		}
 
+		allowed := false
+		domains := splitCommaList(role.AllowedDomains)
 		if len(role.AllowedBaseDomain) != 0 {
-			if strings.HasSuffix(name, "."+role.AllowedBaseDomain) {
+			domains = append(domains, role.AllowedBaseDomain)
+		}
+		for _, domain := range domains {
+			if role.AllowGlobDomains && strings.Contains(domain, "*") {
+				if matched, _ := path.Match(domain, name); matched {
+					allowed = true
+					break
+				}
+				continue
+			}
+
+			if role.AllowBareDomains && name == domain {
+				allowed = true
+				break
+			}
+
+			if strings.HasSuffix(name, "."+domain) {
 				if role.AllowSubdomains {
-					continue
+					allowed = true
+					break
 				}
 
-				if subdomainRegex.MatchString(strings.TrimSuffix(name, "."+role.AllowedBaseDomain)) {
-					continue
+				if subdomainRegex.MatchString(strings.TrimSuffix(name, "."+domain)) {
+					allowed = true
+					break
 				}
 
-				if isWildcard && role.AllowedBaseDomain == sanitizedName {
-					continue
+				if isWildcard && domain == sanitizedName {
+					allowed = true
+					break
 				}
 			}
 		}
+		if allowed {
+			continue
+		}
+
+		return &nameRejection{
+			Name:    requestedName,
+			Reason:  nameReasonNotAllowed,
+			Message: fmt.Sprintf("Name %s not allowed by this role", requestedName),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// The key usages of issued certificates when a role doesn't set them
+const defaultKeyUsage = "DigitalSignature,KeyEncipherment,KeyAgreement"
+
+// The key usages that can be given to a leaf certificate; the certificate
+// and CRL signing usages are only for CAs
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digitalsignature":  x509.KeyUsageDigitalSignature,
+	"contentcommitment": x509.KeyUsageContentCommitment,
+	"keyencipherment":   x509.KeyUsageKeyEncipherment,
+	"dataencipherment":  x509.KeyUsageDataEncipherment,
+	"keyagreement":      x509.KeyUsageKeyAgreement,
+	"encipheronly":      x509.KeyUsageEncipherOnly,
+	"decipheronly":      x509.KeyUsageDecipherOnly,
+}
+
+// Parses a comma-delimited list of key usage names, such as
+// "DigitalSignature,KeyAgreement", in any case
+func parseKeyUsage(list string) (x509.KeyUsage, error) {
+	var keyUsage x509.KeyUsage
+	for _, name := range splitCommaList(list) {
+		bit, ok := keyUsageNames[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown key usage %q", name)
+		}
+		keyUsage |= bit
+	}
+	return keyUsage, nil
+}
+
+// Splits a comma-delimited list, trimming spaces and dropping empty values
+func splitCommaList(list string) []string {
+	var result []string
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if len(value) != 0 {
+			result = append(result, value)
+		}
+	}
+	return result
+}
 
-		return name, nil
+// Removes repeated names, compared without regard to case as DNS names
+// are, keeping the first occurrence of each where it was
+func dedupeNames(names []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, name := range names {
+		key := strings.ToLower(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, name)
 	}
+	return result
+}
 
-	return "", nil
+// Removes repeated IP addresses, keeping the first occurrence of each
+// where it was; IPv4 addresses given in IPv6 form count as the same
+func dedupeIPs(ips []net.IP) []net.IP {
+	result := []net.IP{}
+	for _, ip := range ips {
+		repeated := false
+		for _, kept := range result {
+			if kept.Equal(ip) {
+				repeated = true
+				break
+			}
+		}
+		if !repeated {
+			result = append(result, ip)
+		}
+	}
+	return result
+}
+
+// Removes repeated URIs, keeping the first occurrence of each where it was
+func dedupeURIs(uris []*url.URL) []*url.URL {
+	seen := map[string]bool{}
+	var result []*url.URL
+	for _, uri := range uris {
+		if seen[uri.String()] {
+			continue
+		}
+		seen[uri.String()] = true
+		result = append(result, uri)
+	}
+	return result
+}
+
+// Reports whether the value matches any of the patterns, in which "*"
+// matches any run of characters, including none
+func matchesAnyGlob(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) != 0 && globMatch(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
+
+// Aligns a validity period starting now and lasting for the given TTL to
+// local midnight in the given location: it starts at the beginning of the
+// current day and ends at the last midnight that is no later than now plus
+// the TTL. Days are calendar days, so DST transitions are accounted for.
+func alignValidityToDay(now time.Time, ttl time.Duration, loc *time.Location) (time.Time, time.Time, error) {
+	localNow := now.In(loc)
+	notBefore := time.Date(localNow.Year(), localNow.Month(), localNow.Day(), 0, 0, 0, 0, loc)
+
+	localEnd := now.Add(ttl).In(loc)
+	notAfter := time.Date(localEnd.Year(), localEnd.Month(), localEnd.Day(), 0, 0, 0, 0, loc)
+	if !notAfter.After(now) {
+		return time.Time{}, time.Time{}, certutil.UserError{Err: fmt.Sprintf("The TTL of %s does not reach the next midnight in %s, so the validity cannot be aligned to it", ttl, loc)}
+	}
+
+	return notBefore.UTC(), notAfter.UTC(), nil
+}
+
+// The characters used for random common name suffixes; lowercase only, so
+// the result is still a valid host name and compares case-insensitively
+const randomCNCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Appends a hyphen and the given number of random characters to the first
+// label of the given name, so that "foo.example.com" becomes
+// "foo-x1y2z3w4.example.com". Names of fewer than three labels, and the
+// given allowed domains themselves, are refused, as changing their first
+// label would change the domain rather than name a host within it.
+func appendRandomToName(name string, length int, allowedDomains []string) (string, error) {
+	if strings.HasPrefix(name, "*") {
+		return "", certutil.UserError{Err: "A random component cannot be added to a wildcard name"}
+	}
+	bareName := strings.TrimSuffix(name, ".")
+	if strings.Count(bareName, ".") < 2 {
+		return "", certutil.UserError{Err: fmt.Sprintf("A random component cannot be added to %s, as it has fewer than three labels", name)}
+	}
+	for _, domain := range allowedDomains {
+		if strings.EqualFold(bareName, domain) {
+			return "", certutil.UserError{Err: fmt.Sprintf("A random component cannot be added to %s, as it is a domain allowed by this role rather than a host within one", name)}
+		}
+	}
+
+	firstLabel, rest := name, ""
+	if i := strings.Index(name, "."); i != -1 {
+		firstLabel, rest = name[:i], name[i:]
+	}
+	if len(firstLabel)+1+length > 63 {
+		return "", certutil.UserError{Err: fmt.Sprintf("The first label of %s is too long to add a random component to", name)}
+	}
+
+	suffix := make([]byte, length)
+	max := big.NewInt(int64(len(randomCNCharset)))
+	for i := range suffix {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", certutil.InternalError{Err: fmt.Sprintf("Error generating random common name component: %s", err)}
+		}
+		suffix[i] = randomCNCharset[n.Int64()]
+	}
+
+	return firstLabel + "-" + string(suffix) + rest, nil
+}
+
+// Computes the subject key ID of the given public key. Method 1 is the
+// SHA-1 hash of the marshalled public key, as returned by
+// certutil.GetSubjKeyID; method 2 is RFC 5280's 64-bit variant, the low 60
+// bits of the SHA-1 hash of the subjectPublicKey bits, prefixed with 0100.
+func subjectKeyID(pub crypto.PublicKey, method int) ([]byte, error) {
+	marshaledKey, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling public key: %s", err)}
+	}
+
+	switch method {
+	case 0, 1:
+		subjKeyID := sha1.Sum(marshaledKey)
+		return subjKeyID[:], nil
+	case 2:
+		var spki struct {
+			Algorithm        pkix.AlgorithmIdentifier
+			SubjectPublicKey asn1.BitString
+		}
+		if _, err := asn1.Unmarshal(marshaledKey, &spki); err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error parsing marshalled public key: %s", err)}
+		}
+		hash := sha1.Sum(spki.SubjectPublicKey.Bytes)
+		subjKeyID := hash[len(hash)-8:]
+		subjKeyID[0] = 0x40 | subjKeyID[0]&0x0f
+		return subjKeyID, nil
+	default:
+		return nil, certutil.UserError{Err: fmt.Sprintf("Unsupported subject key ID method %d", method)}
+	}
+}
+
+// The default size of serial numbers; the most that fits in the 20 octets
+// RFC 5280 allows, as serial numbers must be positive
+const defaultSerialBits = 159
+
+// Returns a random serial number of at most the given number of bits. It
+// is never zero, which some clients reject. A variable so tests can force
+// collisions.
+var randomSerialNumber = func(bits int) (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+	serial, err := rand.Int(rand.Reader, max.Sub(max, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// How many serial numbers are tried before giving up on finding an unused one
+const serialNumberAttempts = 5
+
+// Generates a random serial number that no certificate issued by this
+// backend, revoked or not, already has. A collision is vanishingly
+// unlikely, but would make revoking either certificate revoke both.
+func generateSerialNumber(s logical.Storage, bits int) (*big.Int, error) {
+	for attempt := 0; attempt < serialNumberAttempts; attempt++ {
+		serialNumber, err := randomSerialNumber(bits)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error getting random serial number: %s", err)}
+		}
+
+		serial := certutil.GetOctalFormatted(serialNumber.Bytes(), ":")
+		inUse := false
+		for _, prefix := range []string{"certs/", "revoked/"} {
+			entry, err := s.Get(prefix + serial)
+			if err != nil {
+				return nil, certutil.InternalError{Err: fmt.Sprintf("Error checking for existing serial number %s: %s", serial, err)}
+			}
+			if entry != nil {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return serialNumber, nil
+		}
+	}
+
+	return nil, certutil.InternalError{Err: fmt.Sprintf("Unable to find an unused serial number after %d attempts", serialNumberAttempts)}
+}
+
+// Fills in everything of the certificate to be created from the creation
+// info, other than its key, running the checks that depend on it, such as
+// of the validity period and signature algorithm. The serial number may be
+// nil to preview a certificate without consuming one.
+func generateCertTemplate(creationInfo *certCreationBundle, serialNumber *big.Int) (*x509.Certificate, error) {
+	subject := pkix.Name{
+		Country:            creationInfo.CACert.Subject.Country,
+		Organization:       creationInfo.CACert.Subject.Organization,
+		OrganizationalUnit: creationInfo.CACert.Subject.OrganizationalUnit,
+		Locality:           creationInfo.CACert.Subject.Locality,
+		Province:           creationInfo.CACert.Subject.Province,
+		StreetAddress:      creationInfo.CACert.Subject.StreetAddress,
+		PostalCode:         creationInfo.CACert.Subject.PostalCode,
+	}
+	if !creationInfo.NoCommonName {
+		subject.CommonName = creationInfo.CommonNames[0]
+	}
+	if serialNumber != nil {
+		subject.SerialNumber = serialNumber.String()
+	}
+	overrides := creationInfo.SubjectAttributes
+	if len(overrides.Country) != 0 {
+		subject.Country = overrides.Country
+	}
+	if len(overrides.Organization) != 0 {
+		subject.Organization = overrides.Organization
+	}
+	if len(overrides.OrganizationalUnit) != 0 {
+		subject.OrganizationalUnit = overrides.OrganizationalUnit
+	}
+	if len(overrides.Locality) != 0 {
+		subject.Locality = overrides.Locality
+	}
+	if len(overrides.Province) != 0 {
+		subject.Province = overrides.Province
+	}
+	if len(overrides.StreetAddress) != 0 {
+		subject.StreetAddress = overrides.StreetAddress
+	}
+	if len(overrides.PostalCode) != 0 {
+		subject.PostalCode = overrides.PostalCode
+	}
+
+	var rawSubject []byte
+	var err error
+	if creationInfo.UTF8Subject {
+		rawSubject, err = marshalUTF8Subject(subject)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling subject: %s", err)}
+		}
+	}
+
+	// The start is backdated for clients whose clocks are behind; the TTL
+	// still counts from now, so the end is unaffected
+	now := time.Now()
+	notBefore := now.Add(-creationInfo.NotBeforeDuration)
+	notAfter := now.Add(creationInfo.TTL)
+	if creationInfo.ValidityLocation != nil {
+		// Aligning to midnight already starts the period before now
+		notBefore, notAfter, err = alignValidityToDay(now, creationInfo.TTL, creationInfo.ValidityLocation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !creationInfo.NotAfter.IsZero() {
+		notAfter = creationInfo.NotAfter
+	}
+	// Don't claim validity from before the CA itself was valid
+	if notBefore.Before(creationInfo.CACert.NotBefore) {
+		notBefore = creationInfo.CACert.NotBefore
+	}
+	// These are checked against the actual period, which alignment and
+	// backdating can make differ from the TTL
+	if notAfter.After(creationInfo.CACert.NotAfter) {
+		return nil, certutil.UserError{Err: "Cannot satisfy request, as TTL is beyond the expiration of the CA certificate"}
+	}
+	if creationInfo.MaxValidity != 0 && notAfter.Sub(notBefore) > creationInfo.MaxValidity {
+		return nil, certutil.UserError{Err: fmt.Sprintf("The validity period of %s, from the backdated start to the end, is longer than the maximum of %s allowed by this role",
+			notAfter.Sub(notBefore).Truncate(time.Second), creationInfo.MaxValidity)}
+	}
+
+	// Ed25519 keys can only be used for signatures
+	keyUsage := creationInfo.KeyUsage
+	if creationInfo.KeyType == "ed25519" {
+		keyUsage &^= x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageKeyAgreement | x509.KeyUsageEncipherOnly | x509.KeyUsageDecipherOnly
+	}
+
+	sigAlg, err := signatureAlgorithm(creationInfo.SigningBundle.PrivateKey, creationInfo.SignatureBits)
+	if err != nil {
+		return nil, err
+	}
+	if creationInfo.UsePSS {
+		switch sigAlg {
+		case x509.SHA256WithRSA:
+			sigAlg = x509.SHA256WithRSAPSS
+		case x509.SHA384WithRSA:
+			sigAlg = x509.SHA384WithRSAPSS
+		case x509.SHA512WithRSA:
+			sigAlg = x509.SHA512WithRSAPSS
+		default:
+			return nil, certutil.UserError{Err: "use_pss requires an RSA CA"}
+		}
+	}
+
+	dnsNames := creationInfo.CommonNames
+	if creationInfo.ExcludeCNFromSANs && !creationInfo.NoCommonName {
+		dnsNames = dnsNames[1:]
+	}
+
+	certTemplate := &x509.Certificate{
+		SignatureAlgorithm:          sigAlg,
+		SerialNumber:                serialNumber,
+		Subject:                     subject,
+		RawSubject:                  rawSubject,
+		NotBefore:                   notBefore,
+		NotAfter:                    notAfter,
+		KeyUsage:                    keyUsage,
+		IsCA:                        false,
+		DNSNames:                    dnsNames,
+		IPAddresses:                 creationInfo.IPSANs,
+		URIs:                        creationInfo.URISANs,
+		PermittedDNSDomainsCritical: false,
+		PermittedDNSDomains:         nil,
+		CRLDistributionPoints:       creationInfo.CACert.CRLDistributionPoints,
+		PolicyIdentifiers:           creationInfo.PolicyIdentifiers,
+	}
+
+	// anyExtendedKeyUsage covers all of the specific usages, so those
+	// are left out when it is set
+	if creationInfo.Usage&anyExtKeyUsage != 0 {
+		certTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	} else {
+		if creationInfo.Usage&serverUsage != 0 {
+			certTemplate.ExtKeyUsage = append(certTemplate.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+		}
+		if creationInfo.Usage&clientUsage != 0 {
+			certTemplate.ExtKeyUsage = append(certTemplate.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
+		}
+		if creationInfo.Usage&codeSigningUsage != 0 {
+			certTemplate.ExtKeyUsage = append(certTemplate.ExtKeyUsage, x509.ExtKeyUsageCodeSigning)
+		}
+		certTemplate.UnknownExtKeyUsage = creationInfo.ExtKeyUsageOIDs
+	}
+
+	basicConstraintsValue, err := asn1.Marshal(leafBasicConstraints{IsCA: false})
+	if err != nil {
+		return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling basic constraints: %s", err)}
+	}
+	certTemplate.ExtraExtensions = append(certTemplate.ExtraExtensions, pkix.Extension{
+		Id:       oidExtensionBasicConstraints,
+		Critical: creationInfo.BasicConstraintsCritical,
+		Value:    basicConstraintsValue,
+	})
+
+	if creationInfo.NonceOID != nil {
+		nonceValue, err := asn1.Marshal(creationInfo.Nonce)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling nonce: %s", err)}
+		}
+		certTemplate.ExtraExtensions = append(certTemplate.ExtraExtensions, pkix.Extension{
+			Id:    creationInfo.NonceOID,
+			Value: nonceValue,
+		})
+	}
+
+	// The standard library leaves out its own Subject Alternative Name
+	// extension when one is given here
+	if len(creationInfo.OtherSANs) != 0 {
+		sanValue, err := marshalSubjectAltNames(certTemplate.DNSNames, certTemplate.IPAddresses, certTemplate.URIs, creationInfo.OtherSANs)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling subject alternative names: %s", err)}
+		}
+		certTemplate.ExtraExtensions = append(certTemplate.ExtraExtensions, pkix.Extension{
+			Id: oidExtensionSubjectAltName,
+			// RFC 5280 requires it to be critical when the subject is empty
+			Critical: len(subject.ToRDNSequence()) == 0,
+			Value:    sanValue,
+		})
+	}
+
+	if creationInfo.RequireOCSPStapling {
+		tlsFeatureValue, err := asn1.Marshal([]int{tlsFeatureStatusRequest})
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling TLS feature: %s", err)}
+		}
+		certTemplate.ExtraExtensions = append(certTemplate.ExtraExtensions, pkix.Extension{
+			Id:    oidExtensionTLSFeature,
+			Value: tlsFeatureValue,
+		})
+	}
+
+	if creationInfo.ProvenanceOID != nil {
+		provenanceValue, err := asn1.MarshalWithParams(creationInfo.Provenance, "utf8")
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling provenance: %s", err)}
+		}
+		certTemplate.ExtraExtensions = append(certTemplate.ExtraExtensions, pkix.Extension{
+			Id:    creationInfo.ProvenanceOID,
+			Value: provenanceValue,
+		})
+	}
+
+	pkupExt, err := privateKeyUsagePeriodExtension(creationInfo, certTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if pkupExt != nil {
+		certTemplate.ExtraExtensions = append(certTemplate.ExtraExtensions, *pkupExt)
+	}
+
+	return certTemplate, nil
 }
 
 // Performs the heavy lifting of creating a certificate. Returns
@@ -169,10 +1214,12 @@ func createCertificate(creationInfo *certCreationBundle) (*certutil.ParsedCertBu
 	var err error
 	result := &certutil.ParsedCertBundle{}
 
-	var serialNumber *big.Int
-	serialNumber, err = rand.Int(rand.Reader, (&big.Int{}).Exp(big.NewInt(2), big.NewInt(159), nil))
-	if err != nil {
-		return nil, certutil.InternalError{Err: fmt.Sprintf("Error getting random serial number")}
+	serialNumber := creationInfo.SerialNumber
+	if serialNumber == nil {
+		serialNumber, err = randomSerialNumber(defaultSerialBits)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error getting random serial number")}
+		}
 	}
 
 	switch creationInfo.KeyType {
@@ -208,55 +1255,38 @@ func createCertificate(creationInfo *certCreationBundle) (*certutil.ParsedCertBu
 		if err != nil {
 			return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling EC private key")}
 		}
+	case "ed25519":
+		result.PrivateKeyType = certutil.Ed25519PrivateKey
+		_, clientPrivKey, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error generating Ed25519 private key")}
+		}
+		result.PrivateKey = clientPrivKey
+		result.PrivateKeyBytes, err = x509.MarshalPKCS8PrivateKey(clientPrivKey)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error marshalling Ed25519 private key")}
+		}
 	default:
 		return nil, certutil.UserError{Err: fmt.Sprintf("Unknown key type: %s", creationInfo.KeyType)}
 	}
 
-	subjKeyID, err := certutil.GetSubjKeyID(result.PrivateKey)
+	subjKeyID, err := subjectKeyID(clientPrivKey.Public(), creationInfo.SubjectKeyIDMethod)
 	if err != nil {
-		return nil, certutil.InternalError{Err: fmt.Sprintf("Error getting subject key ID: %s", err)}
+		return nil, err
 	}
 
-	subject := pkix.Name{
-		Country:            creationInfo.CACert.Subject.Country,
-		Organization:       creationInfo.CACert.Subject.Organization,
-		OrganizationalUnit: creationInfo.CACert.Subject.OrganizationalUnit,
-		Locality:           creationInfo.CACert.Subject.Locality,
-		Province:           creationInfo.CACert.Subject.Province,
-		StreetAddress:      creationInfo.CACert.Subject.StreetAddress,
-		PostalCode:         creationInfo.CACert.Subject.PostalCode,
-		SerialNumber:       serialNumber.String(),
-		CommonName:         creationInfo.CommonNames[0],
-	}
-
-	certTemplate := &x509.Certificate{
-		SignatureAlgorithm:    x509.SHA256WithRSA,
-		SerialNumber:          serialNumber,
-		Subject:               subject,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(creationInfo.TTL),
-		KeyUsage:              x509.KeyUsage(x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement),
-		BasicConstraintsValid: true,
-		IsCA:                        false,
-		SubjectKeyId:                subjKeyID,
-		DNSNames:                    creationInfo.CommonNames,
-		IPAddresses:                 creationInfo.IPSANs,
-		PermittedDNSDomainsCritical: false,
-		PermittedDNSDomains:         nil,
-		CRLDistributionPoints:       creationInfo.CACert.CRLDistributionPoints,
+	certTemplate, err := generateCertTemplate(creationInfo, serialNumber)
+	if err != nil {
+		return nil, err
 	}
+	certTemplate.SubjectKeyId = subjKeyID
 
-	if creationInfo.Usage&serverUsage != 0 {
-		certTemplate.ExtKeyUsage = append(certTemplate.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
-	}
-	if creationInfo.Usage&clientUsage != 0 {
-		certTemplate.ExtKeyUsage = append(certTemplate.ExtKeyUsage, x509.ExtKeyUsageClientAuth)
-	}
-	if creationInfo.Usage&codeSigningUsage != 0 {
-		certTemplate.ExtKeyUsage = append(certTemplate.ExtKeyUsage, x509.ExtKeyUsageCodeSigning)
+	var cert []byte
+	if creationInfo.X509Version == 1 {
+		cert, err = createV1Certificate(certTemplate, creationInfo.CACert, clientPrivKey.Public(), creationInfo.SigningBundle.PrivateKey)
+	} else {
+		cert, err = x509.CreateCertificate(rand.Reader, certTemplate, creationInfo.CACert, clientPrivKey.Public(), creationInfo.SigningBundle.PrivateKey)
 	}
-
-	cert, err := x509.CreateCertificate(rand.Reader, certTemplate, creationInfo.CACert, clientPrivKey.Public(), creationInfo.SigningBundle.PrivateKey)
 	if err != nil {
 		return nil, certutil.InternalError{Err: fmt.Sprintf("Unable to create certificate: %s", err)}
 	}
@@ -272,3 +1302,174 @@ func createCertificate(creationInfo *certCreationBundle) (*certutil.ParsedCertBu
 
 	return result, nil
 }
+
+// Picks the algorithm the CA signs with, for the given hash size. When no
+// size is given, an RSA CA uses SHA-256 and an EC CA the hash matching its
+// curve: SHA-256 for P-256, SHA-384 for P-384 and SHA-512 for P-521. With
+// an EC CA, a hash larger than the curve is refused, as it adds nothing and
+// some clients reject such signatures. An Ed25519 CA always uses
+// PureEd25519, which hashes internally, so no size may be given for it.
+func signatureAlgorithm(signer crypto.Signer, bits int) (x509.SignatureAlgorithm, error) {
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		switch bits {
+		case 0, 256:
+			return x509.SHA256WithRSA, nil
+		case 384:
+			return x509.SHA384WithRSA, nil
+		case 512:
+			return x509.SHA512WithRSA, nil
+		}
+	case *ecdsa.PublicKey:
+		curveBits := pub.Curve.Params().BitSize
+		if bits == 0 {
+			switch {
+			case curveBits > 384:
+				bits = 512
+			case curveBits > 256:
+				bits = 384
+			default:
+				bits = 256
+			}
+		}
+		// Smaller curves still get SHA-256, the smallest hash offered,
+		// whether it is asked for or not
+		if bits > curveBits && bits != 256 {
+			return x509.UnknownSignatureAlgorithm, certutil.UserError{Err: fmt.Sprintf("signature_bits of %d is too large for the CA's P-%d key", bits, curveBits)}
+		}
+		switch bits {
+		case 256:
+			return x509.ECDSAWithSHA256, nil
+		case 384:
+			return x509.ECDSAWithSHA384, nil
+		case 512:
+			return x509.ECDSAWithSHA512, nil
+		}
+	case ed25519.PublicKey:
+		if bits != 0 {
+			return x509.UnknownSignatureAlgorithm, certutil.UserError{Err: "signature_bits cannot be set with an Ed25519 CA, which always signs with PureEd25519"}
+		}
+		return x509.PureEd25519, nil
+	default:
+		return x509.UnknownSignatureAlgorithm, certutil.UserError{Err: "Unsupported CA key type"}
+	}
+
+	return x509.UnknownSignatureAlgorithm, certutil.UserError{Err: fmt.Sprintf("Unsupported signature_bits %d", bits)}
+}
+
+// The identifiers and hashes of the signature algorithms that the
+// structures marshalled by hand, v1 certificates and CRLs, can be signed
+// with. PureEd25519 signs the data itself, so has no hash.
+var signatureAlgorithmDetails = map[x509.SignatureAlgorithm]struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	x509.SHA256WithRSA:   {asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, crypto.SHA256},
+	x509.SHA384WithRSA:   {asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, crypto.SHA384},
+	x509.SHA512WithRSA:   {asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, crypto.SHA512},
+	x509.ECDSAWithSHA256: {asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, crypto.SHA256},
+	x509.ECDSAWithSHA384: {asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, crypto.SHA384},
+	x509.ECDSAWithSHA512: {asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, crypto.SHA512},
+	x509.PureEd25519:     {asn1.ObjectIdentifier{1, 3, 101, 112}, crypto.Hash(0)},
+}
+
+// Returns the identifier of the given signature algorithm, as it is
+// marshalled for the given signer
+func signatureAlgorithmIdentifier(alg x509.SignatureAlgorithm, signer crypto.Signer) (pkix.AlgorithmIdentifier, error) {
+	details, ok := signatureAlgorithmDetails[alg]
+	if !ok {
+		return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported signature algorithm %s", alg)
+	}
+	sigAlg := pkix.AlgorithmIdentifier{
+		Algorithm: details.oid,
+	}
+	// RSA algorithm identifiers carry explicit NULL parameters
+	if _, ok := signer.Public().(*rsa.PublicKey); ok {
+		sigAlg.Parameters = asn1.RawValue{Tag: asn1.TagNull}
+	}
+	return sigAlg, nil
+}
+
+// Signs the given data with the given signature algorithm
+func signHashed(alg x509.SignatureAlgorithm, signer crypto.Signer, data []byte) ([]byte, error) {
+	details, ok := signatureAlgorithmDetails[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm %s", alg)
+	}
+	if details.hash == crypto.Hash(0) {
+		return signer.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+	h := details.hash.New()
+	h.Write(data)
+	return signer.Sign(rand.Reader, h.Sum(nil), details.hash)
+}
+
+// The ASN.1 structures of an X.509 v1 certificate. The standard library
+// always produces v3 certificates, so these are marshalled by hand.
+type v1Certificate struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+type v1TBSCertificate struct {
+	SerialNumber       *big.Int
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Issuer             asn1.RawValue
+	Validity           v1Validity
+	Subject            asn1.RawValue
+	PublicKey          asn1.RawValue
+}
+
+type v1Validity struct {
+	NotBefore, NotAfter time.Time
+}
+
+// Creates an X.509 v1 certificate from the serial number, subject, and
+// validity of the given template; everything else in the template, and in
+// particular any extension, is ignored. Only used for legacy clients that
+// cannot parse v3 certificates.
+func createV1Certificate(template, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) ([]byte, error) {
+	sigAlg, err := signatureAlgorithmIdentifier(template.SignatureAlgorithm, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	subjectBytes := template.RawSubject
+	if len(subjectBytes) == 0 {
+		subjectBytes, err = asn1.Marshal(template.Subject.ToRDNSequence())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tbsBytes, err := asn1.Marshal(v1TBSCertificate{
+		SerialNumber:       template.SerialNumber,
+		SignatureAlgorithm: sigAlg,
+		Issuer:             asn1.RawValue{FullBytes: parent.RawSubject},
+		Validity: v1Validity{
+			NotBefore: template.NotBefore.UTC().Truncate(time.Second),
+			NotAfter:  template.NotAfter.UTC().Truncate(time.Second),
+		},
+		Subject:   asn1.RawValue{FullBytes: subjectBytes},
+		PublicKey: asn1.RawValue{FullBytes: publicKeyBytes},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signHashed(template.SignatureAlgorithm, signer, tbsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(v1Certificate{
+		TBSCertificate:     asn1.RawValue{FullBytes: tbsBytes},
+		SignatureAlgorithm: sigAlg,
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+}
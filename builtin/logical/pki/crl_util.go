@@ -1,10 +1,12 @@
 package pki
 
 import (
-	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"fmt"
+	"math/big"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault/helper/certutil"
@@ -14,10 +16,42 @@ import (
 type revocationInfo struct {
 	CertificateBytes []byte `json:"certificate_bytes"`
 	RevocationTime   int64  `json:"revocation_time"`
+	Reason           int    `json:"reason,omitempty"`
 }
 
-// Revokes a cert, and tries to be smart about error recovery
-func revokeCert(b *backend, req *logical.Request, serial string) (*logical.Response, error) {
+// The CRL entry extension holding the revocation reason, from RFC 5280
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// The RFC 5280 revocation reasons that can be given when revoking. 7 is
+// unused, and removeFromCRL (8) only has meaning in delta CRLs.
+var revocationReasons = map[string]int{
+	"unspecified":          0,
+	"keycompromise":        1,
+	"cacompromise":         2,
+	"affiliationchanged":   3,
+	"superseded":           4,
+	"cessationofoperation": 5,
+	"certificatehold":      6,
+	"privilegewithdrawn":   9,
+	"aacompromise":         10,
+}
+
+// Returns the code of the named revocation reason, compared without
+// regard to case. An empty name is unspecified.
+func parseRevocationReason(name string) (int, error) {
+	if len(name) == 0 {
+		return 0, nil
+	}
+	reason, ok := revocationReasons[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown revocation reason %s", name)
+	}
+	return reason, nil
+}
+
+// Revokes a cert, and tries to be smart about error recovery. The reason is
+// an RFC 5280 reason code; it is not changed if the cert was already revoked.
+func revokeCert(b *backend, req *logical.Request, serial string, reason int) (*logical.Response, error) {
 	alreadyRevoked := false
 	var revInfo revocationInfo
 
@@ -71,6 +105,7 @@ func revokeCert(b *backend, req *logical.Request, serial string) (*logical.Respo
 
 		revInfo.CertificateBytes = certEntry.Value
 		revInfo.RevocationTime = time.Now().Unix()
+		revInfo.Reason = reason
 
 		certEntry, err = logical.StorageEntryJSON("revoked/"+serial, revInfo)
 		if err != nil {
@@ -84,7 +119,7 @@ func revokeCert(b *backend, req *logical.Request, serial string) (*logical.Respo
 
 	}
 
-	crlErr := buildCRL(b, req)
+	crlErr := buildDeltaCRL(b, req)
 	switch crlErr.(type) {
 	case certutil.UserError:
 		return logical.ErrorResponse(fmt.Sprintf("Error during CRL building: %s", crlErr)), nil
@@ -105,19 +140,166 @@ func revokeCert(b *backend, req *logical.Request, serial string) (*logical.Respo
 	}, nil
 }
 
+// Revokes every valid certificate whose common name or one of whose DNS SANs
+// is the given name, compared without regard to case, rebuilding the CRL
+// once for all of them. Returns the serials of the revoked certificates.
+// The caller must hold the revocation lock.
+func revokeCertsByName(b *backend, req *logical.Request, name string, reason int) ([]string, error) {
+	signingBundle, caErr := fetchCAInfo(req)
+	if caErr != nil {
+		return nil, caErr
+	}
+
+	serials, err := req.Storage.List("certs/")
+	if err != nil {
+		return nil, certutil.InternalError{Err: fmt.Sprintf("Error fetching list of certs: %s", err)}
+	}
+
+	now := time.Now()
+	revoked := []string{}
+	for _, serial := range serials {
+		certEntry, err := req.Storage.Get("certs/" + serial)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error fetching certificate %s: %s", serial, err)}
+		}
+		if certEntry == nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(certEntry.Value)
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Unable to parse stored certificate with serial %s: %s", serial, err)}
+		}
+
+		// Nothing here should be a CA, but revoking one by a name match
+		// would be far worse than missing it
+		if cert.IsCA || cert.SerialNumber.Cmp(signingBundle.Certificate.SerialNumber) == 0 {
+			continue
+		}
+		// As for a single revocation, expired certificates are left be
+		if cert.NotAfter.Before(now) {
+			continue
+		}
+
+		matches := strings.EqualFold(cert.Subject.CommonName, name)
+		for _, dnsName := range cert.DNSNames {
+			matches = matches || strings.EqualFold(dnsName, name)
+		}
+		if !matches {
+			continue
+		}
+
+		entry, err := logical.StorageEntryJSON("revoked/"+serial, revocationInfo{
+			CertificateBytes: certEntry.Value,
+			RevocationTime:   now.Unix(),
+			Reason:           reason,
+		})
+		if err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error creating revocation entry: %s", err)}
+		}
+		if err := req.Storage.Put(entry); err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error saving revoked certificate %s: %s", serial, err)}
+		}
+		revoked = append(revoked, serial)
+	}
+	if len(revoked) == 0 {
+		return revoked, nil
+	}
+
+	// As in revokeCert, the certificates are only removed from certs/ once
+	// the CRL has them, so a failure part way can be retried
+	if err := buildDeltaCRL(b, req); err != nil {
+		return nil, err
+	}
+	for _, serial := range revoked {
+		if err := req.Storage.Delete("certs/" + serial); err != nil {
+			return nil, certutil.InternalError{Err: fmt.Sprintf("Error deleting cert %s from valid-certs location: %s", serial, err)}
+		}
+	}
+
+	return revoked, nil
+}
+
 // Builds a CRL by going through the list of revoked certificates and building
-// a new CRL with the stored revocation times and serial numbers.
+// a new CRL with the stored revocation times and serial numbers. If there is
+// a previous CA, certificates it issued are placed on its own CRL instead.
 //
-// If a certificate has already expired, it will be removed entirely rather than
-// become part of the new CRL.
+// If a certificate has already expired and the CRL config excludes expired
+// certificates, it will be removed entirely rather than become part of the
+// new CRL.
 func buildCRL(b *backend, req *logical.Request) error {
+	return buildCRLs(b, req, false)
+}
+
+// Builds only the delta CRL of the certificates revoked since the last full
+// CRL, if the CRL config enables delta CRLs, or else the full CRL. The
+// previous CA's CRL, if any, is always rebuilt in full.
+func buildDeltaCRL(b *backend, req *logical.Request) error {
+	return buildCRLs(b, req, true)
+}
+
+// The numbering of the active CA's CRLs. Full and delta CRLs share the one
+// sequence, as RFC 5280 requires; a delta CRL names the full CRL it is
+// based on, and lists what was revoked since that was built.
+type crlState struct {
+	Number     int64 `json:"number"`
+	BaseNumber int64 `json:"base_number"`
+	BaseTime   int64 `json:"base_time"`
+}
+
+func buildCRLs(b *backend, req *logical.Request, delta bool) error {
+	signingBundle, caErr := fetchCAInfo(req)
+	switch caErr.(type) {
+	case certutil.UserError:
+		return certutil.UserError{Err: fmt.Sprintf("Could not fetch the CA certificate: %s", caErr)}
+	case certutil.InternalError:
+		return certutil.InternalError{Err: fmt.Sprintf("Error fetching CA certificate: %s", caErr)}
+	}
+
+	previousBundle, err := fetchStoredCABundle(req.Storage, "config/ca_previous_bundle")
+	if err != nil {
+		return certutil.InternalError{Err: fmt.Sprintf("Error fetching previous CA certificate: %s", err)}
+	}
+
+	crlLifetime := b.crlLifetime
+	excludeExpired := false
+	retainExpired := false
+	deltaEnabled := false
+	var deltaURL string
+	crlInfo, err := b.CRL(req.Storage)
+	if err != nil {
+		return certutil.InternalError{Err: fmt.Sprintf("Error fetching CRL config information: %s", err)}
+	}
+	if crlInfo != nil {
+		crlDur, err := time.ParseDuration(crlInfo.Expiry)
+		if err != nil {
+			return certutil.InternalError{Err: fmt.Sprintf("Error parsing CRL duration of %s", crlInfo.Expiry)}
+		}
+		crlLifetime = crlDur
+		excludeExpired = crlInfo.ExcludeExpiredFromCRL
+		retainExpired = crlInfo.RetainExpiredRevoked
+		deltaEnabled = crlInfo.EnableDelta
+		deltaURL = crlInfo.DeltaURL
+	}
+	delta = delta && deltaEnabled
+
+	var state crlState
+	stateEntry, err := req.Storage.Get("crl_state")
+	if err != nil {
+		return certutil.InternalError{Err: fmt.Sprintf("Error fetching CRL numbering: %s", err)}
+	}
+	if stateEntry != nil {
+		if err := stateEntry.DecodeJSON(&state); err != nil {
+			return certutil.InternalError{Err: fmt.Sprintf("Error decoding CRL numbering: %s", err)}
+		}
+	}
+
 	revokedSerials, err := req.Storage.List("revoked/")
 	if err != nil {
 		return certutil.InternalError{Err: fmt.Sprintf("Error fetching list of revoked certs: %s", err)}
 	}
 
 	revokedCerts := []pkix.RevokedCertificate{}
-	var revInfo revocationInfo
+	previousRevokedCerts := []pkix.RevokedCertificate{}
 	for _, serial := range revokedSerials {
 		revokedEntry, err := req.Storage.Get("revoked/" + serial)
 		if err != nil {
@@ -133,6 +315,7 @@ func buildCRL(b *backend, req *logical.Request) error {
 			return certutil.InternalError{Err: fmt.Sprintf("Found revoked serial but actual certificate is empty")}
 		}
 
+		var revInfo revocationInfo
 		err = revokedEntry.DecodeJSON(&revInfo)
 		if err != nil {
 			return certutil.InternalError{Err: fmt.Sprintf("Error decoding revocation entry for serial %s: %s", serial, err)}
@@ -143,48 +326,164 @@ func buildCRL(b *backend, req *logical.Request) error {
 			return certutil.InternalError{Err: fmt.Sprintf("Unable to parse stored revoked certificate with serial %s: %s", serial, err)}
 		}
 
-		if revokedCert.NotAfter.Before(time.Now()) {
-			err = req.Storage.Delete(serial)
-			if err != nil {
-				return certutil.InternalError{Err: fmt.Sprintf("Unable to delete revoked, expired certificate with serial %s: %s", serial, err)}
+		// An expired certificate need not stay on the CRL, per RFC 5280,
+		// and once off it the entry is only kept if asked for
+		if excludeExpired && revokedCert.NotAfter.Before(time.Now()) {
+			if !retainExpired {
+				err = req.Storage.Delete("revoked/" + serial)
+				if err != nil {
+					return certutil.InternalError{Err: fmt.Sprintf("Unable to delete revoked, expired certificate with serial %s: %s", serial, err)}
+				}
 			}
 			continue
 		}
 
-		revokedCerts = append(revokedCerts, pkix.RevokedCertificate{
+		crlEntry := pkix.RevokedCertificate{
 			SerialNumber:   revokedCert.SerialNumber,
 			RevocationTime: time.Unix(revInfo.RevocationTime, 0),
-		})
+		}
+		// RFC 5280 says to leave the reason out rather than give it as
+		// unspecified
+		if revInfo.Reason != 0 {
+			reasonBytes, err := asn1.Marshal(asn1.Enumerated(revInfo.Reason))
+			if err != nil {
+				return certutil.InternalError{Err: fmt.Sprintf("Error encoding revocation reason for serial %s: %s", serial, err)}
+			}
+			crlEntry.Extensions = []pkix.Extension{
+				{
+					Id:    oidExtensionReasonCode,
+					Value: reasonBytes,
+				},
+			}
+		}
+		switch {
+		case previousBundle != nil && revokedCert.CheckSignatureFrom(previousBundle.Certificate) == nil:
+			previousRevokedCerts = append(previousRevokedCerts, crlEntry)
+		// A delta CRL lists only what the full CRL it is based on does
+		// not. Anything revoked in the second that was built may be on
+		// both, which is harmless.
+		case delta && revInfo.RevocationTime < state.BaseTime:
+		default:
+			revokedCerts = append(revokedCerts, crlEntry)
+		}
 	}
 
-	signingBundle, caErr := fetchCAInfo(req)
-	switch caErr.(type) {
-	case certutil.UserError:
-		return certutil.UserError{Err: fmt.Sprintf("Could not fetch the CA certificate: %s", caErr)}
-	case certutil.InternalError:
-		return certutil.InternalError{Err: fmt.Sprintf("Error fetching CA certificate: %s", caErr)}
+	deltaIndicator := func() (pkix.Extension, error) {
+		value, err := asn1.Marshal(big.NewInt(state.BaseNumber))
+		return pkix.Extension{Id: oidExtensionDeltaCRLIndicator, Critical: true, Value: value}, err
 	}
 
-	crlLifetime := b.crlLifetime
-	crlInfo, err := b.CRL(req.Storage)
+	now := time.Now()
+	state.Number++
+	if delta {
+		indicator, err := deltaIndicator()
+		if err != nil {
+			return certutil.InternalError{Err: fmt.Sprintf("Error encoding delta CRL indicator: %s", err)}
+		}
+		if err := storeCRL(req, "crl_delta", signingBundle, revokedCerts, now, crlLifetime, state.Number, []pkix.Extension{indicator}); err != nil {
+			return err
+		}
+	} else {
+		var extensions []pkix.Extension
+		if deltaEnabled && len(deltaURL) != 0 {
+			freshest, err := asn1.Marshal([]distributionPoint{
+				{
+					DistributionPoint: distributionPointName{
+						FullName: []asn1.RawValue{
+							{Tag: 6, Class: asn1.ClassContextSpecific, Bytes: []byte(deltaURL)},
+						},
+					},
+				},
+			})
+			if err != nil {
+				return certutil.InternalError{Err: fmt.Sprintf("Error encoding freshest CRL extension: %s", err)}
+			}
+			extensions = append(extensions, pkix.Extension{Id: oidExtensionFreshestCRL, Value: freshest})
+		}
+		if err := storeCRL(req, "crl", signingBundle, revokedCerts, now, crlLifetime, state.Number, extensions); err != nil {
+			return err
+		}
+		state.BaseNumber = state.Number
+		state.BaseTime = now.Unix()
+
+		// The delta CRL based on the previous full CRL is now stale
+		if deltaEnabled {
+			state.Number++
+			indicator, err := deltaIndicator()
+			if err != nil {
+				return certutil.InternalError{Err: fmt.Sprintf("Error encoding delta CRL indicator: %s", err)}
+			}
+			if err := storeCRL(req, "crl_delta", signingBundle, []pkix.RevokedCertificate{}, now, crlLifetime, state.Number, []pkix.Extension{indicator}); err != nil {
+				return err
+			}
+		}
+	}
+
+	stateEntry, err = logical.StorageEntryJSON("crl_state", state)
 	if err != nil {
-		return certutil.InternalError{Err: fmt.Sprintf("Error fetching CRL config information: %s", err)}
+		return certutil.InternalError{Err: fmt.Sprintf("Error encoding CRL numbering: %s", err)}
 	}
-	if crlInfo != nil {
-		crlDur, err := time.ParseDuration(crlInfo.Expiry)
-		if err != nil {
-			return certutil.InternalError{Err: fmt.Sprintf("Error parsing CRL duration of %s", crlInfo.Expiry)}
+	if err := req.Storage.Put(stateEntry); err != nil {
+		return certutil.InternalError{Err: fmt.Sprintf("Error storing CRL numbering: %s", err)}
+	}
+
+	if previousBundle != nil {
+		if err := storeCRL(req, "crl_previous", previousBundle, previousRevokedCerts, now, crlLifetime, 0, nil); err != nil {
+			return err
 		}
-		crlLifetime = crlDur
 	}
 
-	crlBytes, err := signingBundle.Certificate.CreateCRL(rand.Reader, signingBundle.PrivateKey, revokedCerts, time.Now(), time.Now().Add(crlLifetime))
+	return nil
+}
+
+var (
+	oidExtensionAuthorityKeyID    = asn1.ObjectIdentifier{2, 5, 29, 35}
+	oidExtensionCRLNumber         = asn1.ObjectIdentifier{2, 5, 29, 20}
+	oidExtensionDeltaCRLIndicator = asn1.ObjectIdentifier{2, 5, 29, 27}
+	oidExtensionFreshestCRL       = asn1.ObjectIdentifier{2, 5, 29, 46}
+)
+
+// The ASN.1 structures of a CRL. The standard library cannot add a CRL
+// number or other extensions to a CRL signed with an arbitrary CA, so
+// these are marshalled by hand.
+type certificateList struct {
+	TBSCertList        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+type tbsCertificateList struct {
+	Version             int `asn1:"optional,default:0"`
+	Signature           pkix.AlgorithmIdentifier
+	Issuer              asn1.RawValue
+	ThisUpdate          time.Time
+	NextUpdate          time.Time                 `asn1:"optional"`
+	RevokedCertificates []pkix.RevokedCertificate `asn1:"optional"`
+	Extensions          []pkix.Extension          `asn1:"tag:0,optional,explicit"`
+}
+
+type authorityKeyID struct {
+	ID []byte `asn1:"optional,tag:0"`
+}
+
+type distributionPoint struct {
+	DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+}
+
+type distributionPointName struct {
+	FullName []asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// Signs a CRL of the given revoked certificates with the given CA and
+// stores it at the given key. A CRL number of 0 is left out.
+func storeCRL(req *logical.Request, key string, signingBundle *certutil.ParsedCertBundle, revokedCerts []pkix.RevokedCertificate, now time.Time, crlLifetime time.Duration, number int64, extensions []pkix.Extension) error {
+	crlBytes, err := createCRL(signingBundle, revokedCerts, now, crlLifetime, number, extensions)
 	if err != nil {
 		return certutil.InternalError{Err: fmt.Sprintf("Error creating new CRL: %s", err)}
 	}
 
 	err = req.Storage.Put(&logical.StorageEntry{
-		Key:   "crl",
+		Key:   key,
 		Value: crlBytes,
 	})
 	if err != nil {
@@ -193,3 +492,62 @@ func buildCRL(b *backend, req *logical.Request) error {
 
 	return nil
 }
+
+func createCRL(signingBundle *certutil.ParsedCertBundle, revokedCerts []pkix.RevokedCertificate, now time.Time, crlLifetime time.Duration, number int64, extensions []pkix.Extension) ([]byte, error) {
+	alg, err := signatureAlgorithm(signingBundle.PrivateKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg, err := signatureAlgorithmIdentifier(alg, signingBundle.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var crlExtensions []pkix.Extension
+	if len(signingBundle.Certificate.SubjectKeyId) != 0 {
+		value, err := asn1.Marshal(authorityKeyID{ID: signingBundle.Certificate.SubjectKeyId})
+		if err != nil {
+			return nil, err
+		}
+		crlExtensions = append(crlExtensions, pkix.Extension{Id: oidExtensionAuthorityKeyID, Value: value})
+	}
+	if number != 0 {
+		value, err := asn1.Marshal(big.NewInt(number))
+		if err != nil {
+			return nil, err
+		}
+		crlExtensions = append(crlExtensions, pkix.Extension{Id: oidExtensionCRLNumber, Value: value})
+	}
+	crlExtensions = append(crlExtensions, extensions...)
+
+	// Revocation times are converted the same way as the update times
+	entries := make([]pkix.RevokedCertificate, len(revokedCerts))
+	for i, entry := range revokedCerts {
+		entry.RevocationTime = entry.RevocationTime.UTC()
+		entries[i] = entry
+	}
+
+	tbsBytes, err := asn1.Marshal(tbsCertificateList{
+		Version:             1,
+		Signature:           sigAlg,
+		Issuer:              asn1.RawValue{FullBytes: signingBundle.Certificate.RawSubject},
+		ThisUpdate:          now.UTC().Truncate(time.Second),
+		NextUpdate:          now.Add(crlLifetime).UTC().Truncate(time.Second),
+		RevokedCertificates: entries,
+		Extensions:          crlExtensions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signHashed(alg, signingBundle.PrivateKey, tbsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(certificateList{
+		TBSCertList:        asn1.RawValue{FullBytes: tbsBytes},
+		SignatureAlgorithm: sigAlg,
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+}
@@ -0,0 +1,492 @@
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_excludeExpiredFromCRL(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+		}
+		return resp
+	}
+	crlSerials := func() map[string]bool {
+		request(logical.ReadOperation, "crl/rotate", nil)
+		resp := request(logical.ReadOperation, "crl", nil)
+		crl, err := x509.ParseCRL(resp.Data[logical.HTTPRawBody].([]byte))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serials := map[string]bool{}
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			serials[revoked.SerialNumber.String()] = true
+		}
+		return serials
+	}
+
+	// A certificate revoked while it was valid, which has since expired
+	signingBundle, err := fetchCAInfo(&logical.Request{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := createCertificate(&certCreationBundle{
+		SigningBundle: signingBundle,
+		CACert:        signingBundle.Certificate,
+		CommonNames:   []string{"expired.example.com"},
+		KeyType:       "rsa",
+		KeyBits:       2048,
+		TTL:           -time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredPath := "revoked/" + certutil.GetOctalFormatted(expired.Certificate.SerialNumber.Bytes(), ":")
+	entry, err := logical.StorageEntryJSON(expiredPath, revocationInfo{
+		CertificateBytes: expired.CertificateBytes,
+		RevocationTime:   time.Now().Add(-2 * time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	request(logical.WriteOperation, "roles/test", map[string]interface{}{
+		"allow_any_name": true,
+	})
+	valid := parseIssuedCert(t, request(logical.WriteOperation, "issue/test", map[string]interface{}{
+		"common_name": "valid.example.com",
+	}))
+	request(logical.WriteOperation, "revoke", map[string]interface{}{
+		"serial_number": certutil.GetOctalFormatted(valid.SerialNumber.Bytes(), ":"),
+	})
+
+	// Included by default
+	serials := crlSerials()
+	if !serials[expired.Certificate.SerialNumber.String()] || !serials[valid.SerialNumber.String()] {
+		t.Fatalf("expected both certificates on the CRL, got %v", serials)
+	}
+
+	storedRevoked := func() bool {
+		entry, err := storage.Get(expiredPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry != nil
+	}
+
+	// Left off, but kept in storage when retained
+	request(logical.WriteOperation, "config/crl", map[string]interface{}{
+		"exclude_expired_from_crl": true,
+		"retain_expired_revoked":   true,
+	})
+	resp := request(logical.ReadOperation, "config/crl", nil)
+	if resp.Data["exclude_expired_from_crl"] != true || resp.Data["retain_expired_revoked"] != true || resp.Data["expiry"] != "72h" {
+		t.Fatalf("bad config: %#v", resp.Data)
+	}
+	serials = crlSerials()
+	if serials[expired.Certificate.SerialNumber.String()] || !serials[valid.SerialNumber.String()] {
+		t.Fatalf("expected only the valid certificate on the CRL, got %v", serials)
+	}
+	if !storedRevoked() {
+		t.Fatalf("expected the expired revoked certificate to be retained")
+	}
+
+	// Otherwise removed from storage as well
+	request(logical.WriteOperation, "config/crl", map[string]interface{}{
+		"exclude_expired_from_crl": true,
+	})
+	serials = crlSerials()
+	if serials[expired.Certificate.SerialNumber.String()] || !serials[valid.SerialNumber.String()] {
+		t.Fatalf("expected only the valid certificate on the CRL, got %v", serials)
+	}
+	if storedRevoked() {
+		t.Fatalf("expected the expired revoked certificate to be removed")
+	}
+
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "config/crl",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"expiry": "-1h",
+		},
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected a negative expiry to be rejected: resp: %#v, err: %v", resp, err)
+	}
+}
+
+func TestBackend_revocationReason(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	request("roles/test", map[string]interface{}{
+		"allow_any_name": true,
+	})
+	issue := func() string {
+		cert := parseIssuedCert(t, request("issue/test", map[string]interface{}{
+			"common_name": "foo.example.com",
+		}))
+		return certutil.GetOctalFormatted(cert.SerialNumber.Bytes(), ":")
+	}
+
+	compromised, unspecified := issue(), issue()
+	if resp := request("revoke", map[string]interface{}{
+		"serial_number": compromised,
+		"reason":        "keyCompromise",
+	}); resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if resp := request("revoke", map[string]interface{}{
+		"serial_number": unspecified,
+	}); resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if resp := request("revoke", map[string]interface{}{
+		"serial_number": issue(),
+		"reason":        "lostIt",
+	}); !resp.IsError() {
+		t.Fatalf("expected an unknown reason to be rejected, got: %#v", resp)
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "crl",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(resp.Data[logical.HTTPRawBody].([]byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[string]int{}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		serial := certutil.GetOctalFormatted(revoked.SerialNumber.Bytes(), ":")
+		reasons[serial] = -1
+		for _, ext := range revoked.Extensions {
+			if ext.Id.Equal(oidExtensionReasonCode) {
+				var reason asn1.Enumerated
+				if _, err := asn1.Unmarshal(ext.Value, &reason); err != nil {
+					t.Fatal(err)
+				}
+				reasons[serial] = int(reason)
+			}
+		}
+	}
+	// An unspecified reason is left out of the entry
+	if len(reasons) != 2 || reasons[compromised] != 1 || reasons[unspecified] != -1 {
+		t.Fatalf("bad CRL reasons: %v", reasons)
+	}
+}
+
+func TestBackend_deltaCRL(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+		}
+		return resp
+	}
+	fetchCRL := func(path string) *x509.RevocationList {
+		resp := request(logical.ReadOperation, path, nil)
+		crl, err := x509.ParseRevocationList(resp.Data[logical.HTTPRawBody].([]byte))
+		if err != nil {
+			t.Fatalf("error parsing %s: %s", path, err)
+		}
+		return crl
+	}
+	extension := func(crl *x509.RevocationList, id asn1.ObjectIdentifier) *pkix.Extension {
+		for _, ext := range crl.Extensions {
+			if ext.Id.Equal(id) {
+				return &ext
+			}
+		}
+		return nil
+	}
+	baseNumber := func(crl *x509.RevocationList) int64 {
+		ext := extension(crl, oidExtensionDeltaCRLIndicator)
+		if ext == nil || !ext.Critical {
+			t.Fatalf("expected a critical delta CRL indicator, got %#v", crl.Extensions)
+		}
+		var number *big.Int
+		if _, err := asn1.Unmarshal(ext.Value, &number); err != nil {
+			t.Fatal(err)
+		}
+		return number.Int64()
+	}
+	serials := func(crl *x509.RevocationList) []string {
+		var result []string
+		for _, entry := range crl.RevokedCertificateEntries {
+			result = append(result, entry.SerialNumber.String())
+		}
+		return result
+	}
+
+	request(logical.WriteOperation, "roles/test", map[string]interface{}{
+		"allow_any_name": true,
+	})
+	issue := func() *x509.Certificate {
+		return parseIssuedCert(t, request(logical.WriteOperation, "issue/test", map[string]interface{}{
+			"common_name": "foo.example.com",
+		}))
+	}
+	revoke := func(cert *x509.Certificate) {
+		request(logical.WriteOperation, "revoke", map[string]interface{}{
+			"serial_number": certutil.GetOctalFormatted(cert.SerialNumber.Bytes(), ":"),
+		})
+	}
+
+	// Revoked before the full CRL is built; it is planted so that it is
+	// not revoked in the same second as the build
+	first := issue()
+	entry, err := logical.StorageEntryJSON("revoked/"+certutil.GetOctalFormatted(first.SerialNumber.Bytes(), ":"), revocationInfo{
+		CertificateBytes: first.Raw,
+		RevocationTime:   time.Now().Add(-time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	request(logical.WriteOperation, "config/crl", map[string]interface{}{
+		"enable_delta": true,
+		"delta_url":    "http://example.com/crl/delta",
+	})
+	request(logical.ReadOperation, "crl/rotate", nil)
+	base := fetchCRL("crl")
+	if extension(base, oidExtensionFreshestCRL) == nil {
+		t.Fatalf("expected a freshest CRL extension on the full CRL")
+	}
+	if deltaCRL := fetchCRL("crl/delta"); baseNumber(deltaCRL) != base.Number.Int64() || len(serials(deltaCRL)) != 0 {
+		t.Fatalf("expected an empty delta CRL based on CRL %s, got %v based on %d", base.Number, serials(deltaCRL), baseNumber(deltaCRL))
+	}
+
+	// Revoking only touches the delta CRL
+	second := issue()
+	revoke(second)
+	if full := fetchCRL("crl"); full.Number.Cmp(base.Number) != 0 {
+		t.Fatalf("expected the full CRL to be unchanged")
+	}
+	deltaCRL := fetchCRL("crl/delta")
+	if baseNumber(deltaCRL) != base.Number.Int64() || deltaCRL.Number.Cmp(base.Number) <= 0 {
+		t.Fatalf("bad delta CRL numbering: %s based on %d", deltaCRL.Number, baseNumber(deltaCRL))
+	}
+	if got := serials(deltaCRL); len(got) != 1 || got[0] != second.SerialNumber.String() {
+		t.Fatalf("expected only the newly revoked certificate on the delta CRL, got %v", got)
+	}
+
+	// A rotation folds it into a new full CRL
+	request(logical.ReadOperation, "crl/rotate", nil)
+	full := fetchCRL("crl")
+	if full.Number.Cmp(deltaCRL.Number) <= 0 || len(serials(full)) != 2 {
+		t.Fatalf("bad full CRL: number %s, entries %v", full.Number, serials(full))
+	}
+	if deltaCRL := fetchCRL("crl/delta"); baseNumber(deltaCRL) != full.Number.Int64() || len(serials(deltaCRL)) != 0 {
+		t.Fatalf("expected an empty delta CRL based on the new full CRL")
+	}
+}
+
+// Measures building a CRL with many revoked certificates; run with
+// -benchmem to see the memory used per build
+func BenchmarkBuildCRL(b *testing.B) {
+	backend, err := Factory(&logical.BackendConfig{
+		System: &logical.StaticSystemView{
+			DefaultLeaseTTLVal: time.Hour * 24,
+			MaxLeaseTTLVal:     time.Hour * 24 * 30,
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	storage := &testStorage{}
+	request := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := backend.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			b.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+		}
+	}
+	request(logical.WriteOperation, "config/ca", map[string]interface{}{
+		"pem_bundle": caKey + caCert,
+	})
+
+	signingBundle, err := fetchCAInfo(&logical.Request{Storage: storage})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 1; i <= 1000; i++ {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i)),
+			Subject:      pkix.Name{CommonName: "revoked.example.com"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		certBytes, err := x509.CreateCertificate(rand.Reader, template, signingBundle.Certificate, signingBundle.Certificate.PublicKey, signingBundle.PrivateKey)
+		if err != nil {
+			b.Fatal(err)
+		}
+		entry, err := logical.StorageEntryJSON("revoked/"+certutil.GetOctalFormatted(template.SerialNumber.Bytes(), ":"), revocationInfo{
+			CertificateBytes: certBytes,
+			RevocationTime:   time.Now().Unix(),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := storage.Put(entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request(logical.ReadOperation, "crl/rotate", nil)
+	}
+}
+
+func TestBackend_revokeByName(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	request("roles/test", map[string]interface{}{
+		"allow_any_name": true,
+	})
+	issue := func(cn, altNames string) string {
+		cert := parseIssuedCert(t, request("issue/test", map[string]interface{}{
+			"common_name": cn,
+			"alt_names":   altNames,
+		}))
+		return certutil.GetOctalFormatted(cert.SerialNumber.Bytes(), ":")
+	}
+	byCN, bySAN := issue("foo.example.com", ""), issue("bar.example.com", "foo.example.com")
+	other := issue("baz.example.com", "")
+
+	// An expired certificate for the name is left alone
+	signingBundle, err := fetchCAInfo(&logical.Request{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := createCertificate(&certCreationBundle{
+		SigningBundle: signingBundle,
+		CACert:        signingBundle.Certificate,
+		CommonNames:   []string{"foo.example.com"},
+		KeyType:       "rsa",
+		KeyBits:       2048,
+		TTL:           -time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredSerial := certutil.GetOctalFormatted(expired.Certificate.SerialNumber.Bytes(), ":")
+	if err := storage.Put(&logical.StorageEntry{Key: "certs/" + expiredSerial, Value: expired.CertificateBytes}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := request("revoke-by-name", map[string]interface{}{
+		"name":   "FOO.example.com",
+		"reason": "keyCompromise",
+	})
+	if resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	serials := resp.Data["revoked_serials"].([]string)
+	if len(serials) != 2 || !((serials[0] == byCN && serials[1] == bySAN) || (serials[0] == bySAN && serials[1] == byCN)) {
+		t.Fatalf("expected %s and %s to be revoked, got %v", byCN, bySAN, serials)
+	}
+
+	for serial, valid := range map[string]bool{byCN: false, bySAN: false, other: true, expiredSerial: true} {
+		entry, err := storage.Get("certs/" + serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (entry != nil) != valid {
+			t.Fatalf("expected %s to be valid: %t", serial, valid)
+		}
+	}
+
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "crl",
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(resp.Data[logical.HTTPRawBody].([]byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.TBSCertList.RevokedCertificates) != 2 {
+		t.Fatalf("expected both certificates on the CRL, got %v", crl.TBSCertList.RevokedCertificates)
+	}
+
+	// Nothing left to match
+	resp = request("revoke-by-name", map[string]interface{}{
+		"name": "foo.example.com",
+	})
+	if serials := resp.Data["revoked_serials"].([]string); len(serials) != 0 {
+		t.Fatalf("expected nothing more to be revoked, got %v", serials)
+	}
+	if resp := request("revoke-by-name", map[string]interface{}{}); !resp.IsError() {
+		t.Fatalf("expected a missing name to be rejected, got: %#v", resp)
+	}
+}
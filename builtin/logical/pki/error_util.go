@@ -0,0 +1,47 @@
+package pki
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// The error_type of responses to requests that need fixing, so that API
+// consumers can tell them from faults in the backend, which are plain 500
+// errors
+const errorTypeUser = "user"
+
+// Converts a certutil.UserError into a raw JSON response with a status code
+// of 400, whose body has the same errors list as any other Vault error plus
+// an error_type of user. Any other error, including a
+// certutil.InternalError, is returned as-is, so that it is still recorded
+// as a failure of the backend, and is reported with a status code of 500.
+func certErrorResponse(err error) (*logical.Response, error) {
+	if _, ok := err.(certutil.UserError); !ok {
+		return nil, err
+	}
+
+	body, jsonErr := json.Marshal(map[string]interface{}{
+		"errors":     []string{err.Error()},
+		"error_type": errorTypeUser,
+	})
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/json",
+			logical.HTTPRawBody:     body,
+			logical.HTTPStatusCode:  http.StatusBadRequest,
+		},
+	}, nil
+}
+
+// Returns the response for a request that cannot be satisfied as given,
+// as certErrorResponse does for a certutil.UserError
+func userErrorResponse(msg string) (*logical.Response, error) {
+	return certErrorResponse(certutil.UserError{Err: msg})
+}
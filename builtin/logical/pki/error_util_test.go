@@ -0,0 +1,72 @@
+package pki
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// Returns the message of a response built by certErrorResponse, or an
+// empty string for any other response
+func userErrorMessage(resp *logical.Response) string {
+	if resp == nil {
+		return ""
+	}
+	body, ok := resp.Data[logical.HTTPRawBody].([]byte)
+	if !ok {
+		return ""
+	}
+	var parsed struct {
+		Errors    []string `json:"errors"`
+		ErrorType string   `json:"error_type"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil || parsed.ErrorType != errorTypeUser || len(parsed.Errors) != 1 {
+		return ""
+	}
+	return parsed.Errors[0]
+}
+
+// Returns whether the response is one built by certErrorResponse
+func isUserError(resp *logical.Response) bool {
+	return len(userErrorMessage(resp)) != 0
+}
+
+// Returns whether the response is an error of either kind: a
+// logical.ErrorResponse or one built by certErrorResponse
+func isErrorResponse(resp *logical.Response) bool {
+	return resp.IsError() || isUserError(resp)
+}
+
+// Returns the message of an error response of either kind
+func errorMessage(resp *logical.Response) string {
+	if resp.IsError() {
+		return resp.Data["error"].(string)
+	}
+	return userErrorMessage(resp)
+}
+
+func TestCertErrorResponse(t *testing.T) {
+	userErr := certutil.UserError{Err: "bad request"}
+	resp, err := certErrorResponse(userErr)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status := resp.Data[logical.HTTPStatusCode]; status != http.StatusBadRequest {
+		t.Fatalf("bad status: %v", status)
+	}
+	if contentType := resp.Data[logical.HTTPContentType]; contentType != "application/json" {
+		t.Fatalf("bad content type: %v", contentType)
+	}
+	if msg := userErrorMessage(resp); msg != userErr.Error() {
+		t.Fatalf("bad message: %s", msg)
+	}
+
+	// Faults in the backend stay errors
+	internalErr := certutil.InternalError{Err: "broken"}
+	if resp, err := certErrorResponse(internalErr); resp != nil || err != internalErr {
+		t.Fatalf("expected the error to be passed through, got: resp: %#v, err: %v", resp, err)
+	}
+}
@@ -0,0 +1,58 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"fmt"
+
+	"github.com/hashicorp/vault/helper/certutil"
+)
+
+// The smallest RSA key allowed in FIPS mode
+const fipsMinRSABits = 2048
+
+// Returns a UserError naming the offending parameter if a key of the given
+// type and size is not approved for use in FIPS mode. RSA keys must be at
+// least 2048 bits and EC keys on the P-256, P-384, or P-521 curves; Ed25519
+// is not approved at all.
+func checkFIPSKey(keyType string, keyBits int) error {
+	switch keyType {
+	case "rsa":
+		if keyBits < fipsMinRSABits {
+			return certutil.UserError{Err: fmt.Sprintf("key_bits of %d is not allowed for RSA keys in FIPS mode; at least %d is required", keyBits, fipsMinRSABits)}
+		}
+	case "ec":
+		switch keyBits {
+		case 256, 384, 521:
+		default:
+			return certutil.UserError{Err: fmt.Sprintf("key_bits of %d is not allowed for EC keys in FIPS mode; must be 256, 384, or 521", keyBits)}
+		}
+	default:
+		return certutil.UserError{Err: fmt.Sprintf("key_type %s is not allowed in FIPS mode; must be rsa or ec", keyType)}
+	}
+	return nil
+}
+
+// As checkFIPSKey, for an existing public key
+func checkFIPSPublicKey(pub crypto.PublicKey) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return checkFIPSKey("rsa", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return checkFIPSKey("ec", pub.Curve.Params().BitSize)
+	case ed25519.PublicKey:
+		return checkFIPSKey("ed25519", 0)
+	default:
+		return certutil.UserError{Err: "unsupported key type"}
+	}
+}
+
+// As checkFIPSKey, for the CA's own key
+func checkFIPSCAKey(pub crypto.PublicKey) error {
+	if err := checkFIPSPublicKey(pub); err != nil {
+		return certutil.UserError{Err: fmt.Sprintf("The CA key is not allowed in FIPS mode: %s", err)}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	// How many events can be waiting to be published in the background
+	// before new events are dropped
+	issuanceLogQueueSize = 1024
+
+	// How many times background publishing of an event is attempted
+	issuanceLogAttempts = 3
+)
+
+// How long to wait between background publishing attempts; multiplied
+// by the attempt number. A variable so tests can shorten it.
+var issuanceLogRetryInterval = time.Second
+
+// issuanceEvent is the record published to the issuance log for every
+// certificate issued
+type issuanceEvent struct {
+	SerialNumber string   `json:"serial_number"`
+	Subject      string   `json:"subject"`
+	DNSNames     []string `json:"dns_names"`
+	IPAddresses  []string `json:"ip_addresses"`
+	URISANs      []string `json:"uri_sans"`
+	OtherSANs    []string `json:"other_sans"`
+	Issuer       string   `json:"issuer"`
+	NotBefore    string   `json:"not_before"`
+	NotAfter     string   `json:"not_after"`
+	Role         string   `json:"role"`
+	Timestamp    string   `json:"timestamp"`
+}
+
+type queuedIssuanceEvent struct {
+	config *issuanceLogConfig
+	event  *issuanceEvent
+}
+
+func newIssuanceEvent(cert *x509.Certificate, roleName string) *issuanceEvent {
+	event := &issuanceEvent{
+		SerialNumber: certutil.GetOctalFormatted(cert.SerialNumber.Bytes(), ":"),
+		Subject:      cert.Subject.String(),
+		DNSNames:     cert.DNSNames,
+		IPAddresses:  []string{},
+		URISANs:      []string{},
+		OtherSANs:    certOtherSANs(cert),
+		Issuer:       cert.Issuer.String(),
+		NotBefore:    cert.NotBefore.UTC().Format(time.RFC3339),
+		NotAfter:     cert.NotAfter.UTC().Format(time.RFC3339),
+		Role:         roleName,
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+	}
+	if event.DNSNames == nil {
+		event.DNSNames = []string{}
+	}
+	for _, ip := range cert.IPAddresses {
+		event.IPAddresses = append(event.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		event.URISANs = append(event.URISANs, uri.String())
+	}
+	return event
+}
+
+// Publishes an issuance event for the given certificate to the configured
+// sink, if any. If the sink is configured as fatal, the event is published
+// synchronously and any error is returned; otherwise the event is queued
+// for background publishing.
+func logIssuance(b *backend, req *logical.Request, cert *x509.Certificate, roleName string) error {
+	config, err := b.IssuanceLog(req.Storage)
+	if err != nil {
+		return fmt.Errorf("Error fetching issuance log configuration: %s", err)
+	}
+	if config == nil {
+		return nil
+	}
+
+	event := newIssuanceEvent(cert, roleName)
+
+	if config.Fatal {
+		if err := b.publishIssuanceEvent(config, event); err != nil {
+			return fmt.Errorf("Error publishing issuance event for serial %s: %s", event.SerialNumber, err)
+		}
+		return nil
+	}
+
+	b.issuanceLogWorkerOnce.Do(func() {
+		go b.issuanceLogWorker()
+	})
+
+	select {
+	case b.issuanceLogQueue <- &queuedIssuanceEvent{config: config, event: event}:
+	default:
+		b.Logger().Printf("[ERR] pki: issuance log queue is full, dropping event for serial %s", event.SerialNumber)
+	}
+
+	return nil
+}
+
+// Publishes queued events until the backend is cleaned up
+func (b *backend) issuanceLogWorker() {
+	for {
+		select {
+		case <-b.issuanceLogStop:
+			return
+		case queued := <-b.issuanceLogQueue:
+			var err error
+			for attempt := 1; attempt <= issuanceLogAttempts; attempt++ {
+				if err = b.publishIssuanceEvent(queued.config, queued.event); err == nil {
+					break
+				}
+				if attempt < issuanceLogAttempts {
+					select {
+					case <-b.issuanceLogStop:
+						return
+					case <-time.After(time.Duration(attempt) * issuanceLogRetryInterval):
+					}
+				}
+			}
+			if err != nil {
+				b.Logger().Printf("[ERR] pki: failed to publish issuance event for serial %s: %s", queued.event.SerialNumber, err)
+			}
+		}
+	}
+}
+
+func (b *backend) publishIssuanceEvent(config *issuanceLogConfig, event *issuanceEvent) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	switch config.Sink {
+	case "file":
+		b.issuanceLogFileLock.Lock()
+		defer b.issuanceLogFileLock.Unlock()
+
+		f, err := os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(eventJSON, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+
+	case "http":
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %s", err)
+		}
+		client := &http.Client{
+			Timeout: timeout,
+		}
+		resp, err := client.Post(config.URL, "application/json", bytes.NewReader(eventJSON))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown sink %q", config.Sink)
+	}
+}
@@ -0,0 +1,158 @@
+package pki
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_issuanceLog(t *testing.T) {
+	issuanceLogRetryInterval = 10 * time.Millisecond
+	defer func() { issuanceLogRetryInterval = time.Second }()
+
+	dir, err := ioutil.TempDir("", "pki-issuance-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "issuance.log")
+
+	b, storage := createBackendWithCA(t)
+	defer b.Cleanup()
+
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || resp.IsError() {
+			t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+		}
+		return resp
+	}
+
+	write("roles/test", map[string]interface{}{
+		"allow_any_name":     true,
+		"allow_ip_sans":      true,
+		"allow_uri_sans":     true,
+		"allowed_other_sans": "*",
+	})
+
+	// Fatal file sink is written before the response is returned
+	write("config/issuance_log", map[string]interface{}{
+		"sink":  "file",
+		"path":  logPath,
+		"fatal": true,
+	})
+	resp := write("issue/test", map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "bar.example.com",
+		"ip_sans":     "127.0.0.1",
+		"uri_sans":    "spiffe://example.com/web",
+		"other_sans":  "1.3.6.1.4.1.311.20.2.3;UTF8:alice@example.com",
+	})
+
+	// Cross-signed CAs are logged too
+	crossResp := write("root/sign-self-issued", map[string]interface{}{
+		"certificate": generateTestCA(t, "Vault Testing CA 2"),
+	})
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(f)
+	var events []issuanceEvent
+	for scanner.Scan() {
+		var event issuanceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	f.Close()
+	if len(events) != 2 {
+		t.Fatalf("expected two events, got %d", len(events))
+	}
+	event := events[0]
+	if event.SerialNumber != resp.Data["serial_number"] ||
+		event.Role != "test" ||
+		!strings.Contains(event.Subject, "CN=foo.example.com") ||
+		len(event.DNSNames) != 2 || event.DNSNames[1] != "bar.example.com" ||
+		len(event.IPAddresses) != 1 || event.IPAddresses[0] != "127.0.0.1" ||
+		len(event.URISANs) != 1 || event.URISANs[0] != "spiffe://example.com/web" ||
+		len(event.OtherSANs) != 1 || event.OtherSANs[0] != "1.3.6.1.4.1.311.20.2.3;UTF8:alice@example.com" ||
+		len(event.Issuer) == 0 || len(event.NotAfter) == 0 || len(event.Timestamp) == 0 {
+		t.Fatalf("bad event: %#v", event)
+	}
+	if event := events[1]; event.SerialNumber != crossResp.Data["serial_number"] || event.Role != "" ||
+		!strings.Contains(event.Subject, "CN=Vault Testing CA 2") {
+		t.Fatalf("bad event for the cross-signed CA: %#v", event)
+	}
+
+	// Best-effort HTTP sink is retried in the background
+	var calls int32
+	received := make(chan issuanceEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event issuanceEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer ts.Close()
+
+	write("config/issuance_log", map[string]interface{}{
+		"sink": "http",
+		"url":  ts.URL,
+	})
+	resp = write("issue/test", map[string]interface{}{
+		"common_name": "baz.example.com",
+	})
+	select {
+	case event := <-received:
+		if event.SerialNumber != resp.Data["serial_number"] {
+			t.Fatalf("bad event: %#v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the event to be published")
+	}
+
+	// A fatal sink that cannot be reached fails the request, and leaves no
+	// certificate behind
+	ts.Close()
+	certs, _ := storage.List("certs/")
+	write("config/issuance_log", map[string]interface{}{
+		"sink":  "http",
+		"url":   ts.URL,
+		"fatal": true,
+	})
+	_, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "issue/test",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"common_name": "foo.example.com",
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected an error with an unreachable fatal sink")
+	}
+	if after, _ := storage.List("certs/"); len(after) != len(certs) {
+		t.Fatalf("expected no new certificate to be stored")
+	}
+}
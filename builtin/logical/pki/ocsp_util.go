@@ -0,0 +1,298 @@
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// OCSP response statuses from RFC 6960. Only a successful response is
+// signed; the others are sent bare.
+const (
+	ocspSuccessful       = 0
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+	ocspUnauthorized     = 6
+)
+
+var (
+	oidOCSPBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNonce         = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+)
+
+// The hashes a request may identify the issuer with
+var ocspHashes = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, crypto.SHA1},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, crypto.SHA256},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}, crypto.SHA384},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}, crypto.SHA512},
+}
+
+// The ASN.1 structures of RFC 6960. There is no OCSP support in the
+// standard library, so these are marshalled by hand, as CRLs are.
+type ocspRequest struct {
+	TBSRequest        ocspTBSRequest
+	OptionalSignature asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspTBSRequest struct {
+	Version           int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName     asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList       []ocspSingleRequest
+	RequestExtensions []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspSingleRequest struct {
+	CertID                  ocspCertID
+	SingleRequestExtensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type ocspResponseData struct {
+	Version            int `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID        asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// Returns a bare OCSP response with the given unsuccessful status
+func ocspErrorResponse(status int) []byte {
+	respBytes, _ := asn1.Marshal(ocspResponse{Status: asn1.Enumerated(status)})
+	return respBytes
+}
+
+// Answers a DER-encoded OCSP request for certificates issued by the active
+// CA or, after a rotation, the previous one. The response is always DER,
+// with an error status if the request can't be answered.
+func respondOCSP(req *logical.Request, reqBytes []byte) []byte {
+	var ocspReq ocspRequest
+	rest, err := asn1.Unmarshal(reqBytes, &ocspReq)
+	if err != nil || len(rest) != 0 || len(ocspReq.TBSRequest.RequestList) == 0 {
+		return ocspErrorResponse(ocspMalformedRequest)
+	}
+
+	signingBundle, err := fetchCAInfo(req)
+	if err != nil {
+		return ocspErrorResponse(ocspInternalError)
+	}
+	previousBundle, err := fetchStoredCABundle(req.Storage, "config/ca_previous_bundle")
+	if err != nil {
+		return ocspErrorResponse(ocspInternalError)
+	}
+
+	// Every certificate in one response must be from the same CA, as it is
+	// signed by that CA
+	var responder *certutil.ParsedCertBundle
+	for _, bundle := range []*certutil.ParsedCertBundle{signingBundle, previousBundle} {
+		if bundle == nil {
+			continue
+		}
+		matches := true
+		for _, single := range ocspReq.TBSRequest.RequestList {
+			ok, err := ocspIssuerMatches(single.CertID, bundle)
+			if err != nil {
+				return ocspErrorResponse(ocspMalformedRequest)
+			}
+			matches = matches && ok
+		}
+		if matches {
+			responder = bundle
+			break
+		}
+	}
+	if responder == nil {
+		return ocspErrorResponse(ocspUnauthorized)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	var responses []ocspSingleResponse
+	for _, single := range ocspReq.TBSRequest.RequestList {
+		response := ocspSingleResponse{
+			CertID:     single.CertID,
+			ThisUpdate: now,
+		}
+		serial := certutil.GetOctalFormatted(single.CertID.SerialNumber.Bytes(), ":")
+		revokedEntry, err := req.Storage.Get("revoked/" + serial)
+		if err != nil {
+			return ocspErrorResponse(ocspInternalError)
+		}
+		switch {
+		case revokedEntry != nil:
+			var revInfo revocationInfo
+			if err := revokedEntry.DecodeJSON(&revInfo); err != nil {
+				return ocspErrorResponse(ocspInternalError)
+			}
+			response.Revoked = ocspRevokedInfo{
+				RevocationTime: time.Unix(revInfo.RevocationTime, 0).UTC(),
+				Reason:         asn1.Enumerated(revInfo.Reason),
+			}
+		default:
+			certEntry, err := req.Storage.Get("certs/" + serial)
+			if err != nil {
+				return ocspErrorResponse(ocspInternalError)
+			}
+			if certEntry != nil {
+				response.Good = true
+			} else {
+				response.Unknown = true
+			}
+		}
+		responses = append(responses, response)
+	}
+
+	respBytes, err := signOCSPResponse(responder, now, responses, ocspReq.TBSRequest.RequestExtensions)
+	if err != nil {
+		return ocspErrorResponse(ocspInternalError)
+	}
+	return respBytes
+}
+
+// Returns whether the issuer named in the given CertID is the given CA
+func ocspIssuerMatches(id ocspCertID, bundle *certutil.ParsedCertBundle) (bool, error) {
+	var hash crypto.Hash
+	for _, candidate := range ocspHashes {
+		if candidate.oid.Equal(id.HashAlgorithm.Algorithm) {
+			hash = candidate.hash
+		}
+	}
+	if hash == 0 {
+		return false, fmt.Errorf("unsupported hash algorithm %s", id.HashAlgorithm.Algorithm)
+	}
+
+	keyBits, err := subjectPublicKeyBits(bundle)
+	if err != nil {
+		return false, err
+	}
+
+	nameHash := hash.New()
+	nameHash.Write(bundle.Certificate.RawSubject)
+	keyHash := hash.New()
+	keyHash.Write(keyBits)
+	return bytes.Equal(nameHash.Sum(nil), id.IssuerNameHash) && bytes.Equal(keyHash.Sum(nil), id.IssuerKeyHash), nil
+}
+
+// Returns the bits of the CA's public key, which OCSP identifies the CA by
+func subjectPublicKeyBits(bundle *certutil.ParsedCertBundle) ([]byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(bundle.Certificate.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	return spki.PublicKey.RightAlign(), nil
+}
+
+// Signs a successful response with the given CA, which it names by key.
+// A nonce in the request is echoed back, so the client can tell the
+// response is fresh.
+func signOCSPResponse(bundle *certutil.ParsedCertBundle, now time.Time, responses []ocspSingleResponse, requestExtensions []pkix.Extension) ([]byte, error) {
+	keyBits, err := subjectPublicKeyBits(bundle)
+	if err != nil {
+		return nil, err
+	}
+	keyHash := crypto.SHA1.New()
+	keyHash.Write(keyBits)
+	keyHashBytes, err := asn1.Marshal(keyHash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	var responseExtensions []pkix.Extension
+	for _, ext := range requestExtensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			responseExtensions = append(responseExtensions, ext)
+		}
+	}
+
+	tbsBytes, err := asn1.Marshal(ocspResponseData{
+		ResponderID: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        2,
+			IsCompound: true,
+			Bytes:      keyHashBytes,
+		},
+		ProducedAt:         now,
+		Responses:          responses,
+		ResponseExtensions: responseExtensions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := signatureAlgorithm(bundle.PrivateKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg, err := signatureAlgorithmIdentifier(alg, bundle.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signHashed(alg, bundle.PrivateKey, tbsBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	basicBytes, err := asn1.Marshal(ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbsBytes},
+		SignatureAlgorithm: sigAlg,
+		Signature:          asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspResponse{
+		Status: ocspSuccessful,
+		ResponseBytes: ocspResponseBytes{
+			ResponseType: oidOCSPBasicResponse,
+			Response:     basicBytes,
+		},
+	})
+}
@@ -0,0 +1,95 @@
+package pki
+
+import (
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// An issued certificate kept for later forensic comparison. Unlike the
+// entries under certs/, which hold DER for revocation and are removed
+// when a certificate is revoked, these are never removed.
+type archivedCertificate struct {
+	Certificate string `json:"certificate" structs:"certificate" mapstructure:"certificate"`
+	Role        string `json:"role" structs:"role" mapstructure:"role"`
+	ArchiveTime int64  `json:"archive_time" structs:"archive_time" mapstructure:"archive_time"`
+}
+
+func pathArchive(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `archive/(?P<serial>[0-9A-Fa-f-:]+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"serial": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Certificate serial number, in colon- or
+hyphen-separated octal`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathArchiveRead,
+		},
+
+		HelpSynopsis:    pathArchiveHelpSyn,
+		HelpDescription: pathArchiveHelpDesc,
+	}
+}
+
+func (b *backend) pathArchiveRead(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	serial := strings.Replace(strings.ToLower(data.Get("serial").(string)), "-", ":", -1)
+
+	entry, err := req.Storage.Get("archive/" + serial)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var archived archivedCertificate
+	if err := entry.DecodeJSON(&archived); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"certificate":  archived.Certificate,
+			"role":         archived.Role,
+			"archive_time": archived.ArchiveTime,
+		},
+	}, nil
+}
+
+// Stores the PEM of an issued certificate under archive/, for roles that
+// set archive_issued_certificates
+func archiveIssuedCert(s logical.Storage, serial, roleName string, certBytes []byte) error {
+	entry, err := logical.StorageEntryJSON("archive/"+serial, archivedCertificate{
+		Certificate: strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: certBytes,
+		}))),
+		Role:        roleName,
+		ArchiveTime: time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating archive entry: %s", err)
+	}
+	return s.Put(entry)
+}
+
+const pathArchiveHelpSyn = `
+Fetch an archived certificate.
+`
+
+const pathArchiveHelpDesc = `
+Certificates issued by roles with "archive_issued_certificates" set are
+archived in PEM format, along with the name of the role and the time they
+were archived, so they can later be compared against certificates found
+in the wild. Archived certificates are kept after they are revoked or
+expire.
+`
@@ -0,0 +1,75 @@
+package pki
+
+import (
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_archiveIssuedCertificates(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	readArchive := func(serial string) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "archive/" + serial,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+		}
+		return resp
+	}
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	// Off by default
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	parseIssuedCert(t, resp)
+	if archived := readArchive(resp.Data["serial_number"].(string)); archived != nil {
+		t.Fatalf("expected no archive entry, got: %#v", archived)
+	}
+
+	roleData["archive_issued_certificates"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	parseIssuedCert(t, resp)
+	serial := resp.Data["serial_number"].(string)
+
+	// Hyphens are accepted in place of colons, as for cert/
+	archived := readArchive(strings.Replace(serial, ":", "-", -1))
+	if archived == nil {
+		t.Fatalf("expected an archive entry")
+	}
+	if archived.Data["certificate"] != resp.Data["certificate"] {
+		t.Fatalf("expected the archived PEM to match the issued certificate, got %v", archived.Data["certificate"])
+	}
+	if block, _ := pem.Decode([]byte(archived.Data["certificate"].(string))); block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("bad archived PEM")
+	}
+	if archived.Data["role"] != "test" || archived.Data["archive_time"].(int64) == 0 {
+		t.Fatalf("bad archive entry: %#v", archived.Data)
+	}
+
+	// The archive outlives revocation
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "revoke",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"serial_number": serial,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+	if readArchive(serial) == nil {
+		t.Fatalf("expected the archive entry to be kept after revocation")
+	}
+}
@@ -0,0 +1,102 @@
+package pki
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// What is recorded about each issued certificate, so that issuance can be
+// audited without fetching and parsing the certificates themselves
+type certMetadata struct {
+	SerialNumber string `json:"serial_number" structs:"serial_number" mapstructure:"serial_number"`
+	CommonName   string `json:"common_name" structs:"common_name" mapstructure:"common_name"`
+	Role         string `json:"role" structs:"role" mapstructure:"role"`
+	IssueTime    int64  `json:"issue_time" structs:"issue_time" mapstructure:"issue_time"`
+	Expiration   int64  `json:"expiration" structs:"expiration" mapstructure:"expiration"`
+}
+
+func pathCertMetadata(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `cert_metadata/(?P<serial>[0-9A-Fa-f-:]+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"serial": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Certificate serial number, in colon- or
+hyphen-separated octal`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathCertMetadataRead,
+		},
+
+		HelpSynopsis:    pathCertMetadataHelpSyn,
+		HelpDescription: pathCertMetadataHelpDesc,
+	}
+}
+
+func (b *backend) pathCertMetadataRead(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	metadata, err := fetchCertMetadata(req, data.Get("serial").(string))
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: structs.New(metadata).Map(),
+	}, nil
+}
+
+// Stores the metadata of an issued certificate under cert_metadata/
+func storeCertMetadata(s logical.Storage, serial, roleName string, cert *x509.Certificate) error {
+	entry, err := logical.StorageEntryJSON("cert_metadata/"+serial, certMetadata{
+		SerialNumber: serial,
+		CommonName:   cert.Subject.CommonName,
+		Role:         roleName,
+		IssueTime:    time.Now().Unix(),
+		Expiration:   cert.NotAfter.Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating metadata entry: %s", err)
+	}
+	return s.Put(entry)
+}
+
+// Returns the metadata stored for the certificate with the given serial,
+// or nil for certificates issued before metadata was kept
+func fetchCertMetadata(req *logical.Request, serial string) (*certMetadata, error) {
+	entry, err := req.Storage.Get("cert_metadata/" + strings.Replace(strings.ToLower(serial), "-", ":", -1))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var metadata certMetadata
+	if err := entry.DecodeJSON(&metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+const pathCertMetadataHelpSyn = `
+Fetch the metadata of an issued certificate.
+`
+
+const pathCertMetadataHelpDesc = `
+The serial number, common name, issuing role, issue time and expiration
+of each issued certificate are recorded, so that issuance can be audited
+without fetching and parsing the certificates. Times are in seconds since
+the Unix epoch. Metadata is kept after a certificate is revoked, until
+"tidy" removes the certificate.
+`
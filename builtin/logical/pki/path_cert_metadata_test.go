@@ -0,0 +1,68 @@
+package pki
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_certMetadata(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	readMetadata := func(serial string) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "cert_metadata/" + serial,
+			Storage:   storage,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+		}
+		return resp
+	}
+
+	before := time.Now().Unix()
+	_, resp := issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name": true,
+	}, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "2h",
+	})
+	cert := parseIssuedCert(t, resp)
+	serial := resp.Data["serial_number"].(string)
+
+	// Hyphens are accepted in place of colons, as for cert/
+	metadata := readMetadata(strings.Replace(serial, ":", "-", -1))
+	if metadata == nil {
+		t.Fatalf("expected metadata")
+	}
+	if metadata.Data["serial_number"] != serial || metadata.Data["common_name"] != "foo.example.com" || metadata.Data["role"] != "test" {
+		t.Fatalf("bad metadata: %#v", metadata.Data)
+	}
+	if issueTime := metadata.Data["issue_time"].(int64); issueTime < before || issueTime > time.Now().Unix() {
+		t.Fatalf("bad issue time: %d", issueTime)
+	}
+	if metadata.Data["expiration"].(int64) != cert.NotAfter.Unix() {
+		t.Fatalf("bad expiration: %d, expected %d", metadata.Data["expiration"], cert.NotAfter.Unix())
+	}
+
+	if metadata := readMetadata("01:02:03"); metadata != nil {
+		t.Fatalf("expected no metadata for an unknown serial, got: %#v", metadata)
+	}
+
+	// The metadata can be fetched along with the certificate
+	req := &logical.Request{Storage: storage}
+	certEntry, certMeta, err := fetchCertBySerialWithMetadata(req, "certs/", serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(certEntry.Value, cert.Raw) || certMeta == nil || certMeta.Role != "test" {
+		t.Fatalf("bad: certificate: %x, metadata: %#v", certEntry.Value, certMeta)
+	}
+	if _, certMeta, err := fetchCertBySerialWithMetadata(req, "", "ca"); err != nil || certMeta != nil {
+		t.Fatalf("expected the CA without metadata, got: %#v, err: %v", certMeta, err)
+	}
+}
@@ -1,7 +1,11 @@
 package pki
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"time"
 
 	"github.com/hashicorp/vault/helper/certutil"
 	"github.com/hashicorp/vault/logical"
@@ -32,13 +36,77 @@ func (b *backend) pathCAWrite(
 	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	pemBundle := d.Get("pem_bundle").(string)
 
+	parsedBundle, err := parseCABundle(pemBundle)
+	switch err.(type) {
+	case certutil.UserError:
+		return logical.ErrorResponse(err.Error()), nil
+	case certutil.InternalError:
+		return nil, err
+	}
+
+	cb, err := parsedBundle.ToCertBundle()
+	if err != nil {
+		return nil, fmt.Errorf("Error converting raw values into cert bundle: %s", err)
+	}
+
+	entry, err := logical.StorageEntryJSON("config/ca_bundle", cb)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// For ease of later use, also store just the certificate at a known
+	// location, plus a blank CRL
+	err = req.Storage.Put(&logical.StorageEntry{
+		Key:   "ca",
+		Value: parsedBundle.CertificateBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Put(&logical.StorageEntry{
+		Key:   "crl",
+		Value: []byte{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if warning := validityCrosses2050Warning(parsedBundle.Certificate); len(warning) != 0 {
+		resp := &logical.Response{}
+		resp.AddWarning(warning)
+		return resp, nil
+	}
+
+	return nil, nil
+}
+
+// RFC 5280 requires validity dates before 2050 to be encoded as UTCTime and
+// later ones as GeneralizedTime. A CA valid on both sides of that boundary
+// is fine, and the standard library encodes it correctly, but some older
+// parsers mishandle the mix or GeneralizedTime itself, so this returns a
+// warning for such a certificate, or an empty string otherwise.
+func validityCrosses2050Warning(cert *x509.Certificate) string {
+	if cert.NotBefore.UTC().Year() >= 2050 || cert.NotAfter.UTC().Year() < 2050 {
+		return ""
+	}
+	return fmt.Sprintf("The CA certificate is valid until %s, past the end of 2049. Dates from 2050 onwards are encoded as GeneralizedTime rather than UTCTime, which some older clients cannot parse.", cert.NotAfter.Format(time.RFC3339))
+}
+
+// Parses the given PEM bundle and makes sure it is actually usable for
+// issuance, rather than finding out at the first issue request
+func parseCABundle(pemBundle string) (*certutil.ParsedCertBundle, error) {
 	parsedBundle, err := certutil.ParsePEMBundle(pemBundle)
 	if err != nil {
 		switch err.(type) {
 		case certutil.InternalError:
 			return nil, err
 		default:
-			return logical.ErrorResponse(err.Error()), nil
+			return nil, certutil.UserError{Err: err.Error()}
 		}
 	}
 
@@ -48,49 +116,116 @@ func (b *backend) pathCAWrite(
 		parsedBundle.CertificateBytes = parsedBundle.IssuingCABytes
 	}
 
-	// TODO?: CRLs can only be generated with RSA keys right now, in the
-	// Go standard library. The plubming is here to support non-RSA keys
-	// if the library gets support
+	if parsedBundle.Certificate == nil {
+		return nil, certutil.UserError{Err: "No certificate was found in the given PEM bundle"}
+	}
+	if parsedBundle.PrivateKey == nil {
+		return nil, certutil.UserError{Err: "No private key was found in the given PEM bundle"}
+	}
 
-	if parsedBundle.PrivateKeyType != certutil.RSAPrivateKey {
-		return logical.ErrorResponse("Currently, only RSA keys are supported for the CA certificate"), nil
+	// CRLs and OCSP responses are signed by hand, which supports RSA,
+	// ECDSA and Ed25519
+	switch parsedBundle.PrivateKeyType {
+	case certutil.RSAPrivateKey, certutil.ECPrivateKey, certutil.Ed25519PrivateKey:
+	default:
+		return nil, certutil.UserError{Err: "Currently, only RSA, EC and Ed25519 keys are supported for the CA certificate"}
 	}
 
-	if !parsedBundle.Certificate.IsCA {
-		return logical.ErrorResponse("The given certificate is not marked for CA use and cannot be used with this backend"), nil
+	// The bundle may carry the CA's issuers as well, in any order, so the
+	// CA certificate is the one matching the private key
+	certs := parsePEMCertificates(pemBundle)
+	for _, cert := range certs {
+		if publicKeysMatch(cert.PublicKey, parsedBundle.PrivateKey.Public()) {
+			parsedBundle.Certificate = cert
+			parsedBundle.CertificateBytes = cert.Raw
+			break
+		}
 	}
 
-	cb, err := parsedBundle.ToCertBundle()
-	if err != nil {
-		return nil, fmt.Errorf("Error converting raw values into cert bundle: %s", err)
+	if !publicKeysMatch(parsedBundle.Certificate.PublicKey, parsedBundle.PrivateKey.Public()) {
+		return nil, certutil.UserError{Err: "The given private key does not match the public key in the certificate"}
 	}
 
-	entry, err := logical.StorageEntryJSON("config/ca_bundle", cb)
+	chain, err := buildCAChain(parsedBundle.Certificate, certs)
 	if err != nil {
 		return nil, err
 	}
-	err = req.Storage.Put(entry)
-	if err != nil {
-		return nil, err
+	parsedBundle.CAChain = chain
+	parsedBundle.CAChainBytes = nil
+	for _, cert := range chain {
+		parsedBundle.CAChainBytes = append(parsedBundle.CAChainBytes, cert.Raw)
 	}
+	// The issuing CA of the CA certificate is the next one up the chain,
+	// or the CA certificate itself if it is a root
+	parsedBundle.IssuingCA = parsedBundle.Certificate
+	if len(chain) > 1 {
+		parsedBundle.IssuingCA = chain[1]
+	}
+	parsedBundle.IssuingCABytes = parsedBundle.IssuingCA.Raw
 
-	// For ease of later use, also store just the certificate at a known
-	// location, plus a blank CRL
-	entry.Key = "ca"
-	entry.Value = parsedBundle.CertificateBytes
-	err = req.Storage.Put(entry)
-	if err != nil {
-		return nil, err
+	if !parsedBundle.Certificate.BasicConstraintsValid || !parsedBundle.Certificate.IsCA {
+		return nil, certutil.UserError{Err: "The given certificate is not marked for CA use and cannot be used with this backend"}
 	}
 
-	entry.Key = "crl"
-	entry.Value = []byte{}
-	err = req.Storage.Put(entry)
-	if err != nil {
-		return nil, err
+	if time.Now().After(parsedBundle.Certificate.NotAfter) {
+		return nil, certutil.UserError{Err: fmt.Sprintf("The given certificate expired at %s and cannot be used with this backend", parsedBundle.Certificate.NotAfter.Format(time.RFC3339))}
 	}
 
-	return nil, nil
+	return parsedBundle, nil
+}
+
+// Returns every certificate in the given PEM bundle, skipping anything that
+// is not a certificate
+func parsePEMCertificates(pemBundle string) []*x509.Certificate {
+	var certs []*x509.Certificate
+	rest := []byte(pemBundle)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// Orders the given certificates into the chain from the CA certificate up
+// to, but not including, its root. A root in the given certificates only
+// ends the chain; any other certificate that is not part of it is an error.
+func buildCAChain(caCert *x509.Certificate, certs []*x509.Certificate) ([]*x509.Certificate, error) {
+	var remaining []*x509.Certificate
+	for _, cert := range certs {
+		if !cert.Equal(caCert) {
+			remaining = append(remaining, cert)
+		}
+	}
+
+	var chain []*x509.Certificate
+	current := caCert
+	for current != nil && !isSelfSigned(current) {
+		chain = append(chain, current)
+		var issuer *x509.Certificate
+		for i, cert := range remaining {
+			if current.CheckSignatureFrom(cert) == nil {
+				issuer = cert
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+		current = issuer
+	}
+
+	if len(remaining) != 0 {
+		return nil, certutil.UserError{Err: fmt.Sprintf("The certificate for %s in the given PEM bundle is not part of the CA certificate's chain", remaining[0].Subject.CommonName)}
+	}
+
+	return chain, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil
 }
 
 const pathConfigCAHelpSyn = `
@@ -100,7 +235,9 @@ Configure the CA certificate and private key used for generated credentials.
 const pathConfigCAHelpDesc = `
 This configures the CA information used for credentials
 generated by this backend. This must be a PEM-format, concatenated
-unencrypted secret key and certificate.
+unencrypted secret key and certificate. If the CA is an
+intermediate, the bundle may also include the certificates of its issuers
+up to the root; they are returned as the "ca_chain" of issued certificates.
 
 For security reasons, you can only view the certificate when reading this endpoint.
 `
@@ -0,0 +1,212 @@
+package pki
+
+import (
+	"encoding/pem"
+	"fmt"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathConfigCANext(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/ca_next",
+		Fields: map[string]*framework.FieldSchema{
+			"pem_bundle": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `PEM-format, concatenated unencrypted secret key
+and certificate`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathCANextRead,
+			logical.WriteOperation:  b.pathCANextWrite,
+			logical.DeleteOperation: b.pathCANextDelete,
+		},
+
+		HelpSynopsis:    pathConfigCANextHelpSyn,
+		HelpDescription: pathConfigCANextHelpDesc,
+	}
+}
+
+func pathConfigCAPromote(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/ca_next/promote",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathCAPromoteWrite,
+		},
+
+		HelpSynopsis:    pathConfigCAPromoteHelpSyn,
+		HelpDescription: pathConfigCAPromoteHelpDesc,
+	}
+}
+
+func (b *backend) pathCANextRead(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	parsedBundle, err := fetchStoredCABundle(req.Storage, "config/ca_next_bundle")
+	if err != nil {
+		return nil, err
+	}
+	if parsedBundle == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"certificate": string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: parsedBundle.CertificateBytes,
+			})),
+		},
+	}, nil
+}
+
+func (b *backend) pathCANextWrite(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	parsedBundle, err := parseCABundle(d.Get("pem_bundle").(string))
+	switch err.(type) {
+	case certutil.UserError:
+		return logical.ErrorResponse(err.Error()), nil
+	case certutil.InternalError:
+		return nil, err
+	}
+
+	cb, err := parsedBundle.ToCertBundle()
+	if err != nil {
+		return nil, fmt.Errorf("Error converting raw values into cert bundle: %s", err)
+	}
+
+	entry, err := logical.StorageEntryJSON("config/ca_next_bundle", cb)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if warning := validityCrosses2050Warning(parsedBundle.Certificate); len(warning) != 0 {
+		resp := &logical.Response{}
+		resp.AddWarning(warning)
+		return resp, nil
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathCANextDelete(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete("config/ca_next_bundle")
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// Makes the next CA the active one. The active CA becomes the previous CA,
+// which keeps a CRL of its own so that certificates it issued can still be
+// revoked.
+func (b *backend) pathCAPromoteWrite(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.revokeStorageLock.Lock()
+	defer b.revokeStorageLock.Unlock()
+
+	nextEntry, err := req.Storage.Get("config/ca_next_bundle")
+	if err != nil {
+		return nil, err
+	}
+	if nextEntry == nil {
+		return logical.ErrorResponse("No next CA has been configured"), nil
+	}
+	nextBundle, err := fetchStoredCABundle(req.Storage, "config/ca_next_bundle")
+	if err != nil {
+		return nil, err
+	}
+
+	activeEntry, err := req.Storage.Get("config/ca_bundle")
+	if err != nil {
+		return nil, err
+	}
+	activeCert, err := req.Storage.Get("ca")
+	if err != nil {
+		return nil, err
+	}
+
+	// The writes are ordered so that if any of them fails, the active CA
+	// is either still the old one or already the new one, and the promote
+	// can simply be retried
+	if activeEntry != nil && activeCert != nil {
+		err = req.Storage.Put(&logical.StorageEntry{
+			Key:   "config/ca_previous_bundle",
+			Value: activeEntry.Value,
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = req.Storage.Put(&logical.StorageEntry{
+			Key:   "ca_previous",
+			Value: activeCert.Value,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = req.Storage.Put(&logical.StorageEntry{
+		Key:   "config/ca_bundle",
+		Value: nextEntry.Value,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(&logical.StorageEntry{
+		Key:   "ca",
+		Value: nextBundle.CertificateBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = req.Storage.Delete("config/ca_next_bundle")
+	if err != nil {
+		return nil, err
+	}
+
+	crlErr := buildCRL(b, req)
+	switch crlErr.(type) {
+	case certutil.UserError:
+		return logical.ErrorResponse(fmt.Sprintf("Error during CRL building: %s", crlErr)), nil
+	case certutil.InternalError:
+		return nil, fmt.Errorf("Error encountered during CRL building: %s", crlErr)
+	}
+
+	return nil, nil
+}
+
+const pathConfigCANextHelpSyn = `
+Configure the CA certificate and private key that will replace the active one.
+`
+
+const pathConfigCANextHelpDesc = `
+This stages a new CA alongside the active one, in the same format as
+"config/ca". It is not used for anything until it is promoted with
+"config/ca_next/promote". Reading this endpoint returns the staged
+certificate, so that it can be distributed to clients before it is
+used to issue certificates.
+`
+
+const pathConfigCAPromoteHelpSyn = `
+Make the staged CA the active one.
+`
+
+const pathConfigCAPromoteHelpDesc = `
+This makes the CA staged at "config/ca_next" the active CA, used for all
+new certificates. The CA that was active becomes the previous CA: its
+certificate is available at "ca/previous" and it keeps signing its own
+CRL, available at "crl/previous", so certificates it issued can still
+be revoked. Promoting again replaces the previous CA.
+`
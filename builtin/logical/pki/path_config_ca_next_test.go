@@ -0,0 +1,118 @@
+package pki
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_caRotation(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+		}
+		return resp
+	}
+	fetchCert := func(path string) *x509.Certificate {
+		resp := request(logical.ReadOperation, path, nil)
+		cert, err := x509.ParseCertificate(resp.Data[logical.HTTPRawBody].([]byte))
+		if err != nil {
+			t.Fatalf("error parsing %s: %s", path, err)
+		}
+		return cert
+	}
+	fetchCRL := func(path string) *pkix.CertificateList {
+		resp := request(logical.ReadOperation, path, nil)
+		crl, err := x509.ParseCRL(resp.Data[logical.HTTPRawBody].([]byte))
+		if err != nil {
+			t.Fatalf("error parsing %s: %s", path, err)
+		}
+		return crl
+	}
+	issue := func() *x509.Certificate {
+		return parseIssuedCert(t, request(logical.WriteOperation, "issue/test", map[string]interface{}{
+			"common_name": "foo.example.com",
+		}))
+	}
+
+	request(logical.WriteOperation, "roles/test", map[string]interface{}{
+		"allow_any_name": true,
+	})
+
+	oldCA := fetchCert("ca")
+	oldLeaf := issue()
+
+	// Staging a new CA changes nothing until it is promoted
+	request(logical.WriteOperation, "config/ca_next", map[string]interface{}{
+		"pem_bundle": generateTestCA(t, "Vault Testing CA 2"),
+	})
+	resp := request(logical.ReadOperation, "config/ca_next", nil)
+	if resp == nil || len(resp.Data["certificate"].(string)) == 0 {
+		t.Fatalf("expected the staged certificate, got: %#v", resp)
+	}
+	if err := issue().CheckSignatureFrom(oldCA); err != nil {
+		t.Fatalf("expected the active CA to be unchanged: %s", err)
+	}
+
+	request(logical.WriteOperation, "config/ca_next/promote", nil)
+
+	newCA := fetchCert("ca")
+	if newCA.Subject.CommonName != "Vault Testing CA 2" {
+		t.Fatalf("expected the new CA to be active, got %s", newCA.Subject.CommonName)
+	}
+	if previous := fetchCert("ca/previous"); !previous.Equal(oldCA) {
+		t.Fatalf("expected the old CA to be the previous one")
+	}
+	if resp := request(logical.ReadOperation, "config/ca_next", nil); resp != nil {
+		t.Fatalf("expected no staged CA after promotion, got: %#v", resp)
+	}
+
+	newLeaf := issue()
+	if err := newLeaf.CheckSignatureFrom(newCA); err != nil {
+		t.Fatalf("expected the new CA to issue: %s", err)
+	}
+
+	// Each CA lists only the certificates it issued
+	for _, leaf := range []*x509.Certificate{oldLeaf, newLeaf} {
+		request(logical.WriteOperation, "revoke", map[string]interface{}{
+			"serial_number": certutil.GetOctalFormatted(leaf.SerialNumber.Bytes(), ":"),
+		})
+	}
+
+	crl := fetchCRL("crl")
+	if err := newCA.CheckCRLSignature(crl); err != nil {
+		t.Fatalf("expected the CRL to be signed by the new CA: %s", err)
+	}
+	if revoked := crl.TBSCertList.RevokedCertificates; len(revoked) != 1 || revoked[0].SerialNumber.Cmp(newLeaf.SerialNumber) != 0 {
+		t.Fatalf("bad CRL entries: %#v", revoked)
+	}
+
+	previousCRL := fetchCRL("crl/previous")
+	if err := oldCA.CheckCRLSignature(previousCRL); err != nil {
+		t.Fatalf("expected the previous CRL to be signed by the old CA: %s", err)
+	}
+	if revoked := previousCRL.TBSCertList.RevokedCertificates; len(revoked) != 1 || revoked[0].SerialNumber.Cmp(oldLeaf.SerialNumber) != 0 {
+		t.Fatalf("bad previous CRL entries: %#v", revoked)
+	}
+
+	// Nothing left to promote
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "config/ca_next/promote",
+		Storage:   storage,
+	})
+	if err != nil || !resp.IsError() {
+		t.Fatalf("expected an error with no staged CA: resp: %#v, err: %v", resp, err)
+	}
+}
@@ -0,0 +1,175 @@
+package pki
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_validityPast2050(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	configure := func(path string, notAfter time.Time) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"pem_bundle": generateTestCAWithExpiry(t, "Vault Testing CA", notAfter),
+			},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+		}
+		return resp
+	}
+
+	longLived := time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, path := range []string{"config/ca", "config/ca_next"} {
+		if resp := configure(path, time.Now().Add(24*time.Hour)); resp != nil && len(resp.Warnings()) != 0 {
+			t.Fatalf("expected no warning for a short-lived CA at %s, got %v", path, resp.Warnings())
+		}
+		resp := configure(path, longLived)
+		if resp == nil || len(resp.Warnings()) != 1 || !strings.Contains(resp.Warnings()[0], "GeneralizedTime") {
+			t.Fatalf("expected a warning for a CA valid past 2049 at %s, got: %#v", path, resp)
+		}
+	}
+
+	// Dates on either side of the boundary use the type RFC 5280 requires
+	signingBundle, err := fetchCAInfo(&logical.Request{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type validity struct {
+		NotBefore, NotAfter asn1.RawValue
+	}
+	type tbsCertificate struct {
+		Version            int `asn1:"optional,explicit,default:0,tag:0"`
+		SerialNumber       *big.Int
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Issuer             asn1.RawValue
+		Validity           validity
+	}
+	for _, version := range []int{3, 1} {
+		parsedBundle, err := createCertificate(&certCreationBundle{
+			SigningBundle: signingBundle,
+			CACert:        signingBundle.Certificate,
+			CommonNames:   []string{"foo.example.com"},
+			KeyType:       "rsa",
+			KeyBits:       2048,
+			TTL:           time.Until(time.Date(2055, 1, 1, 0, 0, 0, 0, time.UTC)),
+			X509Version:   version,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tbs tbsCertificate
+		if _, err := asn1.Unmarshal(parsedBundle.Certificate.RawTBSCertificate, &tbs); err != nil {
+			t.Fatal(err)
+		}
+		if tbs.Validity.NotBefore.Tag != asn1.TagUTCTime {
+			t.Fatalf("expected a UTCTime NotBefore in a v%d certificate, got tag %d", version, tbs.Validity.NotBefore.Tag)
+		}
+		if tbs.Validity.NotAfter.Tag != asn1.TagGeneralizedTime {
+			t.Fatalf("expected a GeneralizedTime NotAfter in a v%d certificate, got tag %d", version, tbs.Validity.NotAfter.Tag)
+		}
+		if year := parsedBundle.Certificate.NotAfter.Year(); year != 2055 && year != 2054 {
+			t.Fatalf("bad NotAfter: %s", parsedBundle.Certificate.NotAfter)
+		}
+	}
+}
+
+func TestBackend_caChain(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	// A root, an intermediate under it, and the issuing CA under that
+	newCA := func(commonName string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: commonName},
+			NotBefore:             time.Now().Add(-time.Minute),
+			NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		certBytes, err := x509.CreateCertificate(cryptorand.Reader, template, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(certBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	encode := func(cert *x509.Certificate) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	root, rootKey := newCA("Root CA", nil, nil)
+	intermediate, intermediateKey := newCA("Intermediate CA", root, rootKey)
+	issuing, issuingKey := newCA("Issuing CA", intermediate, intermediateKey)
+	other, _ := newCA("Other CA", nil, nil)
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(issuingKey)}))
+
+	configure := func(pemBundle string) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "config/ca",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"pem_bundle": pemBundle,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	issueChain := func() []string {
+		_, resp := issueWithRole(t, b, storage, map[string]interface{}{
+			"allow_any_name": true,
+		}, map[string]interface{}{
+			"common_name": "foo.example.com",
+		})
+		if err := parseIssuedCert(t, resp).CheckSignatureFrom(issuing); err != nil {
+			t.Fatalf("expected the issuing CA to sign: %s", err)
+		}
+		return resp.Data["ca_chain"].([]string)
+	}
+
+	// The chain runs up to the root, whatever order the bundle is in
+	if resp := configure(encode(root) + keyPEM + encode(intermediate) + encode(issuing)); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	chain := issueChain()
+	if len(chain) != 2 || chain[0] != strings.TrimSpace(encode(issuing)) || chain[1] != strings.TrimSpace(encode(intermediate)) {
+		t.Fatalf("bad CA chain: %v", chain)
+	}
+
+	// Without its issuers, the CA is the only certificate in the chain
+	configure(keyPEM + encode(issuing))
+	if chain := issueChain(); len(chain) != 1 || chain[0] != strings.TrimSpace(encode(issuing)) {
+		t.Fatalf("bad CA chain: %v", chain)
+	}
+
+	if resp := configure(keyPEM + encode(issuing) + encode(intermediate) + encode(other)); resp == nil || !resp.IsError() {
+		t.Fatalf("expected a certificate outside of the chain to be rejected, got: %#v", resp)
+	}
+}
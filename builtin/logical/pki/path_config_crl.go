@@ -2,6 +2,7 @@ package pki
 
 import (
 	"fmt"
+	"net/url"
 	"time"
 
 	"github.com/fatih/structs"
@@ -11,7 +12,11 @@ import (
 
 // CRLConfig holds basic CRL configuration information
 type crlConfig struct {
-	Expiry string `json:"expiry" mapstructure:"expiry" structs:"expiry"`
+	Expiry                string `json:"expiry" mapstructure:"expiry" structs:"expiry"`
+	ExcludeExpiredFromCRL bool   `json:"exclude_expired_from_crl" mapstructure:"exclude_expired_from_crl" structs:"exclude_expired_from_crl"`
+	RetainExpiredRevoked  bool   `json:"retain_expired_revoked" mapstructure:"retain_expired_revoked" structs:"retain_expired_revoked"`
+	EnableDelta           bool   `json:"enable_delta" mapstructure:"enable_delta" structs:"enable_delta"`
+	DeltaURL              string `json:"delta_url" mapstructure:"delta_url" structs:"delta_url"`
 }
 
 func pathConfigCRL(b *backend) *framework.Path {
@@ -24,6 +29,35 @@ func pathConfigCRL(b *backend) *framework.Path {
 valid; defaults to 72 hours`,
 				Default: "72h",
 			},
+			"exclude_expired_from_crl": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, revoked certificates that have expired
+are left off the CRL, and removed from storage
+when it is rebuilt; defaults to false`,
+				Default: false,
+			},
+			"retain_expired_revoked": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set along with exclude_expired_from_crl,
+revoked certificates that have expired are kept
+in storage as a record, though still left off the
+CRL; defaults to false`,
+				Default: false,
+			},
+			"enable_delta": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, revoking a certificate only rebuilds a
+delta CRL of the certificates revoked since the
+full CRL was last built, rather than the full
+CRL; defaults to false`,
+				Default: false,
+			},
+			"delta_url": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The URL the delta CRL is published at. If set
+with enable_delta, the full CRL points clients to
+it in a Freshest CRL extension`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -72,13 +106,25 @@ func (b *backend) pathCRLWrite(
 	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	expiry := d.Get("expiry").(string)
 
-	_, err := time.ParseDuration(expiry)
+	expiryDur, err := time.ParseDuration(expiry)
 	if err != nil {
 		return logical.ErrorResponse(fmt.Sprintf("Given expiry could not be decoded: %s", err)), nil
 	}
+	if expiryDur <= 0 {
+		return logical.ErrorResponse(fmt.Sprintf("The expiry must be positive, but was given %s", expiry)), nil
+	}
 
 	config := &crlConfig{
-		Expiry: expiry,
+		Expiry:                expiry,
+		ExcludeExpiredFromCRL: d.Get("exclude_expired_from_crl").(bool),
+		RetainExpiredRevoked:  d.Get("retain_expired_revoked").(bool),
+		EnableDelta:           d.Get("enable_delta").(bool),
+		DeltaURL:              d.Get("delta_url").(string),
+	}
+	if len(config.DeltaURL) != 0 {
+		if parsedURL, err := url.Parse(config.DeltaURL); err != nil || !parsedURL.IsAbs() {
+			return logical.ErrorResponse(fmt.Sprintf("The delta_url %s is not a valid absolute URL", config.DeltaURL)), nil
+		}
 	}
 
 	entry, err := logical.StorageEntryJSON("config/crl", config)
@@ -94,9 +140,19 @@ func (b *backend) pathCRLWrite(
 }
 
 const pathConfigCRLHelpSyn = `
-Configure the CRL expiration.
+Configure the CRL expiration and contents.
 `
 
 const pathConfigCRLHelpDesc = `
-This endpoint allows configuration of the CRL lifetime.
+This endpoint allows configuration of the CRL lifetime, and of whether
+revoked certificates that have since expired are still listed on it.
+Unless they are retained, expired revoked certificates that are left off
+the CRL are removed from storage when it is rebuilt, which keeps the list
+of revoked certificates, and the CRL, from growing without bound.
+
+With delta CRLs enabled, revoking a certificate rebuilds only the delta
+CRL, served at "crl/delta", which lists the certificates revoked since
+the full CRL was last built. The full CRL is rebuilt by "crl/rotate", or
+when the CA changes. Changing these settings takes effect at the next
+rebuild.
 `
@@ -0,0 +1,140 @@
+package pki
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// fipsConfig holds the backend-wide restriction of keys to those approved
+// for FIPS 140-2, which applies regardless of role configuration
+type fipsConfig struct {
+	Enabled bool `json:"enabled" structs:"enabled" mapstructure:"enabled"`
+}
+
+func pathConfigFIPS(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/fips",
+		Fields: map[string]*framework.FieldSchema{
+			"enabled": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, only FIPS-approved keys may be used: RSA
+keys of at least 2048 bits, and EC keys on the
+P-256, P-384, or P-521 curves. Defaults to false.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:  b.pathFIPSRead,
+			logical.WriteOperation: b.pathFIPSWrite,
+		},
+
+		HelpSynopsis:    pathConfigFIPSHelpSyn,
+		HelpDescription: pathConfigFIPSHelpDesc,
+	}
+}
+
+func (b *backend) FIPS(s logical.Storage) (*fipsConfig, error) {
+	entry, err := s.Get("config/fips")
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result fipsConfig
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Returns whether FIPS mode is enabled, which it is not if it was never
+// configured
+func (b *backend) fipsEnabled(s logical.Storage) (bool, error) {
+	config, err := b.FIPS(s)
+	if err != nil {
+		return false, fmt.Errorf("Error fetching FIPS configuration: %s", err)
+	}
+	return config != nil && config.Enabled, nil
+}
+
+func (b *backend) pathFIPSRead(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.FIPS(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: structs.New(config).Map(),
+	}, nil
+}
+
+func (b *backend) pathFIPSWrite(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config := &fipsConfig{
+		Enabled: d.Get("enabled").(bool),
+	}
+
+	entry, err := logical.StorageEntryJSON("config/fips", config)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	// Existing roles are left as they are, but can no longer issue, so
+	// the operator is told which ones need updating
+	roleNames, err := req.Storage.List("role/")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing roles: %s", err)
+	}
+	sort.Strings(roleNames)
+	var resp *logical.Response
+	for _, roleName := range roleNames {
+		role, err := b.getRole(req.Storage, roleName)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching role %s: %s", roleName, err)
+		}
+		if role == nil {
+			continue
+		}
+		if err := checkFIPSKey(role.KeyType, role.KeyBits); err != nil {
+			if resp == nil {
+				resp = &logical.Response{}
+			}
+			resp.AddWarning(fmt.Sprintf("Role %s cannot issue certificates until it is updated: %s", roleName, err))
+		}
+	}
+
+	return resp, nil
+}
+
+const pathConfigFIPSHelpSyn = `
+Configure whether only FIPS-approved keys may be used.
+`
+
+const pathConfigFIPSHelpDesc = `
+With FIPS mode enabled, roles may only be written with FIPS-approved key
+types and sizes, whatever else they allow: RSA keys of at least 2048 bits,
+and EC keys on the P-256, P-384, or P-521 curves. Issuance checks the same
+policy against the role's key settings and against the CA's key, so roles
+written before FIPS mode was enabled are refused until they are updated;
+enabling it warns about any such roles.
+`
@@ -0,0 +1,109 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_fips(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	write := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		return resp
+	}
+
+	// Roles written before FIPS mode is enabled are kept
+	if resp := write("roles/legacy", map[string]interface{}{
+		"allow_any_name": true,
+		"key_type":       "ec",
+		"key_bits":       224,
+	}); resp != nil && resp.IsError() {
+		t.Fatalf("bad: %#v", resp)
+	}
+	resp := write("config/fips", map[string]interface{}{
+		"enabled": true,
+	})
+	if resp == nil || len(resp.Warnings()) != 1 || !strings.Contains(resp.Warnings()[0], "Role legacy") {
+		t.Fatalf("expected a warning about the legacy role, got: %#v", resp)
+	}
+
+	// ...but can no longer issue
+	resp = write("issue/legacy", map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	if msg := userErrorMessage(resp); !strings.Contains(msg, "key_bits of 224") {
+		t.Fatalf("expected issuance to be refused, got: %#v", resp)
+	}
+
+	for _, c := range []struct {
+		keyType string
+		keyBits int
+		errMsg  string
+	}{
+		{"rsa", 1024, "key_bits of 1024"},
+		{"ec", 224, "key_bits of 224"},
+		{"ed25519", 0, "key_type ed25519"},
+		{"rsa", 2048, ""},
+		{"ec", 256, ""},
+	} {
+		roleData := map[string]interface{}{
+			"allow_any_name": true,
+			"key_type":       c.keyType,
+		}
+		if c.keyBits != 0 {
+			roleData["key_bits"] = c.keyBits
+		}
+		resp := write("roles/test", roleData)
+		if len(c.errMsg) == 0 {
+			if resp != nil && resp.IsError() {
+				t.Fatalf("%s %d: bad: %#v", c.keyType, c.keyBits, resp)
+			}
+			if resp := write("issue/test", map[string]interface{}{"common_name": "foo.example.com"}); resp == nil || resp.Data["certificate"] == nil {
+				t.Fatalf("%s %d: expected a certificate, got: %#v", c.keyType, c.keyBits, resp)
+			}
+			continue
+		}
+		if !resp.IsError() || !strings.Contains(resp.Data["error"].(string), c.errMsg) {
+			t.Fatalf("%s %d: expected an error containing %q, got: %#v", c.keyType, c.keyBits, c.errMsg, resp)
+		}
+	}
+
+	// The CA's own key is held to the same policy
+	rsaKey, err := rsa.GenerateKey(cryptorand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFIPSCAKey(rsaKey.Public()); err == nil || !strings.Contains(err.Error(), "The CA key") {
+		t.Fatalf("expected a 1024-bit RSA CA key to be refused, got: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFIPSCAKey(ecKey.Public()); err != nil {
+		t.Fatalf("expected a P-384 CA key to be allowed, got: %v", err)
+	}
+
+	// Disabling FIPS mode lifts the restriction
+	write("config/fips", map[string]interface{}{
+		"enabled": false,
+	})
+	if resp := write("issue/legacy", map[string]interface{}{"common_name": "foo.example.com"}); resp == nil || resp.Data["certificate"] == nil {
+		t.Fatalf("expected a certificate, got: %#v", resp)
+	}
+}
@@ -0,0 +1,176 @@
+package pki
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// issuanceLogConfig holds the configuration of the sink that issuance
+// events are published to
+type issuanceLogConfig struct {
+	Sink    string `json:"sink" structs:"sink" mapstructure:"sink"`
+	Path    string `json:"path" structs:"path" mapstructure:"path"`
+	URL     string `json:"url" structs:"url" mapstructure:"url"`
+	Timeout string `json:"timeout" structs:"timeout" mapstructure:"timeout"`
+	Fatal   bool   `json:"fatal" structs:"fatal" mapstructure:"fatal"`
+}
+
+func pathConfigIssuanceLog(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/issuance_log",
+		Fields: map[string]*framework.FieldSchema{
+			"sink": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Where to publish issuance events; "file" or
+"http"`,
+			},
+
+			"path": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `For the "file" sink, the file that events are
+appended to, one JSON object per line`,
+			},
+
+			"url": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `For the "http" sink, the URL that each event is
+POSTed to`,
+			},
+
+			"timeout": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "5s",
+				Description: `For the "http" sink, how long to wait for a
+response; defaults to 5 seconds`,
+			},
+
+			"fatal": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, events are published before the
+certificate is returned and a failure to publish
+fails the request. Otherwise events are published
+in the background on a best-effort basis.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathIssuanceLogRead,
+			logical.WriteOperation:  b.pathIssuanceLogWrite,
+			logical.DeleteOperation: b.pathIssuanceLogDelete,
+		},
+
+		HelpSynopsis:    pathConfigIssuanceLogHelpSyn,
+		HelpDescription: pathConfigIssuanceLogHelpDesc,
+	}
+}
+
+func (b *backend) IssuanceLog(s logical.Storage) (*issuanceLogConfig, error) {
+	entry, err := s.Get("config/issuance_log")
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result issuanceLogConfig
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathIssuanceLogRead(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.IssuanceLog(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: structs.New(config).Map(),
+	}, nil
+}
+
+func (b *backend) pathIssuanceLogWrite(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config := &issuanceLogConfig{
+		Sink:    d.Get("sink").(string),
+		Path:    d.Get("path").(string),
+		URL:     d.Get("url").(string),
+		Timeout: d.Get("timeout").(string),
+		Fatal:   d.Get("fatal").(bool),
+	}
+
+	switch config.Sink {
+	case "file":
+		if len(config.Path) == 0 {
+			return logical.ErrorResponse(`The "file" sink requires a path`), nil
+		}
+	case "http":
+		if len(config.URL) == 0 {
+			return logical.ErrorResponse(`The "http" sink requires a url`), nil
+		}
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Given timeout could not be decoded: %s", err)), nil
+		}
+		if timeout <= 0 {
+			return logical.ErrorResponse("The timeout must be greater than zero"), nil
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unknown sink %q; must be \"file\" or \"http\"", config.Sink)), nil
+	}
+
+	entry, err := logical.StorageEntryJSON("config/issuance_log", config)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathIssuanceLogDelete(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete("config/issuance_log")
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+const pathConfigIssuanceLogHelpSyn = `
+Configure publishing of issuance events to an external log.
+`
+
+const pathConfigIssuanceLogHelpDesc = `
+This endpoint allows configuring a sink that receives a JSON record of
+every certificate issued by this backend, suitable for building an
+append-only issuance log or transparency monitor. This is separate from,
+and in addition to, Vault's audit log.
+
+The "file" sink appends one JSON object per line to the given path on
+the Vault server. The "http" sink POSTs each event to the given URL and
+expects a 2xx response.
+
+By default, events are queued and published in the background, with a
+few retries; if the queue is full or all retries fail, the event is
+dropped and an error is logged. If "fatal" is set, events are instead
+published before the certificate is returned, and a failure to publish
+fails the issue request, and the certificate, which was never returned,
+is removed from storage.
+`
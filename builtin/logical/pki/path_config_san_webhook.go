@@ -0,0 +1,166 @@
+package pki
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// sanWebhookConfig holds the configuration of the optional external
+// service that is consulted before names are issued
+type sanWebhookConfig struct {
+	URL           string `json:"url" structs:"url" mapstructure:"url"`
+	Timeout       string `json:"timeout" structs:"timeout" mapstructure:"timeout"`
+	CACertificate string `json:"ca_certificate" structs:"ca_certificate" mapstructure:"ca_certificate"`
+	TLSSkipVerify bool   `json:"tls_skip_verify" structs:"tls_skip_verify" mapstructure:"tls_skip_verify"`
+	FailOpen      bool   `json:"fail_open" structs:"fail_open" mapstructure:"fail_open"`
+}
+
+func pathConfigSANWebhook(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/san_webhook",
+		Fields: map[string]*framework.FieldSchema{
+			"url": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The URL that requested names are POSTed to before
+issuance. Leave empty to disable the webhook.`,
+			},
+
+			"timeout": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "5s",
+				Description: `How long to wait for the webhook to respond;
+defaults to 5 seconds`,
+			},
+
+			"ca_certificate": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `PEM-encoded CA certificate(s) used to verify the
+webhook's TLS certificate. If not set, the system
+roots are used.`,
+			},
+
+			"tls_skip_verify": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, the webhook's TLS certificate is not
+verified. Not recommended.`,
+			},
+
+			"fail_open": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, issuance proceeds when the webhook cannot
+be reached or returns an invalid response. Defaults
+to false, which refuses issuance instead.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathSANWebhookRead,
+			logical.WriteOperation:  b.pathSANWebhookWrite,
+			logical.DeleteOperation: b.pathSANWebhookDelete,
+		},
+
+		HelpSynopsis:    pathConfigSANWebhookHelpSyn,
+		HelpDescription: pathConfigSANWebhookHelpDesc,
+	}
+}
+
+func (b *backend) SANWebhook(s logical.Storage) (*sanWebhookConfig, error) {
+	entry, err := s.Get("config/san_webhook")
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var result sanWebhookConfig
+	if err := entry.DecodeJSON(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (b *backend) pathSANWebhookRead(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	config, err := b.SANWebhook(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: structs.New(config).Map(),
+	}, nil
+}
+
+func (b *backend) pathSANWebhookWrite(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config := &sanWebhookConfig{
+		URL:           d.Get("url").(string),
+		Timeout:       d.Get("timeout").(string),
+		CACertificate: d.Get("ca_certificate").(string),
+		TLSSkipVerify: d.Get("tls_skip_verify").(bool),
+		FailOpen:      d.Get("fail_open").(bool),
+	}
+
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Given timeout could not be decoded: %s", err)), nil
+	}
+	if timeout <= 0 {
+		return logical.ErrorResponse("The timeout must be greater than zero"), nil
+	}
+
+	if len(config.CACertificate) != 0 {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(config.CACertificate)) {
+			return logical.ErrorResponse("Could not parse any certificates from the given ca_certificate"), nil
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON("config/san_webhook", config)
+	if err != nil {
+		return nil, err
+	}
+	err = req.Storage.Put(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *backend) pathSANWebhookDelete(
+	req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := req.Storage.Delete("config/san_webhook")
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+const pathConfigSANWebhookHelpSyn = `
+Configure an external service that approves requested names.
+`
+
+const pathConfigSANWebhookHelpDesc = `
+This endpoint allows configuring an HTTP(S) endpoint that is consulted
+after a request has passed the role's own name checks. The requested
+names are POSTed as JSON and issuance only proceeds if the service
+answers with {"allowed": true}.
+
+If "fail_open" is set, a webhook that cannot be reached or that gives
+an invalid response does not block issuance. This means that anyone
+able to interfere with the webhook can bypass it; only enable this if
+the webhook is a convenience rather than a security boundary.
+`
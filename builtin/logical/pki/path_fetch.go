@@ -3,6 +3,7 @@ package pki
 import (
 	"encoding/pem"
 	"fmt"
+	"strings"
 
 	"github.com/hashicorp/vault/helper/certutil"
 	"github.com/hashicorp/vault/logical"
@@ -12,7 +13,7 @@ import (
 // Returns the CA in raw format
 func pathFetchCA(b *backend) *framework.Path {
 	return &framework.Path{
-		Pattern: `ca(/pem)?`,
+		Pattern: `ca(/previous)?(/pem)?`,
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation: b.pathFetchRead,
@@ -26,7 +27,7 @@ func pathFetchCA(b *backend) *framework.Path {
 // Returns the CRL in raw format
 func pathFetchCRL(b *backend) *framework.Path {
 	return &framework.Path{
-		Pattern: `crl(/pem)?`,
+		Pattern: `crl(/previous|/delta)?(/pem)?`,
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation: b.pathFetchRead,
@@ -59,6 +60,21 @@ hyphen-separated octal`,
 	}
 }
 
+// Lists the serial numbers of valid (non-revoked) certificates
+func pathFetchListCerts(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `certs/?$`,
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathFetchCertList,
+			logical.ReadOperation: b.pathFetchCertList,
+		},
+
+		HelpSynopsis:    pathFetchCertListHelpSyn,
+		HelpDescription: pathFetchCertListHelpDesc,
+	}
+}
+
 // This returns the CRL in a non-raw format
 func pathFetchCRLViaCertPath(b *backend) *framework.Path {
 	return &framework.Path{
@@ -73,6 +89,25 @@ func pathFetchCRLViaCertPath(b *backend) *framework.Path {
 	}
 }
 
+func (b *backend) pathFetchCertList(req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List("certs/")
+	if err != nil {
+		return nil, err
+	}
+
+	// Serials are stored colon-separated, but given hyphen-separated so
+	// they can be used in paths as they are
+	serials := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, "/") {
+			continue
+		}
+		serials = append(serials, strings.Replace(entry, ":", "-", -1))
+	}
+
+	return logical.ListResponse(serials), nil
+}
+
 func (b *backend) pathFetchRead(req *logical.Request, data *framework.FieldData) (response *logical.Response, retErr error) {
 	var serial string
 	var pemType string
@@ -102,6 +137,24 @@ func (b *backend) pathFetchRead(req *logical.Request, data *framework.FieldData)
 		if req.Path == "crl/pem" {
 			pemType = "X509 CRL"
 		}
+	case req.Path == "ca/previous" || req.Path == "ca/previous/pem":
+		serial = "ca_previous"
+		contentType = "application/pkix-cert"
+		if req.Path == "ca/previous/pem" {
+			pemType = "CERTIFICATE"
+		}
+	case req.Path == "crl/previous" || req.Path == "crl/previous/pem":
+		serial = "crl_previous"
+		contentType = "application/pkix-crl"
+		if req.Path == "crl/previous/pem" {
+			pemType = "X509 CRL"
+		}
+	case req.Path == "crl/delta" || req.Path == "crl/delta/pem":
+		serial = "crl_delta"
+		contentType = "application/pkix-crl"
+		if req.Path == "crl/delta/pem" {
+			pemType = "X509 CRL"
+		}
 	case req.Path == "cert/crl":
 		serial = "crl"
 		pemType = "X509 CRL"
@@ -166,6 +219,17 @@ reply:
 	return
 }
 
+const pathFetchCertListHelpSyn = `
+List the serial numbers of valid certificates.
+`
+
+const pathFetchCertListHelpDesc = `
+This returns the serial numbers of every certificate issued by this
+backend that has not been revoked or removed by "tidy", in
+hyphen-separated octal, so that each can be fetched from "cert/" or
+revoked.
+`
+
 const pathFetchHelpSyn = `
 Fetch a CA, CRL, or non-revoked certificate.
 `
@@ -174,4 +238,8 @@ const pathFetchHelpDesc = `
 This allows certificates to be fetched. If using the fetch/ prefix any non-revoked certificate can be fetched.
 
 Using "ca" or "crl" as the value fetches the appropriate information in DER encoding. Add "/pem" to either to get PEM encoding.
+
+After a CA rotation, "ca/previous" and "crl/previous" fetch the certificate and CRL of the CA that was replaced.
+
+If delta CRLs are enabled, "crl/delta" fetches the current delta CRL.
 `
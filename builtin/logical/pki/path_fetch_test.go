@@ -0,0 +1,68 @@
+package pki
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_listCerts(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+		}
+		return resp
+	}
+	list := func() map[string]bool {
+		serials := map[string]bool{}
+		for _, key := range request(logical.ListOperation, "certs/", nil).Data["keys"].([]string) {
+			serials[key] = true
+		}
+		return serials
+	}
+
+	if serials := list(); len(serials) != 0 {
+		t.Fatalf("expected no certificates, got %v", serials)
+	}
+
+	request(logical.WriteOperation, "roles/test", map[string]interface{}{
+		"allow_any_name": true,
+	})
+	var issued []string
+	for i := 0; i < 2; i++ {
+		resp := request(logical.WriteOperation, "issue/test", map[string]interface{}{
+			"common_name": "foo.example.com",
+		})
+		issued = append(issued, strings.Replace(resp.Data["serial_number"].(string), ":", "-", -1))
+	}
+
+	serials := list()
+	if len(serials) != 2 || !serials[issued[0]] || !serials[issued[1]] {
+		t.Fatalf("expected %v, got %v", issued, serials)
+	}
+	// Reading lists too, for clients that can't send a list
+	if keys := request(logical.ReadOperation, "certs", nil).Data["keys"].([]string); len(keys) != 2 {
+		t.Fatalf("bad keys: %v", keys)
+	}
+
+	// Listed serials can be used as they are
+	request(logical.ReadOperation, "cert/"+issued[0], nil)
+	request(logical.WriteOperation, "revoke", map[string]interface{}{
+		"serial_number": issued[0],
+	})
+	if serials := list(); len(serials) != 1 || !serials[issued[1]] {
+		t.Fatalf("expected only %s, got %v", issued[1], serials)
+	}
+	if entry, err := storage.Get("revoked/" + strings.Replace(issued[0], "-", ":", -1)); err != nil || entry == nil {
+		t.Fatalf("expected the revocation to be stored under the colon-separated serial: %v", err)
+	}
+}
@@ -1,8 +1,13 @@
 package pki
 
 import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"net/url"
 	"strings"
 	"time"
 
@@ -36,6 +41,17 @@ in a comma-delimited list`,
 				Type: framework.TypeString,
 				Description: `The requested IP SANs, if any, in a
 common-delimited list`,
+			},
+			"uri_sans": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The requested URI SANs, if any, in a
+comma-delimited list`,
+			},
+			"other_sans": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The requested otherName SANs, if any, in a
+comma-delimited list of "<oid>;UTF8:<value>", e.g.
+"1.3.6.1.4.1.311.20.2.3;UTF8:user@example.com"`,
 			},
 			"lease": &framework.FieldSchema{
 				Type:        framework.TypeString,
@@ -49,6 +65,30 @@ the role default, backend default, or system
 default TTL is used, in that order. Cannot
 be later than the role max TTL.`,
 			},
+			"not_after": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The time the certificate expires, in RFC 3339
+format, e.g. "2030-01-01T00:00:00Z"; an alternative
+to "ttl" for certificates that must expire on a
+fixed date. Cannot be later than the role max TTL
+allows.`,
+			},
+			"validate_only": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, the request is checked against the role
+as for issuing, and the certificate that would be
+issued is described, but none is issued or stored.
+Defaults to false.`,
+			},
+			"format": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "pem",
+				Description: `Format for returned data. Can be "pem" or
+"pem_bundle"; "pem_bundle" returns the private key,
+certificate and issuing CA concatenated in the
+certificate field. Defaults to "pem".`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -64,13 +104,19 @@ func (b *backend) pathIssueCert(
 	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
 	roleName := data.Get("role").(string)
 
-	// Get the common name(s)
+	format := getFormat(data)
+	if len(format) == 0 {
+		return userErrorResponse(fmt.Sprintf("Invalid format specified: %s", data.Get("format").(string)))
+	}
+
+	// Get the common name(s); their order, the common name followed by the
+	// alt names as given, is kept through to the certificate
 	var commonNames []string
 	cn := data.Get("common_name").(string)
-	if len(cn) == 0 {
-		return logical.ErrorResponse("The common_name field is required"), nil
+	hasCN := len(cn) != 0
+	if hasCN {
+		commonNames = []string{cn}
 	}
-	commonNames = []string{cn}
 
 	cnAlt := data.Get("alt_names").(string)
 	if len(cnAlt) != 0 {
@@ -85,26 +131,150 @@ func (b *backend) pathIssueCert(
 		return nil, err
 	}
 	if role == nil {
-		return logical.ErrorResponse(fmt.Sprintf("Unknown role: %s", roleName)), nil
+		return userErrorResponse(fmt.Sprintf("Unknown role: %s", roleName))
+	}
+
+	if !hasCN {
+		if role.RequireCN {
+			return userErrorResponse("The common_name field is required")
+		}
+		if len(commonNames) == 0 && len(data.Get("ip_sans").(string)) == 0 && len(data.Get("uri_sans").(string)) == 0 && len(data.Get("other_sans").(string)) == 0 {
+			return userErrorResponse("A common_name or at least one of alt_names, ip_sans, uri_sans, or other_sans is required")
+		}
+	}
+
+	// Names such as "example.com." are valid FQDNs, but many clients
+	// don't expect the trailing dot in a certificate, so remove it
+	// unless the role asks to keep it
+	if !role.PreserveTrailingDot {
+		for i, name := range commonNames {
+			commonNames[i] = strings.TrimSuffix(name, ".")
+		}
 	}
 
 	// Get any IP SANs
 	ipSANs := []net.IP{}
 
+	allowedRanges, err := parseCIDRList(role.AllowedIPRanges)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing allowed_ip_ranges %s: %s", role.AllowedIPRanges, err)
+	}
+
 	ipAlt := data.Get("ip_sans").(string)
 	if len(ipAlt) != 0 {
 		if !role.AllowIPSANs {
-			return logical.ErrorResponse(fmt.Sprintf("IP Subject Alternative Names are not allowed in this role, but was provided %s", ipAlt)), nil
+			return userErrorResponse((&nameRejection{
+				Name:    ipAlt,
+				Reason:  nameReasonIP,
+				Message: fmt.Sprintf("IP Subject Alternative Names are not allowed in this role, but was provided %s", ipAlt),
+			}).Error())
 		}
 		for _, v := range strings.Split(ipAlt, ",") {
 			parsedIP := net.ParseIP(v)
 			if parsedIP == nil {
-				return logical.ErrorResponse(fmt.Sprintf("The value '%s' is not a valid IP address", v)), nil
+				return userErrorResponse(fmt.Sprintf("The value '%s' is not a valid IP address", v))
+			}
+			if len(allowedRanges) != 0 && !ipInNets(parsedIP, allowedRanges) {
+				return userErrorResponse((&nameRejection{
+					Name:    v,
+					Reason:  nameReasonIP,
+					Message: fmt.Sprintf("IP address %s is outside of the ranges allowed by this role", v),
+				}).Error())
 			}
 			ipSANs = append(ipSANs, parsedIP)
 		}
 	}
 
+	// Get any URI SANs
+	var uriSANs []*url.URL
+
+	uriAlt := data.Get("uri_sans").(string)
+	if len(uriAlt) != 0 {
+		if !role.AllowURISANs {
+			return userErrorResponse((&nameRejection{
+				Name:    uriAlt,
+				Reason:  nameReasonURI,
+				Message: fmt.Sprintf("URI Subject Alternative Names are not allowed in this role, but was provided %s", uriAlt),
+			}).Error())
+		}
+		for _, v := range strings.Split(uriAlt, ",") {
+			parsedURI, err := url.Parse(v)
+			if err != nil || !parsedURI.IsAbs() {
+				return userErrorResponse(fmt.Sprintf("The value '%s' is not a valid absolute URI", v))
+			}
+			if len(role.AllowedURISANs) != 0 && !matchesAnyGlob(strings.Split(role.AllowedURISANs, ","), v) {
+				return userErrorResponse((&nameRejection{
+					Name:    v,
+					Reason:  nameReasonURI,
+					Message: fmt.Sprintf("URI %s not allowed by this role", v),
+				}).Error())
+			}
+			uriSANs = append(uriSANs, parsedURI)
+		}
+	}
+
+	// Get any other SANs, which are refused unless the role lists them
+	var otherSANs []otherSAN
+
+	otherAlt := data.Get("other_sans").(string)
+	if len(otherAlt) != 0 {
+		allowedOtherSANs := splitCommaList(role.AllowedOtherSANs)
+		for _, v := range splitCommaList(otherAlt) {
+			san, err := parseOtherSAN(v)
+			if err != nil {
+				return userErrorResponse(fmt.Sprintf("Invalid other SAN: %s", err))
+			}
+			if !otherSANAllowed(allowedOtherSANs, san) {
+				return userErrorResponse((&nameRejection{
+					Name:    v,
+					Reason:  nameReasonOtherSAN,
+					Message: fmt.Sprintf("Other SAN %s not allowed by this role", v),
+				}).Error())
+			}
+			repeated := false
+			for _, kept := range otherSANs {
+				if kept.OID.Equal(san.OID) && kept.Value == san.Value {
+					repeated = true
+					break
+				}
+			}
+			if !repeated {
+				otherSANs = append(otherSANs, san)
+			}
+		}
+	}
+
+	// Names given more than once, such as the common name repeated in
+	// the alt names, are only put in the certificate once, where they
+	// first appear
+	commonNames = dedupeNames(commonNames)
+	ipSANs = dedupeIPs(ipSANs)
+	uriSANs = dedupeURIs(uriSANs)
+
+	// An IP address given as a name would otherwise fail the host name
+	// checks with a message that doesn't say why, and must be within the
+	// allowed ranges as much as one given in ip_sans
+	for _, name := range commonNames {
+		parsedIP := net.ParseIP(name)
+		if parsedIP == nil {
+			continue
+		}
+		if !role.AllowIPSANs {
+			return userErrorResponse((&nameRejection{
+				Name:    name,
+				Reason:  nameReasonIP,
+				Message: fmt.Sprintf("IP Subject Alternative Names, including IP addresses given as the common name or alt names, are not allowed in this role, but was provided %s", name),
+			}).Error())
+		}
+		if len(allowedRanges) != 0 && !ipInNets(parsedIP, allowedRanges) {
+			return userErrorResponse((&nameRejection{
+				Name:    name,
+				Reason:  nameReasonIP,
+				Message: fmt.Sprintf("IP address %s is outside of the ranges allowed by this role", name),
+			}).Error())
+		}
+	}
+
 	ttlField := data.Get("ttl").(string)
 	if len(ttlField) == 0 {
 		ttlField = data.Get("lease").(string)
@@ -119,8 +289,42 @@ func (b *backend) pathIssueCert(
 	} else {
 		ttl, err = time.ParseDuration(ttlField)
 		if err != nil {
-			return logical.ErrorResponse(fmt.Sprintf(
-				"Invalid requested ttl: %s", err)), nil
+			return userErrorResponse(fmt.Sprintf(
+				"Invalid requested ttl: %s", err))
+		}
+		// A certificate that is never valid is of no use to anyone
+		if ttl <= 0 {
+			return userErrorResponse(fmt.Sprintf(
+				"The requested ttl must be greater than zero, but was given %s", ttlField))
+		}
+	}
+
+	// A fixed expiry is checked against the role's limits as if it were
+	// the TTL from now that it amounts to
+	var notAfter time.Time
+	if notAfterField := data.Get("not_after").(string); len(notAfterField) != 0 {
+		if len(data.Get("ttl").(string)) != 0 || len(data.Get("lease").(string)) != 0 {
+			return userErrorResponse("Only one of ttl and not_after can be given")
+		}
+		notAfter, err = time.Parse(time.RFC3339, notAfterField)
+		if err != nil {
+			return userErrorResponse(fmt.Sprintf(
+				"Invalid requested not_after: %s", err))
+		}
+		ttl = notAfter.Sub(time.Now())
+		if ttl <= 0 {
+			return userErrorResponse(fmt.Sprintf(
+				"The requested not_after must be in the future, but was given %s", notAfterField))
+		}
+		ttlField = notAfterField
+	}
+
+	// Roles saved before not_before_duration existed get the default
+	notBeforeDuration := 30 * time.Second
+	if len(role.NotBeforeDuration) != 0 {
+		notBeforeDuration, err = time.ParseDuration(role.NotBeforeDuration)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing not_before_duration %s: %s", role.NotBeforeDuration, err)
 		}
 	}
 
@@ -130,41 +334,195 @@ func (b *backend) pathIssueCert(
 	} else {
 		maxTTL, err = time.ParseDuration(role.MaxTTL)
 		if err != nil {
-			return logical.ErrorResponse(fmt.Sprintf(
-				"Invalid ttl: %s", err)), nil
+			return userErrorResponse(fmt.Sprintf(
+				"Invalid ttl: %s", err))
 		}
 	}
 
+	// The longest validity period allowed, which the backdated start
+	// counts towards if the role says so
+	maxValidity := maxTTL
 	if ttl > maxTTL {
 		// Don't error if they were using system defaults, only error if
 		// they specifically chose a bad TTL
 		if len(ttlField) == 0 {
 			ttl = maxTTL
+		} else if ttl <= role.graceMaxTTL() {
+			b.Logger().Printf("[INFO] pki: role %s: allowing ttl %s above max_ttl %s during the grace period ending %s",
+				roleName, ttl, maxTTL, role.GraceExpiry.Format(time.RFC3339))
+			maxValidity = role.graceMaxTTL()
 		} else {
-			return logical.ErrorResponse("TTL is larger than maximum allowed by this role"), nil
+			return userErrorResponse("TTL is larger than maximum allowed by this role")
+		}
+	}
+	if role.MaxTTLIncludesBackdate {
+		if len(ttlField) == 0 && ttl+notBeforeDuration > maxValidity {
+			ttl = maxValidity - notBeforeDuration
+		}
+	} else {
+		maxValidity = 0
+	}
+
+	if len(role.MinTTL) != 0 {
+		minTTL, err := time.ParseDuration(role.MinTTL)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing min_ttl %s: %s", role.MinTTL, err)
+		}
+		if ttl < minTTL {
+			// As for the max TTL, only error if they specifically chose a
+			// bad TTL and the role doesn't bump it; a fixed not_after is
+			// never moved
+			if len(ttlField) == 0 || (role.MinTTLBehavior == "bump" && notAfter.IsZero()) {
+				ttl = minTTL
+			} else {
+				return userErrorResponse(fmt.Sprintf("TTL is smaller than the minimum of %s allowed by this role", minTTL))
+			}
+		}
+	}
+
+	if role.X509Version == 1 && (len(commonNames) > 1 || len(ipSANs) > 0 || len(uriSANs) > 0 || len(otherSANs) > 0) {
+		return userErrorResponse("This role issues version 1 certificates, which cannot carry Subject Alternative Names")
+	}
+
+	// Alt names the role does not allow can be dropped, rather than
+	// refusing the whole request; the common name must still be allowed
+	var droppedNames []string
+	if role.DropDisallowedSANs {
+		altStart := 0
+		if hasCN {
+			altStart = 1
+		}
+		allowedNames := commonNames[:altStart]
+		for _, name := range commonNames[altStart:] {
+			rejection, err := validateCommonNames(req, []string{name}, role)
+			if err != nil {
+				return nil, fmt.Errorf("Error validating name %s: %s", name, err)
+			}
+			if rejection != nil {
+				droppedNames = append(droppedNames, name)
+				continue
+			}
+			allowedNames = append(allowedNames, name)
+		}
+		commonNames = allowedNames
+
+		// Without a common name, a certificate needs at least one SAN
+		if !hasCN && len(commonNames) == 0 && len(ipSANs) == 0 && len(uriSANs) == 0 && len(otherSANs) == 0 {
+			return userErrorResponse(fmt.Sprintf("None of the requested names are allowed by this role: %s", strings.Join(droppedNames, ", ")))
 		}
 	}
 
-	badName, err := validateCommonNames(req, commonNames, role)
-	if len(badName) != 0 {
-		return logical.ErrorResponse(fmt.Sprintf("Name %s not allowed by this role", badName)), nil
-	} else if err != nil {
-		return nil, fmt.Errorf("Error validating name %s: %s", badName, err)
+	rejection, err := validateCommonNames(req, commonNames, role)
+	if err != nil {
+		return nil, fmt.Errorf("Error validating names: %s", err)
+	}
+	if rejection != nil {
+		return userErrorResponse(rejection.Error())
+	}
+
+	sanCount := len(commonNames) + len(ipSANs) + len(uriSANs) + len(otherSANs)
+	if hasCN && role.ExcludeCNFromSANs {
+		sanCount--
+	}
+	if role.MaxSANs != 0 && sanCount > role.MaxSANs {
+		return userErrorResponse(fmt.Sprintf("Request has %d Subject Alternative Names, more than the %d allowed by this role", sanCount, role.MaxSANs))
+	}
+
+	err = checkSANResolution(role, commonNames)
+	if err != nil {
+		return certErrorResponse(err)
+	}
+
+	// The common name, if any, as it was requested
+	var commonName string
+	altNames := commonNames
+	if hasCN {
+		commonName = commonNames[0]
+		altNames = commonNames[1:]
+	}
+
+	// The webhook sees the names that were requested and checked against
+	// the role, not ones with a random component it could not allow for
+	webhookWarning, err := checkSANWebhook(b, req, roleName, commonName, altNames, ipSANs, uriSANs, otherSANs)
+	if err != nil {
+		return certErrorResponse(err)
+	}
+
+	// The random component is added after the names have been checked
+	// against the role and the webhook, since the requester does not
+	// know it in advance. The name that is actually signed is then
+	// checked against both as well.
+	if role.AppendRandomToCN && hasCN {
+		allowedDomains := splitCommaList(role.AllowedDomains)
+		if len(role.AllowedBaseDomain) != 0 {
+			allowedDomains = append(allowedDomains, role.AllowedBaseDomain)
+		}
+		commonNames[0], err = appendRandomToName(commonNames[0], role.RandomCNLength, allowedDomains)
+		if err != nil {
+			return certErrorResponse(err)
+		}
+		commonName = commonNames[0]
+
+		rejection, err := validateCommonNames(req, []string{commonName}, role)
+		if err != nil {
+			return nil, fmt.Errorf("Error validating names: %s", err)
+		}
+		if rejection != nil {
+			return userErrorResponse(rejection.Error())
+		}
+		randomWarning, err := checkSANWebhook(b, req, roleName, commonName, altNames, ipSANs, uriSANs, otherSANs)
+		if err != nil {
+			return certErrorResponse(err)
+		}
+		if len(webhookWarning) == 0 {
+			webhookWarning = randomWarning
+		}
 	}
 
 	signingBundle, caErr := fetchCAInfo(req)
 	switch caErr.(type) {
 	case certutil.UserError:
-		return logical.ErrorResponse(fmt.Sprintf("Could not fetch the CA certificate: %s", caErr)), nil
+		return userErrorResponse(fmt.Sprintf("Could not fetch the CA certificate: %s", caErr))
 	case certutil.InternalError:
 		return nil, fmt.Errorf("Error fetching CA certificate: %s", caErr)
 	}
 
-	if time.Now().Add(ttl).After(signingBundle.Certificate.NotAfter) {
-		return logical.ErrorResponse(fmt.Sprintf("Cannot satisfy request, as TTL is beyond the expiration of the CA certificate")), nil
+	// Roles written before FIPS mode was enabled are not updated, so
+	// their keys are checked again here, as is the CA's
+	fipsEnabled, err := b.fipsEnabled(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if fipsEnabled {
+		if err := checkFIPSKey(role.KeyType, role.KeyBits); err != nil {
+			return userErrorResponse(fmt.Sprintf("Role %s: %s", roleName, err))
+		}
+		if err := checkFIPSCAKey(signingBundle.Certificate.PublicKey); err != nil {
+			return certErrorResponse(err)
+		}
+	}
+
+	var caExpiryWarning string
+	if len(role.CAMinRemaining) != 0 {
+		minRemaining, err := time.ParseDuration(role.CAMinRemaining)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing ca_min_remaining %s: %s", role.CAMinRemaining, err)
+		}
+		if remaining := signingBundle.Certificate.NotAfter.Sub(time.Now()); remaining < minRemaining {
+			msg := fmt.Sprintf("The CA certificate expires at %s, which is sooner than the minimum of %s required by this role; the CA should be rotated",
+				signingBundle.Certificate.NotAfter.Format(time.RFC3339), minRemaining)
+			if role.CAMinRemainingBehavior != "warn" {
+				return userErrorResponse(msg)
+			}
+			b.Logger().Printf("[WARN] pki: role %s: %s", roleName, msg)
+			caExpiryWarning = msg
+		}
 	}
 
 	var usage certUsage
+	if role.AnyExtKeyUsage {
+		usage = usage | anyExtKeyUsage
+	}
 	if role.ServerFlag {
 		usage = usage | serverUsage
 	}
@@ -174,26 +532,142 @@ func (b *backend) pathIssueCert(
 	if role.CodeSigningFlag {
 		usage = usage | codeSigningUsage
 	}
+	keyUsage, err := parseKeyUsage(role.KeyUsage)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing key_usage %s: %s", role.KeyUsage, err)
+	}
+
+	extKeyUsageOIDs, err := parseOIDList(role.ExtKeyUsageOIDs)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing ext_key_usage_oids %s: %s", role.ExtKeyUsageOIDs, err)
+	}
+	policyIdentifiers, err := parseOIDList(role.PolicyIdentifiers)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing policy_identifiers %s: %s", role.PolicyIdentifiers, err)
+	}
+	if usage == 0 && len(extKeyUsageOIDs) == 0 {
+		switch role.EmptyUsageBehavior {
+		case "server_client":
+			usage = serverUsage | clientUsage
+		case "reject":
+			return userErrorResponse("This role has no usage flags set and is configured to reject such requests")
+		}
+	}
+
+	var validityLocation *time.Location
+	if role.AlignValidityToDay {
+		validityLocation, err = time.LoadLocation(role.ValidityTimezone)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading validity time zone %s: %s", role.ValidityTimezone, err)
+		}
+	}
+
+	var nonceOID asn1.ObjectIdentifier
+	var nonce []byte
+	if len(role.NonceOID) != 0 {
+		nonceOID, err = parseExtensionOID(role.NonceOID)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing nonce OID %s: %s", role.NonceOID, err)
+		}
+		nonce = make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("Error generating nonce: %s", err)
+		}
+	}
+
+	var provenanceOID asn1.ObjectIdentifier
+	var provenance string
+	if len(role.ProvenanceExtensionOID) != 0 {
+		provenanceOID, err = parseExtensionOID(role.ProvenanceExtensionOID)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing provenance OID %s: %s", role.ProvenanceExtensionOID, err)
+		}
+		provenance, err = renderProvenance(role.ProvenanceExtensionTemplate, provenanceData{
+			Role:        roleName,
+			CommonName:  commonName,
+			DisplayName: req.DisplayName,
+			MountPoint:  req.MountPoint,
+			Time:        time.Now().UTC().Format(time.RFC3339),
+		})
+		if err != nil {
+			return certErrorResponse(err)
+		}
+	}
 
 	creationBundle := &certCreationBundle{
-		SigningBundle: signingBundle,
-		CACert:        signingBundle.Certificate,
-		CommonNames:   commonNames,
-		IPSANs:        ipSANs,
-		KeyType:       role.KeyType,
-		KeyBits:       role.KeyBits,
-		TTL:           ttl,
-		Usage:         usage,
+		SigningBundle:            signingBundle,
+		CACert:                   signingBundle.Certificate,
+		CommonNames:              commonNames,
+		NoCommonName:             !hasCN,
+		ExcludeCNFromSANs:        role.ExcludeCNFromSANs,
+		IPSANs:                   ipSANs,
+		URISANs:                  uriSANs,
+		OtherSANs:                otherSANs,
+		KeyType:                  role.KeyType,
+		KeyBits:                  role.KeyBits,
+		SignatureBits:            role.SignatureBits,
+		UsePSS:                   role.UsePSS,
+		TTL:                      ttl,
+		NotBeforeDuration:        notBeforeDuration,
+		MaxValidity:              maxValidity,
+		NotAfter:                 notAfter,
+		Usage:                    usage,
+		KeyUsage:                 keyUsage,
+		ExtKeyUsageOIDs:          extKeyUsageOIDs,
+		PolicyIdentifiers:        policyIdentifiers,
+		PrivateKeyUsageNotBefore: role.PrivateKeyUsageNotBefore,
+		PrivateKeyUsageNotAfter:  role.PrivateKeyUsageNotAfter,
+		ValidityLocation:         validityLocation,
+		NonceOID:                 nonceOID,
+		Nonce:                    nonce,
+		ProvenanceOID:            provenanceOID,
+		Provenance:               provenance,
+		X509Version:              role.X509Version,
+		UTF8Subject:              role.UTF8Subject,
+		SubjectAttributes:        role.subjectAttributes(),
+		BasicConstraintsCritical: role.BasicConstraintsCritical,
+		RequireOCSPStapling:      role.RequireOCSPStapling,
+		SubjectKeyIDMethod:       role.SubjectKeyIDMethod,
 	}
 
-	parsedBundle, err := createCertificate(creationBundle)
-	switch err.(type) {
-	case certutil.UserError:
-		return logical.ErrorResponse(err.Error()), nil
-	case certutil.InternalError:
+	var warnings []string
+	if len(droppedNames) != 0 {
+		warnings = append(warnings, fmt.Sprintf("The following alt names are not allowed by this role and were left out of the certificate: %s", strings.Join(droppedNames, ", ")))
+	}
+	if len(webhookWarning) != 0 {
+		warnings = append(warnings, webhookWarning)
+	}
+	if len(caExpiryWarning) != 0 {
+		warnings = append(warnings, caExpiryWarning)
+	}
+
+	// Nothing is issued or stored, and no serial number is used up, when
+	// the request is only being validated
+	if data.Get("validate_only").(bool) {
+		certTemplate, err := generateCertTemplate(creationBundle, nil)
+		if err != nil {
+			return certErrorResponse(err)
+		}
+		resp := validatedCertResponse(certTemplate)
+		for _, warning := range warnings {
+			resp.AddWarning(warning)
+		}
+		return resp, nil
+	}
+
+	creationBundle.SerialNumber, err = generateSerialNumber(req.Storage, role.SerialBits)
+	if err != nil {
 		return nil, err
 	}
 
+	parsedBundle, err := createCertificate(creationBundle)
+	if err != nil {
+		return certErrorResponse(err)
+	}
+
+	parsedBundle.CAChain = signingBundle.CAChain
+	parsedBundle.CAChainBytes = signingBundle.CAChainBytes
+
 	cb, err := parsedBundle.ToCertBundle()
 	if err != nil {
 		return nil, fmt.Errorf("Error converting raw cert bundle to cert bundle: %s", err)
@@ -207,17 +681,129 @@ func (b *backend) pathIssueCert(
 
 	resp.Secret.TTL = ttl
 
-	err = req.Storage.Put(&logical.StorageEntry{
-		Key:   "certs/" + cb.SerialNumber,
-		Value: parsedBundle.CertificateBytes,
-	})
+	if format == "pem_bundle" {
+		resp.Data["certificate"] = strings.Join([]string{cb.PrivateKey, cb.Certificate, cb.IssuingCA}, "\n")
+	}
+
+	if nonce != nil {
+		resp.Data["nonce"] = hex.EncodeToString(nonce)
+	}
+	if provenanceOID != nil {
+		resp.Data["provenance"] = provenance
+	}
+
+	for _, warning := range warnings {
+		resp.AddWarning(warning)
+	}
+
+	// A certificate that isn't stored can't be revoked, so it must not be
+	// returned to the caller
+	err = storeIssuedCert(req.Storage, cb.SerialNumber, parsedBundle.CertificateBytes)
+	if err != nil {
+		b.Logger().Printf("[ERR] pki: unable to store certificate with serial %s, not returning it: %s", cb.SerialNumber, err)
+		return nil, fmt.Errorf("Unable to store certificate locally, so it was not issued: %s", err)
+	}
+
+	// From here on, any failure must remove what has been stored, so that
+	// no certificate is left on record that was never returned
+	err = storeCertMetadata(req.Storage, cb.SerialNumber, roleName, parsedBundle.Certificate)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to store certificate locally")
+		b.Logger().Printf("[ERR] pki: unable to store metadata of certificate with serial %s, not returning it: %s", cb.SerialNumber, err)
+		discardIssuedCert(b, req.Storage, cb.SerialNumber)
+		return nil, fmt.Errorf("Unable to store certificate metadata, so it was not returned: %s", err)
+	}
+
+	if role.ArchiveIssuedCertificates {
+		err = archiveIssuedCert(req.Storage, cb.SerialNumber, roleName, parsedBundle.CertificateBytes)
+		if err != nil {
+			b.Logger().Printf("[ERR] pki: unable to archive certificate with serial %s, not returning it: %s", cb.SerialNumber, err)
+			discardIssuedCert(b, req.Storage, cb.SerialNumber)
+			return nil, fmt.Errorf("Unable to archive certificate, so it was not returned: %s", err)
+		}
+	}
+
+	if err := logIssuance(b, req, parsedBundle.Certificate, roleName); err != nil {
+		discardIssuedCert(b, req.Storage, cb.SerialNumber)
+		return nil, err
 	}
 
 	return resp, nil
 }
 
+// Describes the certificate that a validated request would be issued
+func validatedCertResponse(certTemplate *x509.Certificate) *logical.Response {
+	ipSANs := []string{}
+	for _, ip := range certTemplate.IPAddresses {
+		ipSANs = append(ipSANs, ip.String())
+	}
+	uriSANs := []string{}
+	for _, uri := range certTemplate.URIs {
+		uriSANs = append(uriSANs, uri.String())
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"subject":    certTemplate.Subject.String(),
+			"alt_names":  certTemplate.DNSNames,
+			"ip_sans":    ipSANs,
+			"uri_sans":   uriSANs,
+			"not_before": certTemplate.NotBefore.UTC().Format(time.RFC3339),
+			"not_after":  certTemplate.NotAfter.UTC().Format(time.RFC3339),
+			"ttl":        int64(certTemplate.NotAfter.Sub(time.Now()).Seconds()),
+		},
+	}
+}
+
+// Returns the requested output format, or an empty string if it is not
+// one that is supported
+func getFormat(data *framework.FieldData) string {
+	format := data.Get("format").(string)
+	switch format {
+	case "pem", "pem_bundle":
+		return format
+	}
+	return ""
+}
+
+const (
+	// How many times storing an issued certificate is attempted
+	certStoreAttempts = 3
+)
+
+// How long to wait between attempts to store an issued certificate; a
+// variable so tests can shorten it
+var certStoreRetryInterval = 100 * time.Millisecond
+
+// Stores an issued certificate so it can later be fetched and revoked,
+// retrying a few times on failure
+func storeIssuedCert(s logical.Storage, serial string, certBytes []byte) error {
+	var err error
+	for attempt := 1; attempt <= certStoreAttempts; attempt++ {
+		err = s.Put(&logical.StorageEntry{
+			Key:   "certs/" + serial,
+			Value: certBytes,
+		})
+		if err == nil {
+			return nil
+		}
+		if attempt < certStoreAttempts {
+			time.Sleep(certStoreRetryInterval)
+		}
+	}
+	return err
+}
+
+// Removes what was stored for an issued certificate that is not going to be
+// returned after all. Failures are only logged, as the request is failing
+// anyway.
+func discardIssuedCert(b *backend, s logical.Storage, serial string) {
+	for _, prefix := range []string{"certs/", "cert_metadata/", "archive/"} {
+		if err := s.Delete(prefix + serial); err != nil {
+			b.Logger().Printf("[ERR] pki: unable to remove %s%s of a certificate that was not returned: %s", prefix, serial, err)
+		}
+	}
+}
+
 const pathIssueCertHelpSyn = `
 Request certificates using a certain role with the provided common name.
 `
@@ -0,0 +1,2825 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+// Writes the given role, then issues a certificate against it with the
+// given data. Returns the issue response, or fails the test if either
+// request returns an internal error.
+func issueWithRole(t *testing.T, b logical.Backend, storage logical.Storage, roleData, issueData map[string]interface{}) (*logical.Response, *logical.Response) {
+	roleResp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/test",
+		Storage:   storage,
+		Data:      roleData,
+	})
+	if err != nil {
+		t.Fatalf("error writing role: %s", err)
+	}
+	if roleResp.IsError() {
+		return roleResp, nil
+	}
+
+	issueResp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "issue/test",
+		Storage:   storage,
+		Data:      issueData,
+	})
+	if err != nil {
+		t.Fatalf("error issuing certificate: %s", err)
+	}
+
+	return roleResp, issueResp
+}
+
+// Parses the certificate out of a successful issue response
+func parseIssuedCert(t *testing.T, resp *logical.Response) *x509.Certificate {
+	if resp == nil || isErrorResponse(resp) {
+		t.Fatalf("expected a certificate, got: %#v", resp)
+	}
+	var certBundle certutil.CertBundle
+	if err := mapstructure.Decode(resp.Data, &certBundle); err != nil {
+		t.Fatal(err)
+	}
+	parsedBundle, err := certBundle.ToParsedCertBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsedBundle.Certificate
+}
+
+func TestBackend_emptyUsageBehavior(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name":    true,
+		"server_flag":       false,
+		"client_flag":       false,
+		"code_signing_flag": false,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	// Default: no extended key usage at all
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if cert := parseIssuedCert(t, resp); len(cert.ExtKeyUsage) != 0 {
+		t.Fatalf("expected no extended key usage, got %v", cert.ExtKeyUsage)
+	}
+
+	// Fall back to server and client use
+	roleData["empty_usage_behavior"] = "server_client"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	if len(cert.ExtKeyUsage) != 2 ||
+		cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth ||
+		cert.ExtKeyUsage[1] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("expected server and client usage, got %v", cert.ExtKeyUsage)
+	}
+
+	// Explicit flags are unaffected by the fallback
+	roleData["code_signing_flag"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert = parseIssuedCert(t, resp)
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageCodeSigning {
+		t.Fatalf("expected only code signing usage, got %v", cert.ExtKeyUsage)
+	}
+
+	// Refuse to save a role without any usage
+	roleData["code_signing_flag"] = false
+	roleData["empty_usage_behavior"] = "reject"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, issueData)
+	if !roleResp.IsError() {
+		t.Fatalf("expected the role write to be rejected")
+	}
+
+	roleData["empty_usage_behavior"] = "bogus"
+	roleResp, _ = issueWithRole(t, b, storage, roleData, issueData)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an unknown behavior to be rejected")
+	}
+}
+
+func TestBackend_trailingDot(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allowed_base_domain": "example.com",
+		"enforce_hostnames":   true,
+	}
+
+	// Without a trailing dot
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	cert := parseIssuedCert(t, resp)
+	if cert.Subject.CommonName != "foo.example.com" {
+		t.Fatalf("bad common name: %s", cert.Subject.CommonName)
+	}
+
+	// By default the trailing dot is removed
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com.",
+		"alt_names":   "bar.example.com.",
+	})
+	cert = parseIssuedCert(t, resp)
+	if cert.Subject.CommonName != "foo.example.com" ||
+		len(cert.DNSNames) != 2 || cert.DNSNames[1] != "bar.example.com" {
+		t.Fatalf("expected trailing dots to be removed, got %s and %v", cert.Subject.CommonName, cert.DNSNames)
+	}
+
+	// ...unless the role preserves it
+	roleData["preserve_trailing_dot"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com.",
+	})
+	cert = parseIssuedCert(t, resp)
+	if cert.Subject.CommonName != "foo.example.com." {
+		t.Fatalf("expected trailing dot to be preserved, got %s", cert.Subject.CommonName)
+	}
+
+	// Only a single trailing dot is accepted
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com..",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a name with two trailing dots to be rejected")
+	}
+}
+
+func TestBackend_maxTTLGrace(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"max_ttl":        "10h",
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "5h",
+	}
+
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	parseIssuedCert(t, resp)
+
+	// Lowering the max TTL without a grace period takes effect immediately
+	roleData["max_ttl"] = "2h"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected the ttl to be rejected")
+	}
+
+	// Within the grace period, the previous max TTL is still honored
+	roleData["max_ttl"] = "10h"
+	issueWithRole(t, b, storage, roleData, issueData)
+	roleData["max_ttl"] = "2h"
+	roleData["max_ttl_grace"] = "1h"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	parseIssuedCert(t, resp)
+
+	// ...but not beyond it
+	issueData["ttl"] = "11h"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a ttl above the previous max to be rejected")
+	}
+
+	// Writing the role again, unchanged, does not restart the grace
+	// period
+	readRole := func() *roleEntry {
+		entry, err := storage.Get("role/test")
+		if err != nil || entry == nil {
+			t.Fatalf("error reading role: %v", err)
+		}
+		var role roleEntry
+		if err := entry.DecodeJSON(&role); err != nil {
+			t.Fatal(err)
+		}
+		return &role
+	}
+	before := readRole()
+	time.Sleep(10 * time.Millisecond)
+	issueWithRole(t, b, storage, roleData, nil)
+	after := readRole()
+	if after.GraceMaxTTL != before.GraceMaxTTL || !after.GraceExpiry.Equal(before.GraceExpiry) {
+		t.Fatalf("expected the grace period to be kept, got %s until %s, was %s until %s",
+			after.GraceMaxTTL, after.GraceExpiry, before.GraceMaxTTL, before.GraceExpiry)
+	}
+
+	// After the grace period, the new max TTL applies
+	roleData["max_ttl"] = "10h"
+	delete(roleData, "max_ttl_grace")
+	issueWithRole(t, b, storage, roleData, issueData)
+	roleData["max_ttl"] = "2h"
+	roleData["max_ttl_grace"] = "1ms"
+	issueData["ttl"] = "1h"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	parseIssuedCert(t, resp)
+	time.Sleep(10 * time.Millisecond)
+	issueData["ttl"] = "5h"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected the ttl to be rejected after the grace period")
+	}
+}
+
+func TestBackend_privateKeyUsagePeriod(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "10h",
+	}
+
+	findExtension := func(cert *x509.Certificate) *privateKeyUsagePeriod {
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidExtensionPrivateKeyUsagePeriod) {
+				if ext.Critical {
+					t.Fatalf("extension should not be critical")
+				}
+				var period privateKeyUsagePeriod
+				rest, err := asn1.Unmarshal(ext.Value, &period)
+				if err != nil || len(rest) != 0 {
+					t.Fatalf("error decoding extension: %v", err)
+				}
+				return &period
+			}
+		}
+		return nil
+	}
+
+	// Off by default
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if findExtension(parseIssuedCert(t, resp)) != nil {
+		t.Fatalf("extension should not be present by default")
+	}
+
+	// Relative to the certificate validity
+	roleData["private_key_usage_not_before"] = "1h"
+	roleData["private_key_usage_not_after"] = "5h"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	period := findExtension(cert)
+	if period == nil {
+		t.Fatalf("expected the extension to be present")
+	}
+	if !period.NotBefore.Equal(cert.NotBefore.Add(time.Hour)) ||
+		!period.NotAfter.Equal(cert.NotBefore.Add(5*time.Hour)) {
+		t.Fatalf("bad period: %v - %v for cert valid from %v", period.NotBefore, period.NotAfter, cert.NotBefore)
+	}
+
+	// Only one bound, given as an absolute time
+	notAfter := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+	roleData["private_key_usage_not_before"] = ""
+	roleData["private_key_usage_not_after"] = notAfter.Format(time.RFC3339)
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	period = findExtension(parseIssuedCert(t, resp))
+	if period == nil || !period.NotBefore.IsZero() || !period.NotAfter.Equal(notAfter) {
+		t.Fatalf("bad period: %#v", period)
+	}
+
+	// Outside the certificate validity
+	roleData["private_key_usage_not_after"] = "11h"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if !isUserError(resp) {
+		t.Fatalf("expected a period beyond the certificate validity to be rejected")
+	}
+
+	// Unparseable
+	roleData["private_key_usage_not_after"] = "tomorrow"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, issueData)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an invalid value to be rejected")
+	}
+}
+
+func TestBackend_appendRandomToCN(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allowed_base_domain": "example.com",
+		"enforce_hostnames":   true,
+		"append_random_to_cn": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "bar.example.com",
+	}
+
+	cnRegex := regexp.MustCompile(`^foo-[a-z0-9]{8}\.example\.com$`)
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		_, resp := issueWithRole(t, b, storage, roleData, issueData)
+		cert := parseIssuedCert(t, resp)
+		cn := cert.Subject.CommonName
+		if !cnRegex.MatchString(cn) {
+			t.Fatalf("bad common name: %s", cn)
+		}
+		if len(cert.DNSNames) != 2 || cert.DNSNames[0] != cn || cert.DNSNames[1] != "bar.example.com" {
+			t.Fatalf("bad DNS names: %v", cert.DNSNames)
+		}
+		if seen[cn] {
+			t.Fatalf("duplicate common name: %s", cn)
+		}
+		seen[cn] = true
+	}
+
+	// Configurable length
+	roleData["random_cn_length"] = 4
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if cn := parseIssuedCert(t, resp).Subject.CommonName; !regexp.MustCompile(`^foo-[a-z0-9]{4}\.example\.com$`).MatchString(cn) {
+		t.Fatalf("bad common name: %s", cn)
+	}
+
+	// Wildcards can't be randomized
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "*.example.com",
+	})
+	if !isUserError(resp) {
+		t.Fatalf("expected a wildcard name to be rejected")
+	}
+
+	// Nor can bare domains or other names that a random component would
+	// turn into a different domain, rather than a host within one
+	for _, c := range []struct {
+		roleData map[string]interface{}
+		name     string
+	}{
+		{map[string]interface{}{
+			"allowed_domains":    "example.com",
+			"allow_bare_domains": true,
+			"allow_subdomains":   false,
+		}, "example.com"},
+		{map[string]interface{}{
+			"allowed_domains":    "sub.example.com",
+			"allow_bare_domains": true,
+		}, "sub.example.com"},
+		{map[string]interface{}{
+			"allow_localhost": true,
+		}, "localhost"},
+	} {
+		c.roleData["append_random_to_cn"] = true
+		_, resp = issueWithRole(t, b, storage, c.roleData, map[string]interface{}{
+			"common_name": c.name,
+		})
+		if !isUserError(resp) {
+			t.Fatalf("expected %s to be refused, got: %#v", c.name, resp)
+		}
+	}
+
+	// The randomized name must itself be allowed by the role
+	_, resp = issueWithRole(t, b, storage, map[string]interface{}{
+		"allowed_domains":     "foo.*.com",
+		"allow_glob_domains":  true,
+		"append_random_to_cn": true,
+	}, map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	if !isUserError(resp) {
+		t.Fatalf("expected the randomized name to be refused, got: %#v", resp)
+	}
+
+	roleData["random_cn_length"] = 0
+	roleResp, _ := issueWithRole(t, b, storage, roleData, issueData)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an invalid length to be rejected")
+	}
+}
+
+func TestBackend_alignValidityToDay(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data not available: %s", err)
+	}
+
+	cases := []struct {
+		now       time.Time
+		ttl       time.Duration
+		notBefore time.Time
+		notAfter  time.Time
+	}{
+		// No DST transition
+		{
+			now:       time.Date(2026, 1, 10, 15, 0, 0, 0, loc),
+			ttl:       30 * 24 * time.Hour,
+			notBefore: time.Date(2026, 1, 10, 0, 0, 0, 0, loc),
+			notAfter:  time.Date(2026, 2, 9, 0, 0, 0, 0, loc),
+		},
+		// Across the start of DST, midnight moves from 05:00 to 04:00 UTC
+		{
+			now:       time.Date(2026, 3, 7, 15, 0, 0, 0, loc),
+			ttl:       48 * time.Hour,
+			notBefore: time.Date(2026, 3, 7, 5, 0, 0, 0, time.UTC),
+			notAfter:  time.Date(2026, 3, 9, 4, 0, 0, 0, time.UTC),
+		},
+		// Across the end of DST, midnight moves from 04:00 to 05:00 UTC
+		{
+			now:       time.Date(2026, 10, 31, 15, 0, 0, 0, loc),
+			ttl:       48 * time.Hour,
+			notBefore: time.Date(2026, 10, 31, 4, 0, 0, 0, time.UTC),
+			notAfter:  time.Date(2026, 11, 2, 5, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for i, c := range cases {
+		notBefore, notAfter, err := alignValidityToDay(c.now, c.ttl, loc)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if !notBefore.Equal(c.notBefore) || !notAfter.Equal(c.notAfter) {
+			t.Fatalf("case %d: expected %s - %s, got %s - %s", i, c.notBefore, c.notAfter, notBefore, notAfter)
+		}
+		if notAfter.Location() != time.UTC {
+			t.Fatalf("case %d: expected UTC times", i)
+		}
+	}
+
+	// A TTL that doesn't reach the next midnight can't be aligned
+	if _, _, err := alignValidityToDay(time.Date(2026, 1, 10, 15, 0, 0, 0, loc), time.Hour, loc); err == nil {
+		t.Fatalf("expected an error for a short TTL")
+	}
+
+	// Through the backend
+	b, storage := createBackendWithCA(t)
+	_, resp := issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name":        true,
+		"align_validity_to_day": true,
+		"validity_timezone":     "America/New_York",
+	}, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "72h",
+	})
+	cert := parseIssuedCert(t, resp)
+	if notAfter := cert.NotAfter.In(loc); notAfter.Hour() != 0 || notAfter.Minute() != 0 || notAfter.Second() != 0 {
+		t.Fatalf("expected validity to end at local midnight, got %s", notAfter)
+	}
+	// The start is aligned too, unless that would predate the CA
+	block, _ := pem.Decode([]byte(caCert))
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notBefore := cert.NotBefore.In(loc); (notBefore.Hour() != 0 || notBefore.Minute() != 0 || notBefore.Second() != 0) &&
+		!cert.NotBefore.Equal(ca.NotBefore) {
+		t.Fatalf("expected validity to start at local midnight, got %s", notBefore)
+	}
+
+	roleResp, _ := issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name":    true,
+		"validity_timezone": "Mars/Olympus_Mons",
+	}, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an unknown time zone to be rejected")
+	}
+}
+
+func TestBackend_nonceExtension(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if _, ok := resp.Data["nonce"]; ok {
+		t.Fatalf("no nonce expected by default")
+	}
+
+	roleData["nonce_oid"] = "1.3.6.1.4.1.55555.1"
+	nonceOID := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 55555, 1}
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		_, resp = issueWithRole(t, b, storage, roleData, issueData)
+		cert := parseIssuedCert(t, resp)
+
+		var found []byte
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(nonceOID) {
+				if ext.Critical {
+					t.Fatalf("nonce extension should not be critical")
+				}
+				if _, err := asn1.Unmarshal(ext.Value, &found); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if len(found) != 16 {
+			t.Fatalf("expected a 16-byte nonce, got %x", found)
+		}
+		nonce := resp.Data["nonce"].(string)
+		if nonce != hex.EncodeToString(found) {
+			t.Fatalf("response nonce %s does not match extension %x", nonce, found)
+		}
+		if seen[nonce] {
+			t.Fatalf("nonce reused: %s", nonce)
+		}
+		seen[nonce] = true
+	}
+
+	for _, oid := range []string{"1", "1.3.six", "1.45.1", "3.1", "2.5.29.17"} {
+		roleData["nonce_oid"] = oid
+		roleResp, _ := issueWithRole(t, b, storage, roleData, issueData)
+		if !roleResp.IsError() {
+			t.Fatalf("expected OID %s to be rejected", oid)
+		}
+	}
+}
+
+func TestBackend_caMinRemaining(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	block, _ := pem.Decode([]byte(caCert))
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remainingHours := int(ca.NotAfter.Sub(time.Now()).Hours())
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	// Just inside the threshold
+	roleData["ca_min_remaining"] = fmt.Sprintf("%dh", remainingHours-1)
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	parseIssuedCert(t, resp)
+	if len(resp.Warnings()) != 0 {
+		t.Fatalf("unexpected warnings: %v", resp.Warnings())
+	}
+
+	// Just past it
+	roleData["ca_min_remaining"] = fmt.Sprintf("%dh", remainingHours+1)
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected the request to be refused")
+	}
+
+	roleData["ca_min_remaining_behavior"] = "warn"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	parseIssuedCert(t, resp)
+	if len(resp.Warnings()) != 1 {
+		t.Fatalf("expected a warning, got: %v", resp.Warnings())
+	}
+
+	roleData["ca_min_remaining_behavior"] = "ignore"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, issueData)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an unknown behavior to be rejected")
+	}
+}
+
+func TestBackend_signatureBits(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+	for _, c := range []struct {
+		bits    int
+		version int
+		alg     x509.SignatureAlgorithm
+	}{
+		{0, 3, x509.SHA256WithRSA},
+		{384, 3, x509.SHA384WithRSA},
+		{512, 3, x509.SHA512WithRSA},
+		{512, 1, x509.SHA512WithRSA},
+	} {
+		if c.bits != 0 {
+			roleData["signature_bits"] = c.bits
+		}
+		roleData["x509_version"] = c.version
+		roleData["server_flag"] = c.version == 3
+		roleData["client_flag"] = c.version == 3
+		if c.version == 1 {
+			roleData["key_usage"] = ""
+		}
+		_, resp := issueWithRole(t, b, storage, roleData, issueData)
+		cert := parseIssuedCert(t, resp)
+		if cert.SignatureAlgorithm != c.alg {
+			t.Fatalf("expected %s for %d bits in a v%d certificate, got %s", c.alg, c.bits, c.version, cert.SignatureAlgorithm)
+		}
+		block, _ := pem.Decode([]byte(resp.Data["issuing_ca"].(string)))
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cert.CheckSignatureFrom(ca); err != nil {
+			t.Fatalf("bad signature: %s", err)
+		}
+	}
+
+	roleData["signature_bits"] = 128
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected unsupported signature_bits to be rejected")
+	}
+
+	// The hash may not be larger than an EC CA's curve
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signatureAlgorithm(ecKey, 384); err == nil {
+		t.Fatalf("expected a 384-bit hash to be refused for a P-256 key")
+	}
+	if alg, err := signatureAlgorithm(ecKey, 256); err != nil || alg != x509.ECDSAWithSHA256 {
+		t.Fatalf("bad algorithm for a P-256 key: %s, %v", alg, err)
+	}
+
+	// Smaller curves get SHA-256 whether it is set or not
+	ecKey, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bits := range []int{0, 256} {
+		if alg, err := signatureAlgorithm(ecKey, bits); err != nil || alg != x509.ECDSAWithSHA256 {
+			t.Fatalf("bad algorithm for a P-224 key with signature_bits %d: %s, %v", bits, alg, err)
+		}
+	}
+	if _, err := signatureAlgorithm(ecKey, 384); err == nil {
+		t.Fatalf("expected a 384-bit hash to be refused for a P-224 key")
+	}
+}
+
+func TestBackend_ecCASignatureAlgorithm(t *testing.T) {
+	for _, c := range []struct {
+		curve elliptic.Curve
+		alg   x509.SignatureAlgorithm
+	}{
+		{elliptic.P256(), x509.ECDSAWithSHA256},
+		{elliptic.P384(), x509.ECDSAWithSHA384},
+		{elliptic.P521(), x509.ECDSAWithSHA512},
+	} {
+		key, err := ecdsa.GenerateKey(c.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Vault Testing EC CA"},
+			NotBefore:             time.Now().Add(-time.Minute),
+			NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		caBytes, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ca, err := x509.ParseCertificate(caBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, storage := createBackendWithCA(t)
+		request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+			resp, err := b.HandleRequest(&logical.Request{
+				Operation: op,
+				Path:      path,
+				Storage:   storage,
+				Data:      data,
+			})
+			if err != nil || (resp != nil && isErrorResponse(resp)) {
+				t.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+			}
+			return resp
+		}
+		request(logical.WriteOperation, "config/ca", map[string]interface{}{
+			"pem_bundle": string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})) +
+				string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caBytes})),
+		})
+
+		// The hash matches the curve unless signature_bits is set
+		roleData := map[string]interface{}{
+			"allow_any_name": true,
+		}
+		issueData := map[string]interface{}{
+			"common_name": "foo.example.com",
+		}
+		_, resp := issueWithRole(t, b, storage, roleData, issueData)
+		cert := parseIssuedCert(t, resp)
+		if cert.SignatureAlgorithm != c.alg {
+			t.Fatalf("expected %s for a P-%d CA, got %s", c.alg, c.curve.Params().BitSize, cert.SignatureAlgorithm)
+		}
+		if err := cert.CheckSignatureFrom(ca); err != nil {
+			t.Fatalf("bad signature: %s", err)
+		}
+
+		roleData["signature_bits"] = 256
+		_, resp = issueWithRole(t, b, storage, roleData, issueData)
+		if cert := parseIssuedCert(t, resp); cert.SignatureAlgorithm != x509.ECDSAWithSHA256 {
+			t.Fatalf("expected signature_bits to override the curve's hash, got %s", cert.SignatureAlgorithm)
+		}
+
+		// The CRL is signed with the curve's hash too
+		request(logical.WriteOperation, "revoke", map[string]interface{}{
+			"serial_number": certutil.GetOctalFormatted(cert.SerialNumber.Bytes(), ":"),
+		})
+		crl, err := x509.ParseCRL(request(logical.ReadOperation, "crl", nil).Data[logical.HTTPRawBody].([]byte))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ca.CheckCRLSignature(crl); err != nil {
+			t.Fatalf("bad CRL signature: %s", err)
+		}
+	}
+}
+
+func TestBackend_ed25519CA(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Vault Testing Ed25519 CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caBytes, err := x509.CreateCertificate(rand.Reader, template, template, pub, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, storage := createBackendWithCA(t)
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && isErrorResponse(resp)) {
+			t.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+		}
+		return resp
+	}
+	request(logical.WriteOperation, "config/ca", map[string]interface{}{
+		"pem_bundle": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})) +
+			string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caBytes})),
+	})
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	if cert.SignatureAlgorithm != x509.PureEd25519 {
+		t.Fatalf("expected PureEd25519, got %s", cert.SignatureAlgorithm)
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		t.Fatalf("bad signature: %s", err)
+	}
+
+	// Version 1 certificates are signed by hand, as CRLs are
+	_, resp = issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name": true,
+		"x509_version":   1,
+		"server_flag":    false,
+		"client_flag":    false,
+		"key_usage":      "",
+	}, issueData)
+	if err := parseIssuedCert(t, resp).CheckSignatureFrom(ca); err != nil {
+		t.Fatalf("bad v1 signature: %s", err)
+	}
+
+	// There is no hash to choose
+	roleData["signature_bits"] = 384
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if msg := userErrorMessage(resp); !strings.Contains(msg, "Ed25519") {
+		t.Fatalf("expected signature_bits to be refused, got: %#v", resp)
+	}
+
+	request(logical.WriteOperation, "revoke", map[string]interface{}{
+		"serial_number": certutil.GetOctalFormatted(cert.SerialNumber.Bytes(), ":"),
+	})
+	crl, err := x509.ParseCRL(request(logical.ReadOperation, "crl", nil).Data[logical.HTTPRawBody].([]byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.CheckCRLSignature(crl); err != nil {
+		t.Fatalf("bad CRL signature: %s", err)
+	}
+
+	signingBundle, err := fetchCAInfo(&logical.Request{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ocspBytes, err := signOCSPResponse(signingBundle, time.Now(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ocspResp ocspResponse
+	if _, err := asn1.Unmarshal(ocspBytes, &ocspResp); err != nil {
+		t.Fatal(err)
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(ocspResp.ResponseBytes.Response, &basic); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.CheckSignature(x509.PureEd25519, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		t.Fatalf("bad OCSP signature: %s", err)
+	}
+}
+
+func TestBackend_usePSS(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	// The OID of RSASSA-PSS from RFC 4055, which all three hashes share
+	oidRSAPSS := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"use_pss":        true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+	for _, c := range []struct {
+		bits int
+		alg  x509.SignatureAlgorithm
+	}{
+		{0, x509.SHA256WithRSAPSS},
+		{384, x509.SHA384WithRSAPSS},
+		{512, x509.SHA512WithRSAPSS},
+	} {
+		roleData["signature_bits"] = c.bits
+		_, resp := issueWithRole(t, b, storage, roleData, issueData)
+		cert := parseIssuedCert(t, resp)
+		if cert.SignatureAlgorithm != c.alg {
+			t.Fatalf("expected %s for %d bits, got %s", c.alg, c.bits, cert.SignatureAlgorithm)
+		}
+
+		var raw struct {
+			TBSCertificate     asn1.RawValue
+			SignatureAlgorithm pkix.AlgorithmIdentifier
+			SignatureValue     asn1.BitString
+		}
+		if _, err := asn1.Unmarshal(cert.Raw, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if !raw.SignatureAlgorithm.Algorithm.Equal(oidRSAPSS) {
+			t.Fatalf("expected the RSASSA-PSS OID, got %s", raw.SignatureAlgorithm.Algorithm)
+		}
+
+		block, _ := pem.Decode([]byte(resp.Data["issuing_ca"].(string)))
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cert.CheckSignatureFrom(ca); err != nil {
+			t.Fatalf("bad signature: %s", err)
+		}
+	}
+
+	// Version 1 certificates are signed by hand, without PSS
+	roleResp, _ := issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name": true,
+		"use_pss":        true,
+		"x509_version":   1,
+		"server_flag":    false,
+		"client_flag":    false,
+		"key_usage":      "",
+	}, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected use_pss to be refused for version 1 certificates")
+	}
+}
+
+func TestBackend_x509Version1(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"x509_version":   1,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "device.example.com",
+	}
+
+	// Usages need extensions
+	roleResp, _ := issueWithRole(t, b, storage, roleData, issueData)
+	if !roleResp.IsError() {
+		t.Fatalf("expected a v1 role with usage flags to be rejected")
+	}
+
+	roleData["server_flag"] = false
+	roleData["client_flag"] = false
+	roleResp, _ = issueWithRole(t, b, storage, roleData, issueData)
+	if !roleResp.IsError() {
+		t.Fatalf("expected a v1 role with the default key_usage to be rejected")
+	}
+
+	roleData["key_usage"] = ""
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	if cert.Version != 1 {
+		t.Fatalf("expected a v1 certificate, got v%d", cert.Version)
+	}
+	if len(cert.Extensions) != 0 {
+		t.Fatalf("expected no extensions, got %#v", cert.Extensions)
+	}
+	if cert.Subject.CommonName != "device.example.com" {
+		t.Fatalf("bad common name: %s", cert.Subject.CommonName)
+	}
+
+	block, _ := pem.Decode([]byte(caCert))
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		t.Fatalf("bad signature: %s", err)
+	}
+
+	// SANs need extensions too
+	issueData["alt_names"] = "other.example.com"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected SANs to be rejected for a v1 certificate")
+	}
+
+	roleData["x509_version"] = 2
+	roleResp, _ = issueWithRole(t, b, storage, roleData, issueData)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an unsupported version to be rejected")
+	}
+}
+
+// failingStorage fails the given number of puts under a prefix
+type failingStorage struct {
+	*testStorage
+	prefix   string
+	failures int
+}
+
+func (s *failingStorage) Put(entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) && s.failures > 0 {
+		s.failures--
+		return fmt.Errorf("injected failure")
+	}
+	return s.testStorage.Put(entry)
+}
+
+func TestBackend_certStorageFailure(t *testing.T) {
+	certStoreRetryInterval = time.Millisecond
+	defer func() { certStoreRetryInterval = 100 * time.Millisecond }()
+
+	b, storage := createBackendWithCA(t)
+	failing := &failingStorage{
+		testStorage: storage.(*testStorage),
+		prefix:      "certs/",
+	}
+
+	_, resp := issueWithRole(t, b, failing, map[string]interface{}{
+		"allow_any_name": true,
+	}, map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	parseIssuedCert(t, resp)
+
+	issue := func() (*logical.Response, error) {
+		return b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "issue/test",
+			Storage:   failing,
+			Data: map[string]interface{}{
+				"common_name": "foo.example.com",
+			},
+		})
+	}
+
+	// A transient failure is retried
+	failing.failures = certStoreAttempts - 1
+	resp, err := issue()
+	if err != nil {
+		t.Fatalf("expected the store to be retried: %s", err)
+	}
+	serial := parseIssuedCert(t, resp).SerialNumber
+	if entry, _ := failing.Get("certs/" + resp.Data["serial_number"].(string)); entry == nil {
+		t.Fatalf("expected certificate %s to be stored", serial)
+	}
+
+	// A persistent failure fails the request without returning the
+	// certificate
+	keys, _ := failing.List("certs/")
+	failing.failures = certStoreAttempts
+	resp, err = issue()
+	if err == nil {
+		t.Fatalf("expected an error, got: %#v", resp)
+	}
+	if resp != nil && resp.Data["certificate"] != nil {
+		t.Fatalf("the certificate must not be returned")
+	}
+	if after, _ := failing.List("certs/"); len(after) != len(keys) {
+		t.Fatalf("expected no new certificate to be stored")
+	}
+}
+
+// Issues a certificate with storage failing under the given prefix, and
+// checks that the request fails and leaves no certificate behind
+func testIssueRollback(t *testing.T, roleData map[string]interface{}, prefix string) {
+	b, storage := createBackendWithCA(t)
+	failing := &failingStorage{
+		testStorage: storage.(*testStorage),
+		prefix:      prefix,
+		failures:    1,
+	}
+	roleData["allow_any_name"] = true
+	if _, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/test",
+		Storage:   failing,
+		Data:      roleData,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "issue/test",
+		Storage:   failing,
+		Data: map[string]interface{}{
+			"common_name": "foo.example.com",
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected an error, got: %#v", resp)
+	}
+	for _, prefix := range []string{"certs/", "cert_metadata/", "archive/"} {
+		if keys, _ := failing.List(prefix); len(keys) != 0 {
+			t.Fatalf("expected nothing to be left under %s, got: %v", prefix, keys)
+		}
+	}
+}
+
+func TestBackend_certMetadataStorageFailure(t *testing.T) {
+	testIssueRollback(t, map[string]interface{}{}, "cert_metadata/")
+}
+
+func TestBackend_archiveStorageFailure(t *testing.T) {
+	testIssueRollback(t, map[string]interface{}{
+		"archive_issued_certificates": true,
+	}, "archive/")
+}
+
+func TestBackend_utf8Subject(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	type attribute struct {
+		Type  asn1.ObjectIdentifier
+		Value asn1.RawValue
+	}
+	// The name suffix makes encoding/asn1 treat it as a SET
+	type attributeSET []attribute
+	subjectTags := func(cert *x509.Certificate) map[string]int {
+		var rdns []attributeSET
+		if rest, err := asn1.Unmarshal(cert.RawSubject, &rdns); err != nil || len(rest) != 0 {
+			t.Fatalf("error decoding subject: %v", err)
+		}
+		tags := map[string]int{}
+		for _, rdn := range rdns {
+			for _, atv := range rdn {
+				tags[atv.Type.String()] = atv.Value.Tag
+			}
+		}
+		return tags
+	}
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	// By default, PrintableString is used where possible
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if tag := subjectTags(parseIssuedCert(t, resp))["2.5.4.3"]; tag != asn1.TagPrintableString {
+		t.Fatalf("expected a PrintableString common name, got tag %d", tag)
+	}
+
+	roleData["utf8_subject"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	tags := subjectTags(cert)
+	if tags["2.5.4.3"] != asn1.TagUTF8String {
+		t.Fatalf("expected a UTF8String common name, got tag %d", tags["2.5.4.3"])
+	}
+	if tags["2.5.4.5"] != asn1.TagPrintableString {
+		t.Fatalf("expected the serial number to stay a PrintableString, got tag %d", tags["2.5.4.5"])
+	}
+	if cert.Subject.CommonName != "foo.example.com" {
+		t.Fatalf("bad common name: %s", cert.Subject.CommonName)
+	}
+}
+
+func TestBackend_subjectKeyIDMethod(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	// The default matches the SKI computed elsewhere from the same key
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	key, err := certutil.ParsePEMBundle(resp.Data["private_key"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := certutil.GetSubjKeyID(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(cert.SubjectKeyId) != hex.EncodeToString(expected) {
+		t.Fatalf("expected SKI %x, got %x", expected, cert.SubjectKeyId)
+	}
+	if len(cert.AuthorityKeyId) == 0 {
+		t.Fatalf("expected an authority key ID")
+	}
+
+	roleData["subject_key_id_method"] = 2
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert = parseIssuedCert(t, resp)
+	if len(cert.SubjectKeyId) != 8 || cert.SubjectKeyId[0]>>4 != 0x4 {
+		t.Fatalf("expected a 64-bit SKI with the 0100 prefix, got %x", cert.SubjectKeyId)
+	}
+	ski, err := subjectKeyID(cert.PublicKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(cert.SubjectKeyId) != hex.EncodeToString(ski) {
+		t.Fatalf("expected SKI %x, got %x", ski, cert.SubjectKeyId)
+	}
+
+	roleData["subject_key_id_method"] = 3
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an unknown method to be rejected")
+	}
+}
+
+func TestBackend_allowWildcardCertificates(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "*.example.com",
+	}
+
+	// Allowed by default
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if cert := parseIssuedCert(t, resp); cert.Subject.CommonName != "*.example.com" {
+		t.Fatalf("bad common name: %s", cert.Subject.CommonName)
+	}
+
+	roleData["allow_wildcard_certificates"] = false
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) || !strings.Contains(errorMessage(resp), "does not allow wildcard certificates") {
+		t.Fatalf("expected the wildcard to be refused, got: %#v", resp)
+	}
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "*.foo.example.com",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a wildcard SAN to be refused")
+	}
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	parseIssuedCert(t, resp)
+
+	// Roles saved before the option existed still allow wildcards
+	entry, err := storage.Get("role/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	if err := entry.DecodeJSON(&raw); err != nil {
+		t.Fatal(err)
+	}
+	delete(raw, "allow_wildcard_certificates")
+	entry, err = logical.StorageEntryJSON("role/test", raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(entry); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "issue/test",
+		Storage:   storage,
+		Data:      issueData,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseIssuedCert(t, resp)
+}
+
+func TestBackend_wildcardAndSubdomainCombinations(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	for _, c := range []struct {
+		subdomains, wildcards, bare bool
+		allowed                     map[string]bool
+	}{
+		{false, false, false, map[string]bool{"foo.example.com": true}},
+		{false, true, false, map[string]bool{"foo.example.com": true, "*.example.com": true}},
+		{true, false, false, map[string]bool{"foo.example.com": true, "foo.bar.example.com": true}},
+		{true, true, false, map[string]bool{"foo.example.com": true, "foo.bar.example.com": true, "*.example.com": true, "*.bar.example.com": true}},
+		{false, false, true, map[string]bool{"foo.example.com": true, "example.com": true}},
+	} {
+		roleData := map[string]interface{}{
+			"allowed_base_domain":         "example.com",
+			"allow_subdomains":            c.subdomains,
+			"allow_wildcard_certificates": c.wildcards,
+			"allow_bare_domains":          c.bare,
+		}
+		for _, cn := range []string{"foo.example.com", "foo.bar.example.com", "*.example.com", "*.bar.example.com", "example.com"} {
+			_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+				"common_name": cn,
+			})
+			if isErrorResponse(resp) == c.allowed[cn] {
+				t.Fatalf("subdomains %t, wildcards %t, bare domains %t: expected %s allowed to be %t, got: %#v",
+					c.subdomains, c.wildcards, c.bare, cn, c.allowed[cn], resp)
+			}
+		}
+	}
+}
+
+func TestBackend_allowSingleLabelDomains(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+
+	// Allowed by default
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "intranet",
+	})
+	if cert := parseIssuedCert(t, resp); cert.Subject.CommonName != "intranet" {
+		t.Fatalf("bad common name: %s", cert.Subject.CommonName)
+	}
+
+	roleData["allow_single_label_domains"] = false
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "intranet",
+	})
+	if !isErrorResponse(resp) || !strings.Contains(errorMessage(resp), "requires fully-qualified names") {
+		t.Fatalf("expected the single-label name to be refused, got: %#v", resp)
+	}
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "intranet",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a single-label SAN to be refused")
+	}
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "bar.example.com",
+	})
+	parseIssuedCert(t, resp)
+
+	// localhost is controlled by its own setting
+	roleData["allow_any_name"] = false
+	roleData["allow_localhost"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "localhost",
+	})
+	parseIssuedCert(t, resp)
+}
+
+func TestBackend_nameRejectionReason(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	cases := []struct {
+		roleData  map[string]interface{}
+		issueData map[string]interface{}
+		reason    string
+	}{
+		{
+			map[string]interface{}{"allowed_base_domain": "example.com"},
+			map[string]interface{}{"common_name": "foo.example.org"},
+			nameReasonNotAllowed,
+		},
+		{
+			map[string]interface{}{"allow_any_name": true, "enforce_hostnames": true},
+			map[string]interface{}{"common_name": "foo_bar.example.com"},
+			nameReasonHostname,
+		},
+		{
+			map[string]interface{}{"allow_any_name": true, "allow_wildcard_certificates": false},
+			map[string]interface{}{"common_name": "*.example.com"},
+			nameReasonWildcard,
+		},
+		{
+			map[string]interface{}{"allow_any_name": true, "allow_single_label_domains": false},
+			map[string]interface{}{"common_name": "intranet"},
+			nameReasonSingleLabel,
+		},
+		{
+			map[string]interface{}{"allow_any_name": true, "allow_ip_sans": false},
+			map[string]interface{}{"common_name": "10.0.0.1"},
+			nameReasonIP,
+		},
+		{
+			map[string]interface{}{"allow_any_name": true, "allow_ip_sans": false},
+			map[string]interface{}{"common_name": "foo.example.com", "ip_sans": "10.0.0.1"},
+			nameReasonIP,
+		},
+		{
+			map[string]interface{}{"allowed_domains": "example.com", "allow_subdomains": true},
+			map[string]interface{}{"common_name": "example.com\x00.evil.com"},
+			nameReasonCharacters,
+		},
+		{
+			map[string]interface{}{"allow_any_name": true},
+			map[string]interface{}{"common_name": "foo.example.com", "alt_names": "user\n@example.com"},
+			nameReasonCharacters,
+		},
+	}
+	for _, tc := range cases {
+		_, resp := issueWithRole(t, b, storage, tc.roleData, tc.issueData)
+		if !isErrorResponse(resp) {
+			t.Fatalf("expected %#v to be refused", tc.issueData)
+		}
+		if msg := errorMessage(resp); !strings.HasSuffix(msg, "(reason: "+tc.reason+")") {
+			t.Fatalf("expected reason %s, got: %s", tc.reason, msg)
+		}
+	}
+}
+
+func TestBackend_ed25519Keys(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"key_type":       "ed25519",
+	}
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	cert := parseIssuedCert(t, resp)
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		t.Fatalf("expected an Ed25519 public key, got %T", cert.PublicKey)
+	}
+	if cert.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Fatalf("bad key usage: %v", cert.KeyUsage)
+	}
+	if resp.Data["private_key_type"] != "ed25519" {
+		t.Fatalf("bad private key type: %v", resp.Data["private_key_type"])
+	}
+	block, _ := pem.Decode([]byte(resp.Data["private_key"].(string)))
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("bad private key block: %#v", block)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priv, ok := key.(ed25519.PrivateKey); !ok || !pub.Equal(priv.Public()) {
+		t.Fatalf("private key does not match the certificate")
+	}
+
+	roleData["key_bits"] = 256
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() || !strings.Contains(roleResp.Data["error"].(string), "fixed size") {
+		t.Fatalf("expected key_bits to be refused for Ed25519, got: %#v", roleResp)
+	}
+}
+
+func TestBackend_uriSANs(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "workload.example.org",
+		"uri_sans":    "spiffe://example.org/ns/default/sa/web,https://example.org/web",
+	}
+
+	// Off by default
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) || !strings.HasSuffix(errorMessage(resp), "(reason: uri_not_allowed)") {
+		t.Fatalf("expected URI SANs to be refused, got: %#v", resp)
+	}
+
+	roleData["allow_uri_sans"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	if len(cert.URIs) != 2 || cert.URIs[0].String() != "spiffe://example.org/ns/default/sa/web" || cert.URIs[1].String() != "https://example.org/web" {
+		t.Fatalf("bad URIs: %v", cert.URIs)
+	}
+
+	roleData["allowed_uri_sans"] = "spiffe://example.org/*, https://example.org/web"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	parseIssuedCert(t, resp)
+
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "workload.example.org",
+		"uri_sans":    "spiffe://example.com/web",
+	})
+	if !isErrorResponse(resp) || !strings.HasSuffix(errorMessage(resp), "(reason: uri_not_allowed)") {
+		t.Fatalf("expected a URI outside of allowed_uri_sans to be refused, got: %#v", resp)
+	}
+
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "workload.example.org",
+		"uri_sans":    "example.org/web",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a relative URI to be refused")
+	}
+}
+
+func TestBackend_roleSubject(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	block, _ := pem.Decode([]byte(caCert))
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	// The CA's attributes are used by default
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	if !reflect.DeepEqual(cert.Subject.Organization, ca.Subject.Organization) ||
+		!reflect.DeepEqual(cert.Subject.Country, ca.Subject.Country) {
+		t.Fatalf("expected the CA's attributes, got: %#v", cert.Subject)
+	}
+
+	roleData["organization"] = "Example Corp"
+	roleData["ou"] = "Engineering, Platform"
+	roleData["country"] = "NL"
+	roleData["locality"] = "Amsterdam"
+	roleData["province"] = "Noord-Holland"
+	roleData["street_address"] = "1 Example Street"
+	roleData["postal_code"] = "1000 AA"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	subject := parseIssuedCert(t, resp).Subject
+	// Values of the same attribute share an RDN, which DER sorts
+	sort.Strings(subject.OrganizationalUnit)
+	expected := pkix.Name{
+		Organization:       []string{"Example Corp"},
+		OrganizationalUnit: []string{"Engineering", "Platform"},
+		Country:            []string{"NL"},
+		Locality:           []string{"Amsterdam"},
+		Province:           []string{"Noord-Holland"},
+		StreetAddress:      []string{"1 Example Street"},
+		PostalCode:         []string{"1000 AA"},
+	}
+	if !reflect.DeepEqual(subject.Organization, expected.Organization) ||
+		!reflect.DeepEqual(subject.OrganizationalUnit, expected.OrganizationalUnit) ||
+		!reflect.DeepEqual(subject.Country, expected.Country) ||
+		!reflect.DeepEqual(subject.Locality, expected.Locality) ||
+		!reflect.DeepEqual(subject.Province, expected.Province) ||
+		!reflect.DeepEqual(subject.StreetAddress, expected.StreetAddress) ||
+		!reflect.DeepEqual(subject.PostalCode, expected.PostalCode) ||
+		subject.CommonName != "foo.example.com" {
+		t.Fatalf("bad subject: %#v", subject)
+	}
+
+	// Repeated values, and empty ones, are only put in once
+	roleData["organization"] = "Example Corp,example corp"
+	roleData["ou"] = "Engineering,,Engineering, Platform"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	subject = parseIssuedCert(t, resp).Subject
+	sort.Strings(subject.OrganizationalUnit)
+	if !reflect.DeepEqual(subject.Organization, expected.Organization) ||
+		!reflect.DeepEqual(subject.OrganizationalUnit, expected.OrganizationalUnit) {
+		t.Fatalf("bad subject: %#v", subject)
+	}
+}
+
+func TestBackend_dropDisallowedSANs(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allowed_base_domain": "example.com",
+		"allow_subdomains":    true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "bar.example.com,foo.example.org,baz.example.com,bar.example.net",
+	}
+
+	// By default, one disallowed name fails the request
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected the request to be refused")
+	}
+
+	roleData["drop_disallowed_sans"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	if strings.Join(cert.DNSNames, ",") != "foo.example.com,bar.example.com,baz.example.com" {
+		t.Fatalf("bad DNS names: %v", cert.DNSNames)
+	}
+	if len(resp.Warnings()) != 1 || !strings.Contains(resp.Warnings()[0], "foo.example.org, bar.example.net") {
+		t.Fatalf("expected the dropped names in a warning, got: %v", resp.Warnings())
+	}
+
+	// Nothing is dropped when everything is allowed
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "bar.example.com",
+	})
+	if cert := parseIssuedCert(t, resp); len(cert.DNSNames) != 2 || len(resp.Warnings()) != 0 {
+		t.Fatalf("bad: names %v, warnings %v", cert.DNSNames, resp.Warnings())
+	}
+
+	// The common name itself is never dropped
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.org",
+		"alt_names":   "bar.example.com",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a disallowed common name to fail the request")
+	}
+}
+
+func TestBackend_requireCN(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allowed_base_domain": "example.com",
+	}
+	sansOnly := map[string]interface{}{
+		"alt_names": "foo.example.com,bar.example.com",
+	}
+
+	_, resp := issueWithRole(t, b, storage, roleData, sansOnly)
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a missing common name to be refused by default")
+	}
+
+	roleData["require_cn"] = false
+	_, resp = issueWithRole(t, b, storage, roleData, sansOnly)
+	cert := parseIssuedCert(t, resp)
+	if cert.Subject.CommonName != "" || !reflect.DeepEqual(cert.DNSNames, []string{"foo.example.com", "bar.example.com"}) {
+		t.Fatalf("bad names: CN %q, SANs %v", cert.Subject.CommonName, cert.DNSNames)
+	}
+
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"ip_sans": "10.0.0.1",
+	})
+	if cert := parseIssuedCert(t, resp); cert.Subject.CommonName != "" || len(cert.IPAddresses) != 1 {
+		t.Fatalf("bad names: CN %q, IPs %v", cert.Subject.CommonName, cert.IPAddresses)
+	}
+
+	// Some name is still needed, and the alt names are still checked
+	for _, issueData := range []map[string]interface{}{
+		{},
+		{"alt_names": "foo.example.org"},
+	} {
+		_, resp := issueWithRole(t, b, storage, roleData, issueData)
+		if !isErrorResponse(resp) {
+			t.Fatalf("expected %#v to be refused", issueData)
+		}
+	}
+	roleData["drop_disallowed_sans"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"alt_names": "foo.example.org",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a request with every name dropped to be refused")
+	}
+}
+
+func TestBackend_excludeCNFromSANs(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	hasSANExtension := func(cert *x509.Certificate) bool {
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidExtensionSubjectAltName) {
+				return true
+			}
+		}
+		return false
+	}
+
+	roleData := map[string]interface{}{
+		"allowed_base_domain":  "example.com",
+		"exclude_cn_from_sans": true,
+		"max_sans":             1,
+	}
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "device.example.com",
+	})
+	cert := parseIssuedCert(t, resp)
+	if cert.Subject.CommonName != "device.example.com" || len(cert.DNSNames) != 0 || hasSANExtension(cert) {
+		t.Fatalf("expected a subject-only certificate: CN %q, SANs %v", cert.Subject.CommonName, cert.DNSNames)
+	}
+
+	// Alt names are still added, without the common name, which doesn't
+	// count towards max_sans
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "device.example.com",
+		"alt_names":   "foo.example.com",
+	})
+	cert = parseIssuedCert(t, resp)
+	if !reflect.DeepEqual(cert.DNSNames, []string{"foo.example.com"}) {
+		t.Fatalf("bad SANs: %v", cert.DNSNames)
+	}
+
+	// The common name is still checked against the role
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "device.example.org",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a disallowed common name to be refused")
+	}
+
+	roleData["exclude_cn_from_sans"] = false
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "device.example.com",
+	})
+	if cert := parseIssuedCert(t, resp); !reflect.DeepEqual(cert.DNSNames, []string{"device.example.com"}) {
+		t.Fatalf("expected the common name as a SAN by default: %v", cert.DNSNames)
+	}
+}
+
+func TestBackend_otherSANs(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	oidUPN := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+	roleData := map[string]interface{}{
+		"allow_any_name":     true,
+		"allowed_other_sans": "1.3.6.1.4.1.311.20.2.3;UTF8:*@example.com",
+	}
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ip_sans":     "10.0.0.1",
+		"other_sans":  "1.3.6.1.4.1.311.20.2.3;UTF8:alice@example.com,1.3.6.1.4.1.311.20.2.3;utf-8:bob@example.com",
+	})
+	cert := parseIssuedCert(t, resp)
+	if !reflect.DeepEqual(cert.DNSNames, []string{"foo.example.com"}) || len(cert.IPAddresses) != 1 {
+		t.Fatalf("expected the other names to be kept: %v, %v", cert.DNSNames, cert.IPAddresses)
+	}
+
+	var sanExts []pkix.Extension
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtensionSubjectAltName) {
+			sanExts = append(sanExts, ext)
+		}
+	}
+	if len(sanExts) != 1 || sanExts[0].Critical {
+		t.Fatalf("expected one non-critical SAN extension, got %#v", sanExts)
+	}
+	var names []asn1.RawValue
+	if _, err := asn1.Unmarshal(sanExts[0].Value, &names); err != nil {
+		t.Fatal(err)
+	}
+	var upns []string
+	for _, name := range names {
+		if name.Tag != 0 {
+			continue
+		}
+		var other struct {
+			OID   asn1.ObjectIdentifier
+			Value asn1.RawValue `asn1:"explicit,tag:0"`
+		}
+		if _, err := asn1.UnmarshalWithParams(name.FullBytes, &other, "tag:0"); err != nil {
+			t.Fatal(err)
+		}
+		var value string
+		if _, err := asn1.UnmarshalWithParams(other.Value.Bytes, &value, "utf8"); err != nil {
+			t.Fatal(err)
+		}
+		if !other.OID.Equal(oidUPN) {
+			t.Fatalf("bad other SAN OID: %s", other.OID)
+		}
+		upns = append(upns, value)
+	}
+	if !reflect.DeepEqual(upns, []string{"alice@example.com", "bob@example.com"}) {
+		t.Fatalf("bad UPNs: %v", upns)
+	}
+
+	for _, otherSANs := range []string{
+		"1.3.6.1.4.1.311.20.2.3;UTF8:mallory@example.org",
+		"1.3.6.1.4.1.311.20.2.4;UTF8:alice@example.com",
+		"1.3.6.1.4.1.311.20.2.3;BMP:alice@example.com",
+		"1.3.6.1.4.1.311.20.2.3;UTF8:",
+		"upn;UTF8:alice@example.com",
+		"1.3.6.1.4.1.311.20.2.3",
+	} {
+		_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+			"common_name": "foo.example.com",
+			"other_sans":  otherSANs,
+		})
+		if !isErrorResponse(resp) {
+			t.Fatalf("expected %s to be refused", otherSANs)
+		}
+	}
+
+	// None are allowed by default
+	_, resp = issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name": true,
+	}, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"other_sans":  "1.3.6.1.4.1.311.20.2.3;UTF8:alice@example.com",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected other SANs to be refused by default")
+	}
+
+	roleData["allowed_other_sans"] = "1.3.6.1.4.1.311.20.2.3"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an invalid allowed_other_sans entry to be rejected")
+	}
+}
+
+func TestBackend_basicConstraintsCritical(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	basicConstraints := func(cert *x509.Certificate) pkix.Extension {
+		var found []pkix.Extension
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidExtensionBasicConstraints) {
+				found = append(found, ext)
+			}
+		}
+		if len(found) != 1 {
+			t.Fatalf("expected one basic constraints extension, got %d", len(found))
+		}
+		if !cert.BasicConstraintsValid || cert.IsCA {
+			t.Fatalf("expected the certificate to be marked as not a CA")
+		}
+		return found[0]
+	}
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	// Critical by default
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if ext := basicConstraints(parseIssuedCert(t, resp)); !ext.Critical {
+		t.Fatalf("expected the extension to be critical")
+	}
+
+	roleData["basic_constraints_critical"] = false
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if ext := basicConstraints(parseIssuedCert(t, resp)); ext.Critical {
+		t.Fatalf("expected the extension not to be critical")
+	}
+}
+
+func TestBackend_requireOCSPStapling(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	tlsFeatures := func(cert *x509.Certificate) []pkix.Extension {
+		var found []pkix.Extension
+		for _, ext := range cert.Extensions {
+			if ext.Id.Equal(oidExtensionTLSFeature) {
+				found = append(found, ext)
+			}
+		}
+		return found
+	}
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if exts := tlsFeatures(parseIssuedCert(t, resp)); len(exts) != 0 {
+		t.Fatalf("expected no TLS feature extension by default, got %#v", exts)
+	}
+
+	roleData["require_ocsp_stapling"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	exts := tlsFeatures(parseIssuedCert(t, resp))
+	if len(exts) != 1 || exts[0].Critical {
+		t.Fatalf("expected one non-critical TLS feature extension, got %#v", exts)
+	}
+	var features []int
+	if rest, err := asn1.Unmarshal(exts[0].Value, &features); err != nil || len(rest) != 0 {
+		t.Fatalf("bad TLS feature extension: %v", err)
+	}
+	if !reflect.DeepEqual(features, []int{5}) {
+		t.Fatalf("expected only status_request, got %v", features)
+	}
+
+	roleResp, _ := issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name":        true,
+		"require_ocsp_stapling": true,
+		"x509_version":          1,
+		"server_flag":           false,
+		"client_flag":           false,
+		"key_usage":             "",
+	}, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected require_ocsp_stapling to be refused for version 1 certificates")
+	}
+}
+
+func TestBackend_ipCommonName(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"allow_ip_sans":  false,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "127.0.0.1",
+	}
+
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if !isErrorResponse(resp) || !strings.Contains(errorMessage(resp), "IP Subject Alternative Names") {
+		t.Fatalf("expected an IP common name to be refused with IP SANs disabled, got: %#v", resp)
+	}
+
+	roleData["allow_ip_sans"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if cert := parseIssuedCert(t, resp); cert.Subject.CommonName != "127.0.0.1" {
+		t.Fatalf("bad common name: %s", cert.Subject.CommonName)
+	}
+}
+
+func TestBackend_provenanceExtension(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name":                true,
+		"provenance_extension_oid":      "1.3.6.1.4.1.12345.2",
+		"provenance_extension_template": "pipeline={{.DisplayName}} role={{.Role}} cn={{.CommonName}}",
+	}
+	if _, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "roles/test",
+		Storage:   storage,
+		Data:      roleData,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation:   logical.WriteOperation,
+		Path:        "issue/test",
+		Storage:     storage,
+		DisplayName: "build-1234",
+		Data: map[string]interface{}{
+			"common_name": "foo.example.com",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseIssuedCert(t, resp)
+
+	expected := "pipeline=build-1234 role=test cn=foo.example.com"
+	if resp.Data["provenance"] != expected {
+		t.Fatalf("bad provenance in response: %#v", resp.Data["provenance"])
+	}
+	var found []string
+	for _, ext := range cert.Extensions {
+		if ext.Id.String() != "1.3.6.1.4.1.12345.2" {
+			continue
+		}
+		if ext.Critical {
+			t.Fatalf("expected the extension not to be critical")
+		}
+		var value string
+		rest, err := asn1.UnmarshalWithParams(ext.Value, &value, "utf8")
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("error decoding provenance: %v", err)
+		}
+		found = append(found, value)
+	}
+	if len(found) != 1 || found[0] != expected {
+		t.Fatalf("bad provenance extension: %v", found)
+	}
+
+	// Off by default
+	_, resp = issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name": true,
+	}, map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	if _, ok := resp.Data["provenance"]; ok {
+		t.Fatalf("expected no provenance without the option")
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"provenance_extension_oid": "2.5.29.99", "provenance_extension_template": "x"},
+		{"provenance_extension_oid": "1.3.6.1.4.1.12345.2"},
+		{"provenance_extension_template": "x"},
+		{"provenance_extension_oid": "1.3.6.1.4.1.12345.2", "provenance_extension_template": "{{.Role"},
+		{"provenance_extension_oid": "1.3.6.1.4.1.12345.2", "provenance_extension_template": "{{.Pipeline}}"},
+	} {
+		roleResp, _ := issueWithRole(t, b, storage, bad, nil)
+		if !roleResp.IsError() {
+			t.Fatalf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestBackend_notBeforeDuration(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "1h",
+	}
+	for _, c := range []struct {
+		notBeforeDuration string
+		backdate          time.Duration
+	}{
+		{"", 30 * time.Second},
+		{"5m", 5 * time.Minute},
+		{"0s", 0},
+	} {
+		if len(c.notBeforeDuration) != 0 {
+			roleData["not_before_duration"] = c.notBeforeDuration
+		}
+		_, resp := issueWithRole(t, b, storage, roleData, issueData)
+		cert := parseIssuedCert(t, resp)
+		if v := cert.NotAfter.Sub(cert.NotBefore); v != time.Hour+c.backdate {
+			t.Fatalf("expected the start to be backdated by %s, got a validity of %s", c.backdate, v)
+		}
+		if d := time.Until(cert.NotAfter); d < 59*time.Minute || d > time.Hour {
+			t.Fatalf("expected the end to be unaffected, got %s from now", d)
+		}
+	}
+
+	roleData["not_before_duration"] = "-1m"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected a negative not_before_duration to be rejected")
+	}
+}
+
+func TestBackend_maxTTLIncludesBackdate(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	validity := func(resp *logical.Response) time.Duration {
+		cert := parseIssuedCert(t, resp)
+		return cert.NotAfter.Sub(cert.NotBefore)
+	}
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"max_ttl":        "1h",
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "1h",
+	}
+
+	// By default only the TTL counts
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if v := validity(resp); v != time.Hour+30*time.Second {
+		t.Fatalf("bad validity: %s", v)
+	}
+
+	// Otherwise the backdated start counts too, so a TTL of max_ttl is
+	// refused, and a defaulted one is shortened to fit
+	roleData["max_ttl_includes_backdate"] = true
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if msg := userErrorMessage(resp); !strings.Contains(msg, "validity period") {
+		t.Fatalf("expected the backdated validity period to be refused, got: %#v", resp)
+	}
+	issueData["ttl"] = "59m30s"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if v := validity(resp); v != time.Hour {
+		t.Fatalf("bad validity at the limit: %s", v)
+	}
+	delete(issueData, "ttl")
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if v := validity(resp); v != time.Hour {
+		t.Fatalf("bad validity for a defaulted TTL: %s", v)
+	}
+
+	roleData["not_before_duration"] = "1h"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected a not_before_duration as long as max_ttl to be rejected")
+	}
+
+	// The end of the actual validity period is checked against the CA's
+	// expiry
+	resp, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "config/ca",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"pem_bundle": generateTestCAWithExpiry(t, "Vault Testing CA", time.Now().Add(2*time.Hour)),
+		},
+	})
+	if err != nil || (resp != nil && isErrorResponse(resp)) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+	roleData = map[string]interface{}{
+		"allow_any_name": true,
+		"max_ttl":        "24h",
+	}
+	for _, c := range []struct {
+		ttl     string
+		allowed bool
+	}{
+		{"1h59m", true},
+		{"2h1m", false},
+	} {
+		_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+			"common_name": "foo.example.com",
+			"ttl":         c.ttl,
+		})
+		if isUserError(resp) == c.allowed {
+			t.Fatalf("expected a ttl of %s to be allowed: %t, got: %#v", c.ttl, c.allowed, resp)
+		}
+	}
+}
+
+func TestBackend_minTTL(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	validity := func(resp *logical.Response) time.Duration {
+		cert := parseIssuedCert(t, resp)
+		return cert.NotAfter.Sub(cert.NotBefore)
+	}
+
+	roleData := map[string]interface{}{
+		"allow_any_name":      true,
+		"min_ttl":             "2h",
+		"not_before_duration": "0s",
+	}
+
+	// Rejected by default
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "30m",
+	})
+	if !isErrorResponse(resp) || !strings.Contains(errorMessage(resp), "minimum") {
+		t.Fatalf("expected a short TTL to be rejected, got: %#v", resp)
+	}
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "3h",
+	})
+	if v := validity(resp); v != 3*time.Hour {
+		t.Fatalf("bad validity: %s", v)
+	}
+
+	roleData["min_ttl_behavior"] = "bump"
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "30m",
+	})
+	if v := validity(resp); v != 2*time.Hour {
+		t.Fatalf("expected the TTL to be bumped to the minimum, got %s", v)
+	}
+	if resp.Secret.TTL != 2*time.Hour {
+		t.Fatalf("bad lease TTL: %s", resp.Secret.TTL)
+	}
+
+	// A default TTL below the minimum is bumped regardless of the behavior
+	roleData["min_ttl_behavior"] = "reject"
+	roleData["min_ttl"] = "36h"
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	if v := validity(resp); v != 36*time.Hour {
+		t.Fatalf("expected the default TTL to be bumped to the minimum, got %s", v)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"min_ttl": "-1h"},
+		{"min_ttl": "2h", "max_ttl": "1h"},
+		{"min_ttl": "2h", "ttl": "1h"},
+		{"min_ttl": "2h", "min_ttl_behavior": "ignore"},
+	} {
+		roleResp, _ := issueWithRole(t, b, storage, bad, nil)
+		if !roleResp.IsError() {
+			t.Fatalf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestBackend_notAfter(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"max_ttl":        "48h",
+		"min_ttl":        "1h",
+	}
+	issue := func(data map[string]interface{}) *logical.Response {
+		data["common_name"] = "foo.example.com"
+		_, resp := issueWithRole(t, b, storage, roleData, data)
+		return resp
+	}
+
+	notAfter := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	resp := issue(map[string]interface{}{
+		"not_after": notAfter.Format(time.RFC3339),
+	})
+	if cert := parseIssuedCert(t, resp); !cert.NotAfter.Equal(notAfter) {
+		t.Fatalf("expected the certificate to expire at %s, got %s", notAfter, cert.NotAfter)
+	}
+	if resp.Secret.TTL <= 23*time.Hour || resp.Secret.TTL > 24*time.Hour {
+		t.Fatalf("bad lease TTL: %s", resp.Secret.TTL)
+	}
+
+	// Aligning the validity to midnight doesn't move a fixed expiry
+	roleData["align_validity_to_day"] = true
+	resp = issue(map[string]interface{}{
+		"not_after": notAfter.Format(time.RFC3339),
+	})
+	if cert := parseIssuedCert(t, resp); !cert.NotAfter.Equal(notAfter) {
+		t.Fatalf("expected the certificate to expire at %s, got %s", notAfter, cert.NotAfter)
+	}
+	delete(roleData, "align_validity_to_day")
+
+	for _, bad := range []map[string]interface{}{
+		// Beyond the role's max TTL
+		{"not_after": time.Now().Add(72 * time.Hour).Format(time.RFC3339)},
+		// Below the minimum, which is not bumped for a fixed expiry
+		{"not_after": time.Now().Add(30 * time.Minute).Format(time.RFC3339)},
+		{"not_after": time.Now().Add(-time.Hour).Format(time.RFC3339)},
+		{"not_after": "tomorrow"},
+		{"not_after": notAfter.Format(time.RFC3339), "ttl": "24h"},
+	} {
+		roleData["min_ttl_behavior"] = "bump"
+		if resp := issue(bad); !isErrorResponse(resp) {
+			t.Fatalf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestBackend_nonPositiveTTL(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	for _, ttl := range []string{"0s", "-1h"} {
+		_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+			"common_name": "foo.example.com",
+			"ttl":         ttl,
+		})
+		if !isErrorResponse(resp) || !strings.Contains(errorMessage(resp), "greater than zero") {
+			t.Fatalf("expected a ttl of %s to be rejected, got: %#v", ttl, resp)
+		}
+	}
+
+	// Even with a minimum to bump it to, as it was surely a mistake
+	roleData["min_ttl"] = "1h"
+	roleData["min_ttl_behavior"] = "bump"
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"ttl":         "0s",
+	})
+	if !isErrorResponse(resp) {
+		t.Fatalf("expected a ttl of 0s to be rejected, got: %#v", resp)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"ttl": "0s"},
+		{"ttl": "-1h"},
+		{"max_ttl": "0s"},
+		{"max_ttl": "-1h"},
+	} {
+		roleResp, _ := issueWithRole(t, b, storage, bad, nil)
+		if !roleResp.IsError() {
+			t.Fatalf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestBackend_sanOrder(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "m.example.com",
+		"alt_names":   "z.example.com,a.example.com,k.example.com",
+		"ip_sans":     "10.0.0.2,10.0.0.1",
+	}
+
+	// The order of the names in the extension itself, not as parsed
+	sanOrder := func(cert *x509.Certificate) []string {
+		for _, ext := range cert.Extensions {
+			if !ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 17}) {
+				continue
+			}
+			var sans []asn1.RawValue
+			if _, err := asn1.Unmarshal(ext.Value, &sans); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, san := range sans {
+				switch san.Tag {
+				case 2:
+					names = append(names, string(san.Bytes))
+				case 7:
+					names = append(names, net.IP(san.Bytes).String())
+				}
+			}
+			return names
+		}
+		t.Fatalf("no subject alternative name extension")
+		return nil
+	}
+
+	expected := "m.example.com,z.example.com,a.example.com,k.example.com,10.0.0.2,10.0.0.1"
+	for i := 0; i < 3; i++ {
+		_, resp := issueWithRole(t, b, storage, roleData, issueData)
+		if order := strings.Join(sanOrder(parseIssuedCert(t, resp)), ","); order != expected {
+			t.Fatalf("bad SAN order: %s", order)
+		}
+	}
+
+	// Repeated names only appear once, where they were first given
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "m.example.com",
+		"alt_names":   "z.example.com,M.example.com,a.example.com,z.example.com",
+		"ip_sans":     "10.0.0.2,10.0.0.1,10.0.0.2,::ffff:10.0.0.1",
+	})
+	cert := parseIssuedCert(t, resp)
+	if order := strings.Join(sanOrder(cert), ","); order != "m.example.com,z.example.com,a.example.com,10.0.0.2,10.0.0.1" {
+		t.Fatalf("bad deduplicated SANs: %s", order)
+	}
+	if cert.Subject.CommonName != "m.example.com" {
+		t.Fatalf("bad common name: %s", cert.Subject.CommonName)
+	}
+}
+
+func TestBackend_serialNumberCollision(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	existing := parseIssuedCert(t, resp).SerialNumber
+
+	defer func(orig func(int) (*big.Int, error)) {
+		randomSerialNumber = orig
+	}(randomSerialNumber)
+	var calls int
+	randomSerialNumber = func(int) (*big.Int, error) {
+		calls++
+		if calls == 1 {
+			return new(big.Int).Set(existing), nil
+		}
+		return big.NewInt(int64(calls)), nil
+	}
+
+	// The colliding serial is replaced
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if serial := parseIssuedCert(t, resp).SerialNumber; serial.Int64() != 2 || calls != 2 {
+		t.Fatalf("expected a fresh serial number after the collision, got %s after %d attempts", serial, calls)
+	}
+
+	// Revoked certificates count too
+	if _, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "revoke",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"serial_number": certutil.GetOctalFormatted(existing.Bytes(), ":"),
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if serial := parseIssuedCert(t, resp).SerialNumber; serial.Cmp(existing) == 0 {
+		t.Fatalf("expected the serial of a revoked certificate not to be reused")
+	}
+
+	// Give up eventually
+	randomSerialNumber = func(int) (*big.Int, error) {
+		return new(big.Int).Set(existing), nil
+	}
+	_, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "issue/test",
+		Storage:   storage,
+		Data:      issueData,
+	})
+	if err == nil || !strings.Contains(err.Error(), "unused serial number") {
+		t.Fatalf("expected an error when every serial collides, got: %v", err)
+	}
+}
+
+func TestBackend_anyExtKeyUsage(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name":    true,
+		"server_flag":       true,
+		"client_flag":       true,
+		"any_ext_key_usage": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	roleResp, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if roleResp == nil || len(roleResp.Warnings()) != 1 || !strings.Contains(roleResp.Warnings()[0], "any purpose") {
+		t.Fatalf("expected a warning when saving the role, got: %#v", roleResp)
+	}
+	cert := parseIssuedCert(t, resp)
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageAny || len(cert.UnknownExtKeyUsage) != 0 {
+		t.Fatalf("expected only anyExtendedKeyUsage, got %v %v", cert.ExtKeyUsage, cert.UnknownExtKeyUsage)
+	}
+
+	// Satisfies a role that requires some usage on its own
+	roleData = map[string]interface{}{
+		"allow_any_name":       true,
+		"server_flag":          false,
+		"client_flag":          false,
+		"any_ext_key_usage":    true,
+		"empty_usage_behavior": "reject",
+	}
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if cert := parseIssuedCert(t, resp); len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageAny {
+		t.Fatalf("expected only anyExtendedKeyUsage, got %v", cert.ExtKeyUsage)
+	}
+
+	// Off by default
+	roleResp, resp = issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name": true,
+	}, issueData)
+	if roleResp != nil && len(roleResp.Warnings()) != 0 {
+		t.Fatalf("expected no warning, got %v", roleResp.Warnings())
+	}
+	for _, usage := range parseIssuedCert(t, resp).ExtKeyUsage {
+		if usage == x509.ExtKeyUsageAny {
+			t.Fatalf("expected no anyExtendedKeyUsage by default")
+		}
+	}
+}
+
+func TestBackend_extKeyUsageOIDs(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	smartcardLogon := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}
+	pdfSigning := asn1.ObjectIdentifier{1, 2, 840, 113583, 1, 1, 5}
+
+	roleData := map[string]interface{}{
+		"allow_any_name":     true,
+		"server_flag":        false,
+		"ext_key_usage_oids": "1.3.6.1.4.1.311.20.2.2, 1.2.840.113583.1.1.5",
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	// Alongside the named flags
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Fatalf("bad named usages: %v", cert.ExtKeyUsage)
+	}
+	if len(cert.UnknownExtKeyUsage) != 2 || !cert.UnknownExtKeyUsage[0].Equal(smartcardLogon) || !cert.UnknownExtKeyUsage[1].Equal(pdfSigning) {
+		t.Fatalf("bad custom usages: %v", cert.UnknownExtKeyUsage)
+	}
+
+	// On their own, they count as usages
+	roleData["client_flag"] = false
+	roleData["empty_usage_behavior"] = "reject"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert = parseIssuedCert(t, resp)
+	if len(cert.ExtKeyUsage) != 0 || len(cert.UnknownExtKeyUsage) != 2 {
+		t.Fatalf("bad usages: %v %v", cert.ExtKeyUsage, cert.UnknownExtKeyUsage)
+	}
+
+	for _, bad := range []string{"1.3.6.1.4.1.311.20.2.2,foo", "1", "3.1"} {
+		roleData["ext_key_usage_oids"] = bad
+		roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+		if !roleResp.IsError() {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestBackend_keyUsage(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if ku := parseIssuedCert(t, resp).KeyUsage; ku != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment|x509.KeyUsageKeyAgreement {
+		t.Fatalf("bad default key usage: %v", ku)
+	}
+
+	roleData["key_type"] = "ec"
+	roleData["key_bits"] = 256
+	roleData["key_usage"] = "digitalSignature, KeyAgreement"
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if ku := parseIssuedCert(t, resp).KeyUsage; ku != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyAgreement {
+		t.Fatalf("bad key usage: %v", ku)
+	}
+
+	// An empty list leaves the extension out
+	roleData["key_usage"] = ""
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 15}) {
+			t.Fatalf("expected no key usage extension")
+		}
+	}
+
+	for _, bad := range []string{"CertSign", "DigitalSignature,Bogus"} {
+		roleData["key_usage"] = bad
+		roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+		if !roleResp.IsError() {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestBackend_pemBundleFormat(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"format":      "pem_bundle",
+	})
+	if resp == nil || isErrorResponse(resp) {
+		t.Fatalf("expected a certificate, got: %#v", resp)
+	}
+
+	var types []string
+	rest := []byte(resp.Data["certificate"].(string))
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		types = append(types, block.Type)
+	}
+	if !reflect.DeepEqual(types, []string{"RSA PRIVATE KEY", "CERTIFICATE", "CERTIFICATE"}) {
+		t.Fatalf("bad PEM bundle: %v", types)
+	}
+	parsedBundle, err := certutil.ParsePEMBundle(resp.Data["certificate"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedBundle.Certificate.Subject.CommonName != "foo.example.com" || parsedBundle.IssuingCA == nil {
+		t.Fatalf("bad PEM bundle contents: %#v", parsedBundle)
+	}
+
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "foo.example.com",
+		"format":      "der",
+	})
+	if resp == nil || !isErrorResponse(resp) {
+		t.Fatalf("expected an unknown format to be rejected, got: %#v", resp)
+	}
+}
+
+func TestBackend_allowedIPRanges(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name":    true,
+		"allowed_ip_ranges": "10.0.0.0/8, fd00::/8",
+	}
+	issue := func(ips string) *logical.Response {
+		_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+			"common_name": "foo.example.com",
+			"ip_sans":     ips,
+		})
+		return resp
+	}
+
+	cert := parseIssuedCert(t, issue("10.1.2.3,fd00::1"))
+	if len(cert.IPAddresses) != 2 {
+		t.Fatalf("bad IP SANs: %v", cert.IPAddresses)
+	}
+	resp := issue("10.1.2.3,192.168.1.1")
+	if !isErrorResponse(resp) || !strings.Contains(errorMessage(resp), "192.168.1.1") {
+		t.Fatalf("expected an address outside of the ranges to be rejected, got: %#v", resp)
+	}
+
+	// Addresses given as the common name or alt names are held to the
+	// same ranges
+	for _, names := range []map[string]interface{}{
+		{"common_name": "8.8.8.8"},
+		{"common_name": "10.1.2.3", "alt_names": "1.2.3.4"},
+	} {
+		_, resp := issueWithRole(t, b, storage, roleData, names)
+		if msg := userErrorMessage(resp); !strings.Contains(msg, "outside of the ranges") || !strings.Contains(msg, nameReasonIP) {
+			t.Fatalf("expected %v to be rejected, got: %#v", names, resp)
+		}
+	}
+	_, resp = issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name": "10.1.2.3",
+	})
+	parseIssuedCert(t, resp)
+
+	// No ranges allows any address
+	roleData["allowed_ip_ranges"] = ""
+	parseIssuedCert(t, issue("192.168.1.1"))
+
+	roleData["allowed_ip_ranges"] = "10.0.0.0"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an invalid CIDR to be rejected")
+	}
+}
+
+func TestBackend_allowedDomains(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allowed_domains": "example.com, example.org, web-*.example.net",
+	}
+	issue := func(cn string) (string, bool) {
+		_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+			"common_name": cn,
+		})
+		if isErrorResponse(resp) {
+			return errorMessage(resp), false
+		}
+		return "", true
+	}
+
+	for _, cn := range []string{"foo.example.com", "foo.example.org", "*.example.org"} {
+		if msg, ok := issue(cn); !ok {
+			t.Fatalf("expected %s to be allowed: %s", cn, msg)
+		}
+	}
+	for _, cn := range []string{"foo.bar.example.com", "foo.example.net", "web-1.example.net"} {
+		if _, ok := issue(cn); ok {
+			t.Fatalf("expected %s to be rejected", cn)
+		}
+	}
+
+	// Globs only apply when enabled, and then match the whole name
+	roleData["allow_glob_domains"] = true
+	if msg, ok := issue("web-1.example.net"); !ok {
+		t.Fatalf("expected a glob match to be allowed: %s", msg)
+	}
+	for _, cn := range []string{"db.example.net", "a.web-1.example.net"} {
+		if _, ok := issue(cn); ok {
+			t.Fatalf("expected %s to be rejected", cn)
+		}
+	}
+
+	roleData["allowed_domains"] = "web-[.example.net"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestBackend_maxSANs(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"max_sans":       3,
+	}
+	issue := func(altNames, ips string) *logical.Response {
+		_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+			"common_name": "foo.example.com",
+			"alt_names":   altNames,
+			"ip_sans":     ips,
+		})
+		return resp
+	}
+
+	parseIssuedCert(t, issue("bar.example.com", "10.0.0.1"))
+	resp := issue("bar.example.com,baz.example.com", "10.0.0.1")
+	if !isErrorResponse(resp) || !strings.Contains(errorMessage(resp), "4 Subject Alternative Names, more than the 3") {
+		t.Fatalf("expected too many SANs to be rejected, got: %#v", resp)
+	}
+
+	roleData["max_sans"] = 0
+	parseIssuedCert(t, issue("bar.example.com,baz.example.com", "10.0.0.1"))
+
+	roleData["max_sans"] = -1
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected a negative max_sans to be rejected")
+	}
+}
+
+func TestBackend_policyIdentifiers(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name":     true,
+		"policy_identifiers": "2.23.140.1.2.1, 1.3.6.1.4.1.44947.1.1.1",
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	cert := parseIssuedCert(t, resp)
+	if len(cert.PolicyIdentifiers) != 2 ||
+		!cert.PolicyIdentifiers[0].Equal(asn1.ObjectIdentifier{2, 23, 140, 1, 2, 1}) ||
+		!cert.PolicyIdentifiers[1].Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 44947, 1, 1, 1}) {
+		t.Fatalf("bad policy identifiers: %v", cert.PolicyIdentifiers)
+	}
+
+	roleData["policy_identifiers"] = ""
+	_, resp = issueWithRole(t, b, storage, roleData, issueData)
+	if cert := parseIssuedCert(t, resp); len(cert.PolicyIdentifiers) != 0 {
+		t.Fatalf("expected no policy identifiers, got %v", cert.PolicyIdentifiers)
+	}
+
+	roleData["policy_identifiers"] = "2.23.140.1.2.1,anyPolicy"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an invalid OID to be rejected")
+	}
+}
+
+func TestBackend_serialBits(t *testing.T) {
+	for _, bits := range []int{64, 128, defaultSerialBits} {
+		limit := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+		maxLen := 0
+		for i := 0; i < 256; i++ {
+			serial, err := randomSerialNumber(bits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serial.Sign() <= 0 || serial.Cmp(limit) >= 0 {
+				t.Fatalf("serial %s out of range for %d bits", serial, bits)
+			}
+			if serial.BitLen() > maxLen {
+				maxLen = serial.BitLen()
+			}
+		}
+		// The chance of 256 serials all falling below 2^(bits-8) is 2^-2048
+		if maxLen < bits-8 {
+			t.Fatalf("serials for %d bits are no longer than %d bits", bits, maxLen)
+		}
+	}
+
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+		"serial_bits":    64,
+	}
+	issueData := map[string]interface{}{
+		"common_name": "foo.example.com",
+	}
+	_, resp := issueWithRole(t, b, storage, roleData, issueData)
+	if cert := parseIssuedCert(t, resp); cert.SerialNumber.BitLen() > 64 {
+		t.Fatalf("expected a serial of at most 64 bits, got %d", cert.SerialNumber.BitLen())
+	}
+
+	for _, bad := range []int{-1, 63, 160} {
+		roleData["serial_bits"] = bad
+		roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+		if !roleResp.IsError() {
+			t.Fatalf("expected serial_bits %d to be rejected", bad)
+		}
+	}
+}
+
+func TestBackend_validateOnly(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allowed_base_domain": "example.com",
+		"allow_ip_sans":       true,
+		"organization":        "Example",
+		"max_ttl":             "24h",
+	}
+	_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+		"common_name":   "foo.example.com",
+		"alt_names":     "bar.example.com",
+		"ip_sans":       "10.0.0.1",
+		"ttl":           "2h",
+		"validate_only": true,
+	})
+	if isErrorResponse(resp) {
+		t.Fatalf("bad: %#v", resp)
+	}
+	if _, ok := resp.Data["certificate"]; ok || resp.Secret != nil {
+		t.Fatalf("expected no certificate to be issued: %#v", resp)
+	}
+	if subject := resp.Data["subject"].(string); subject != "CN=foo.example.com,O=Example" {
+		t.Fatalf("bad subject: %s", subject)
+	}
+	if !reflect.DeepEqual(resp.Data["alt_names"], []string{"foo.example.com", "bar.example.com"}) || !reflect.DeepEqual(resp.Data["ip_sans"], []string{"10.0.0.1"}) {
+		t.Fatalf("bad SANs: %#v", resp.Data)
+	}
+	if ttl := resp.Data["ttl"].(int64); ttl < 7190 || ttl > 7200 {
+		t.Fatalf("bad ttl: %d", ttl)
+	}
+	if serials, err := storage.List("certs/"); err != nil || len(serials) != 0 {
+		t.Fatalf("expected nothing to be stored, got %v, %v", serials, err)
+	}
+
+	// Requests that would be refused are refused in the same way
+	for _, issueData := range []map[string]interface{}{
+		{"common_name": "foo.example.org", "validate_only": true},
+		{"common_name": "foo.example.com", "ttl": "48h", "validate_only": true},
+	} {
+		_, resp := issueWithRole(t, b, storage, roleData, issueData)
+		if !isErrorResponse(resp) {
+			t.Fatalf("expected %#v to be refused", issueData)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package pki
+
+import (
+	"encoding/base64"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// Answers OCSP requests sent with GET, as described in RFC 6960 appendix
+// A.1, with the base64 DER request in the path
+func pathOCSP(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `ocsp/(?P<request>.+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"request": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `The base64 DER-encoded OCSP request`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathOCSPRead,
+		},
+
+		HelpSynopsis:    pathOCSPHelpSyn,
+		HelpDescription: pathOCSPHelpDesc,
+	}
+}
+
+// Answers OCSP requests sent with POST. The HTTP API only takes JSON
+// bodies, so the DER request is given base64-encoded in a field.
+func pathOCSPPost(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `ocsp`,
+		Fields: map[string]*framework.FieldSchema{
+			"request": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `The base64 DER-encoded OCSP request`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathOCSPRead,
+		},
+
+		HelpSynopsis:    pathOCSPHelpSyn,
+		HelpDescription: pathOCSPHelpDesc,
+	}
+}
+
+func (b *backend) pathOCSPRead(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	var respBytes []byte
+	reqBytes, err := base64.StdEncoding.DecodeString(data.Get("request").(string))
+	if err != nil {
+		respBytes = ocspErrorResponse(ocspMalformedRequest)
+	} else {
+		respBytes = respondOCSP(req, reqBytes)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			logical.HTTPContentType: "application/ocsp-response",
+			logical.HTTPRawBody:     respBytes,
+			logical.HTTPStatusCode:  200,
+		},
+	}, nil
+}
+
+const pathOCSPHelpSyn = `
+Check the revocation status of certificates with OCSP.
+`
+
+const pathOCSPHelpDesc = `
+This answers OCSP requests for certificates issued by the active CA or,
+after a rotation, the previous one. The DER-encoded request is given
+base64-encoded, either in the path with a GET, or in the "request" field
+with a POST. The response is DER-encoded and signed by the CA that issued
+the certificates, with a status of good, revoked, or unknown for each;
+revoked certificates include their revocation time and reason.
+`
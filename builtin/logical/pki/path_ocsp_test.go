@@ -0,0 +1,137 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_ocsp(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+		}
+		return resp
+	}
+
+	signingBundle, err := fetchCAInfo(&logical.Request{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBits, err := subjectPublicKeyBits(signingBundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameHash := crypto.SHA1.New()
+	nameHash.Write(signingBundle.Certificate.RawSubject)
+	keyHash := crypto.SHA1.New()
+	keyHash.Write(keyBits)
+	certID := func(serial *big.Int) ocspCertID {
+		return ocspCertID{
+			HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: ocspHashes[0].oid, Parameters: asn1.RawValue{Tag: asn1.TagNull}},
+			IssuerNameHash: nameHash.Sum(nil),
+			IssuerKeyHash:  keyHash.Sum(nil),
+			SerialNumber:   serial,
+		}
+	}
+	nonce := pkix.Extension{Id: oidOCSPNonce, Value: []byte{0x04, 0x02, 0xbe, 0xef}}
+	encodeRequest := func(ids ...ocspCertID) string {
+		var ocspReq ocspRequest
+		for _, id := range ids {
+			ocspReq.TBSRequest.RequestList = append(ocspReq.TBSRequest.RequestList, ocspSingleRequest{CertID: id})
+		}
+		ocspReq.TBSRequest.RequestExtensions = []pkix.Extension{nonce}
+		reqBytes, err := asn1.Marshal(ocspReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(reqBytes)
+	}
+	parseResponse := func(resp *logical.Response) (int, *ocspResponseData) {
+		if resp.Data[logical.HTTPContentType] != "application/ocsp-response" {
+			t.Fatalf("bad content type: %#v", resp.Data)
+		}
+		var ocspResp ocspResponse
+		if _, err := asn1.Unmarshal(resp.Data[logical.HTTPRawBody].([]byte), &ocspResp); err != nil {
+			t.Fatal(err)
+		}
+		if ocspResp.Status != ocspSuccessful {
+			return int(ocspResp.Status), nil
+		}
+		var basic ocspBasicResponse
+		if _, err := asn1.Unmarshal(ocspResp.ResponseBytes.Response, &basic); err != nil {
+			t.Fatal(err)
+		}
+		if err := signingBundle.Certificate.CheckSignature(x509.SHA256WithRSA, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+			t.Fatalf("bad response signature: %s", err)
+		}
+		var data ocspResponseData
+		if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &data); err != nil {
+			t.Fatal(err)
+		}
+		return ocspSuccessful, &data
+	}
+
+	request(logical.WriteOperation, "roles/test", map[string]interface{}{
+		"allow_any_name": true,
+	})
+	issue := func() *x509.Certificate {
+		return parseIssuedCert(t, request(logical.WriteOperation, "issue/test", map[string]interface{}{
+			"common_name": "foo.example.com",
+		}))
+	}
+	good, revoked := issue(), issue()
+	request(logical.WriteOperation, "revoke", map[string]interface{}{
+		"serial_number": certutil.GetOctalFormatted(revoked.SerialNumber.Bytes(), ":"),
+		"reason":        "superseded",
+	})
+
+	// Both GET and POST are answered the same way
+	ocspReq := encodeRequest(certID(good.SerialNumber), certID(revoked.SerialNumber), certID(big.NewInt(12345)))
+	for _, resp := range []*logical.Response{
+		request(logical.ReadOperation, "ocsp/"+ocspReq, nil),
+		request(logical.WriteOperation, "ocsp", map[string]interface{}{"request": ocspReq}),
+	} {
+		status, data := parseResponse(resp)
+		if status != ocspSuccessful || len(data.Responses) != 3 {
+			t.Fatalf("bad response: status %d, data %#v", status, data)
+		}
+		if !data.Responses[0].Good {
+			t.Fatalf("expected the issued certificate to be good: %#v", data.Responses[0])
+		}
+		if data.Responses[1].Revoked.RevocationTime.IsZero() || data.Responses[1].Revoked.Reason != 4 {
+			t.Fatalf("expected the revoked certificate to be revoked as superseded: %#v", data.Responses[1])
+		}
+		if !data.Responses[2].Unknown {
+			t.Fatalf("expected an unknown serial to be unknown: %#v", data.Responses[2])
+		}
+		if len(data.ResponseExtensions) != 1 || !data.ResponseExtensions[0].Id.Equal(oidOCSPNonce) {
+			t.Fatalf("expected the nonce to be echoed: %#v", data.ResponseExtensions)
+		}
+	}
+
+	// Another issuer's certificates are not answered for
+	otherID := certID(good.SerialNumber)
+	otherID.IssuerKeyHash = make([]byte, len(otherID.IssuerKeyHash))
+	if status, _ := parseResponse(request(logical.ReadOperation, "ocsp/"+encodeRequest(otherID), nil)); status != ocspUnauthorized {
+		t.Fatalf("expected an unauthorized status, got %d", status)
+	}
+	if status, _ := parseResponse(request(logical.ReadOperation, "ocsp/bm90IGFuIE9DU1AgcmVxdWVzdA==", nil)); status != ocspMalformedRequest {
+		t.Fatalf("expected a malformed request status, got %d", status)
+	}
+}
@@ -2,6 +2,7 @@ package pki
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/hashicorp/vault/helper/certutil"
 	"github.com/hashicorp/vault/logical"
@@ -17,6 +18,13 @@ func pathRevoke(b *backend) *framework.Path {
 				Description: `Certificate serial number, in colon- or
 hyphen-separated octal`,
 			},
+			"reason": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "unspecified",
+				Description: `The RFC 5280 revocation reason, such as
+"keyCompromise" or "superseded", put on the CRL
+entry. Defaults to "unspecified".`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -28,6 +36,33 @@ hyphen-separated octal`,
 	}
 }
 
+func pathRevokeByName(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: `revoke-by-name`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The common name or DNS SAN of the certificates
+to revoke`,
+			},
+			"reason": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "unspecified",
+				Description: `The RFC 5280 revocation reason, such as
+"keyCompromise" or "superseded", put on the CRL
+entries. Defaults to "unspecified".`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathRevokeByNameWrite,
+		},
+
+		HelpSynopsis:    pathRevokeByNameHelpSyn,
+		HelpDescription: pathRevokeByNameHelpDesc,
+	}
+}
+
 func pathRotateCRL(b *backend) *framework.Path {
 	return &framework.Path{
 		Pattern: `crl/rotate`,
@@ -46,11 +81,47 @@ func (b *backend) pathRevokeWrite(req *logical.Request, data *framework.FieldDat
 	if len(serial) == 0 {
 		return logical.ErrorResponse("The serial number must be provided"), nil
 	}
+	// Storage is keyed by the colon-separated form
+	serial = strings.Replace(strings.ToLower(serial), "-", ":", -1)
+
+	reason, err := parseRevocationReason(data.Get("reason").(string))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid reason: %s", err)), nil
+	}
+
+	b.revokeStorageLock.Lock()
+	defer b.revokeStorageLock.Unlock()
+
+	return revokeCert(b, req, serial, reason)
+}
+
+func (b *backend) pathRevokeByNameWrite(req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	name := strings.TrimSpace(data.Get("name").(string))
+	if len(name) == 0 {
+		return logical.ErrorResponse("The name must be provided"), nil
+	}
+
+	reason, err := parseRevocationReason(data.Get("reason").(string))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid reason: %s", err)), nil
+	}
 
 	b.revokeStorageLock.Lock()
 	defer b.revokeStorageLock.Unlock()
 
-	return revokeCert(b, req, serial)
+	serials, err := revokeCertsByName(b, req, name, reason)
+	switch err.(type) {
+	case certutil.UserError:
+		return logical.ErrorResponse(err.Error()), nil
+	case certutil.InternalError:
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"revoked_serials": serials,
+		},
+	}, nil
 }
 
 func (b *backend) pathRotateCRLRead(req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
@@ -80,6 +151,18 @@ const pathRevokeHelpDesc = `
 This allows certificates to be revoked using its serial number. A root token is required.
 `
 
+const pathRevokeByNameHelpSyn = `
+Revoke every certificate for a name.
+`
+
+const pathRevokeByNameHelpDesc = `
+This revokes every valid certificate whose common name, or one of whose DNS
+SANs, is the given name, compared without regard to case, and rotates the
+CRL once for all of them. The serial numbers of the revoked certificates
+are returned. Expired certificates are not revoked, and neither is the CA.
+A root token is required.
+`
+
 const pathRotateCRLHelpSyn = `
 Force a rebuild of the CRL.
 `
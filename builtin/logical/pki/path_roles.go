@@ -1,7 +1,10 @@
 package pki
 
 import (
+	"crypto/x509/pkix"
 	"fmt"
+	"net"
+	"path"
 	"time"
 
 	"github.com/fatih/structs"
@@ -49,6 +52,82 @@ the value of max_ttl.`,
 				Description: "The maximum allowed lease duration",
 			},
 
+			"min_ttl": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `The minimum allowed lease duration. Requests
+for shorter TTLs are handled as set by
+min_ttl_behavior.`,
+			},
+
+			"not_before_duration": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "30s",
+				Description: `How far before the time of issuance the
+validity period starts, to allow for clients whose
+clocks are slightly behind. Defaults to 30s; "0s"
+starts it at the time of issuance.`,
+			},
+
+			"max_ttl_includes_backdate": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, max_ttl limits the whole validity period
+of issued certificates, including the start
+backdated by not_before_duration, rather than
+only the TTL from the time of issuance. Defaults
+to false.`,
+			},
+
+			"min_ttl_behavior": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "reject",
+				Description: `What to do when a TTL below min_ttl is requested;
+"reject" (the default) refuses the request, "bump"
+issues the certificate with a TTL of min_ttl.`,
+			},
+
+			"max_ttl_grace": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set when lowering max_ttl, requests for TTLs
+up to the previous maximum are still allowed for
+this long after the change, so that existing
+clients can be migrated. Defaults to no grace period.`,
+			},
+
+			"align_validity_to_day": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, certificates are valid from midnight at
+the start of the day they are issued until the last
+midnight within their TTL, in validity_timezone.`,
+			},
+
+			"validity_timezone": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "UTC",
+				Description: `The IANA time zone, e.g. "Europe/Berlin", whose
+midnight is used by align_validity_to_day. Defaults
+to UTC.`,
+			},
+
+			"ca_min_remaining": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, requests are refused once the CA
+certificate has less than this long left before it
+expires, to force the CA to be rotated in time.`,
+			},
+
+			"ca_min_remaining_behavior": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "reject",
+				Description: `What to do when ca_min_remaining is reached;
+"reject" (the default) refuses the request, "warn"
+issues the certificate with a warning.`,
+			},
+
 			"allow_localhost": &framework.FieldSchema{
 				Type:    framework.TypeBool,
 				Default: true,
@@ -65,6 +144,23 @@ the wildcard subdomain. See the documentation for more
 information.`,
 			},
 
+			"allowed_domains": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `A comma-delimited list of domains, each treated
+as allowed_base_domain is. With allow_glob_domains,
+entries containing "*" are instead matched against
+the whole name as glob patterns.`,
+			},
+
+			"allow_glob_domains": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, entries of allowed_domains containing
+"*" are glob patterns, such as "*.corp.example.com".
+Defaults to false.`,
+			},
+
 			"allow_token_displayname": &framework.FieldSchema{
 				Type:    framework.TypeBool,
 				Default: false,
@@ -82,6 +178,14 @@ including wildcard subdomains. See the documentation for
 more information.`,
 			},
 
+			"allow_bare_domains": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, clients can request certificates for
+the allowed domains themselves, e.g. "example.com"
+as well as "foo.example.com". Defaults to false.`,
+			},
+
 			"allow_any_name": &framework.FieldSchema{
 				Type:    framework.TypeBool,
 				Default: false,
@@ -97,6 +201,62 @@ information.`,
 CN and SANs.`,
 			},
 
+			"require_cn": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: true,
+				Description: `If set to false, requests may leave out the
+common name, as long as they give at least one
+alt name, IP SAN, or URI SAN; the certificate
+then has no common name. Defaults to true.`,
+			},
+
+			"exclude_cn_from_sans": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, the common name is only put in the
+subject and not added as a DNS SAN. With no alt
+names, IP SANs, or URI SANs, the certificate has
+no Subject Alternative Name extension at all, as
+some legacy devices require. The common name is
+still checked against the role. Defaults to
+false.`,
+			},
+
+			"drop_disallowed_sans": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, requested alt names that this role does
+not allow are left out of the certificate, with a
+warning, rather than failing the request. The
+common name must still be allowed.`,
+			},
+
+			"allow_wildcard_certificates": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: true,
+				Description: `If set to false, names beginning with "*." are
+refused, regardless of the other name settings.
+Defaults to true.`,
+			},
+
+			"allow_single_label_domains": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: true,
+				Description: `If set to false, names without a dot (e.g.
+"intranet") are refused, so that only
+fully-qualified names can be issued. "localhost"
+is still governed by allow_localhost. Defaults to
+true.`,
+			},
+
+			"preserve_trailing_dot": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, a trailing dot on a requested name
+(e.g. "example.com.") is kept in the certificate.
+By default, a single trailing dot is removed.`,
+			},
+
 			"allow_ip_sans": &framework.FieldSchema{
 				Type:    framework.TypeBool,
 				Default: true,
@@ -104,6 +264,75 @@ CN and SANs.`,
 Any valid IP is accepted.`,
 			},
 
+			"allowed_ip_ranges": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, a comma-delimited list of CIDRs that
+requested IP SANs, and IP addresses given as the
+common name or alt names, must fall within. If
+empty, any IP is accepted when allow_ip_sans is
+set.`,
+			},
+
+			"max_sans": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: 0,
+				Description: `The maximum number of Subject Alternative Names,
+of all types and including the common name, in
+issued certificates. Defaults to 0, for no limit.`,
+			},
+
+			"allow_uri_sans": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, URI Subject Alternative Names (e.g.
+"spiffe://example.org/workload") are allowed.
+Defaults to false.`,
+			},
+
+			"allowed_uri_sans": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, a comma-delimited list of patterns that
+requested URI SANs must match; "*" matches any
+run of characters. If empty, any URI is allowed
+when allow_uri_sans is set.`,
+			},
+
+			"allowed_other_sans": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `A comma-delimited list of the otherName SANs that
+may be requested, each "<oid>;UTF8:<pattern>", in
+which "*" matches any run of characters, or "*"
+to allow any. If empty, none are allowed.`,
+			},
+
+			"allowed_resolution_cidrs": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, a comma-delimited list of CIDRs. Each
+requested name is resolved, and the request is
+refused if any resolves to an address outside of
+these ranges. This is advisory only, as DNS records
+can change after the check.`,
+			},
+
+			"dns_resolver": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `The DNS server, as host:port, used for
+allowed_resolution_cidrs. Defaults to the system
+resolver.`,
+			},
+
+			"dns_resolve_timeout": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "5s",
+				Description: `How long to wait when resolving each name for
+allowed_resolution_cidrs. Defaults to 5 seconds.`,
+			},
+
 			"server_flag": &framework.FieldSchema{
 				Type:    framework.TypeBool,
 				Default: true,
@@ -125,11 +354,232 @@ Defaults to true.`,
 use. Defaults to false.`,
 			},
 
+			"any_ext_key_usage": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, certificates carry only the
+anyExtendedKeyUsage extended key usage, making them
+valid for any purpose, in place of the usages set
+by the other flags.`,
+			},
+
+			"key_usage": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: defaultKeyUsage,
+				Description: `A comma-delimited list of the key usages of
+issued certificates, from DigitalSignature,
+ContentCommitment, KeyEncipherment,
+DataEncipherment, KeyAgreement, EncipherOnly, and
+DecipherOnly. Defaults to
+"DigitalSignature,KeyEncipherment,KeyAgreement";
+an empty list leaves the extension out.`,
+			},
+
+			"ext_key_usage_oids": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `A comma-delimited list of extended key usage
+OIDs to add to certificates, alongside the usages
+set by the flags, e.g. "1.3.6.1.4.1.311.20.2.2"
+for smartcard logon. Left out when
+any_ext_key_usage is set.`,
+			},
+
+			"policy_identifiers": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `A comma-delimited list of certificate policy
+OIDs to add to certificates in the certificate
+policies extension, e.g. "2.23.140.1.2.1".`,
+			},
+
+			"empty_usage_behavior": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "none",
+				Description: `What to do when server_flag, client_flag, and
+code_signing_flag are all false. "none" (the
+default) issues certificates without an extended
+key usage; "server_client" flags them for both
+server and client use; "reject" refuses to save
+such a role.`,
+			},
+
+			"append_random_to_cn": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, a random lowercase alphanumeric suffix
+is appended to the first label of the requested
+common name, e.g. "foo.example.com" becomes
+"foo-x1y2z3w4.example.com". The common name must
+have at least three labels and not be one of the
+allowed domains itself.`,
+			},
+
+			"random_cn_length": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: 8,
+				Description: `The length of the random suffix added when
+append_random_to_cn is set. Defaults to 8.`,
+			},
+
+			"private_key_usage_not_before": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, certificates carry a PrivateKeyUsagePeriod
+extension starting at this time. Either an RFC 3339
+timestamp, or a duration after the certificate's
+NotBefore.`,
+			},
+
+			"private_key_usage_not_after": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, certificates carry a PrivateKeyUsagePeriod
+extension ending at this time. Either an RFC 3339
+timestamp, or a duration after the certificate's
+NotBefore.`,
+			},
+
+			"nonce_oid": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, a random 16-byte nonce is added to each
+certificate as a non-critical extension with this
+dotted-decimal OID, and returned as "nonce".`,
+			},
+
+			"archive_issued_certificates": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, the PEM of every certificate issued
+against this role is kept at "archive/<serial>",
+even after it is revoked or expires.`,
+			},
+
+			"provenance_extension_oid": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, each certificate carries a non-critical
+extension with this dotted-decimal OID, holding
+provenance_extension_template rendered as a
+UTF8String. The rendered value is returned as
+"provenance".`,
+			},
+
+			"provenance_extension_template": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `A Go template for the provenance extension; it
+can use {{.Role}}, {{.CommonName}}, {{.DisplayName}},
+{{.MountPoint}}, and {{.Time}}.`,
+			},
+
+			"x509_version": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: 3,
+				Description: `The X.509 version of issued certificates; 3
+(the default) or 1. Version 1 certificates have no
+extensions, so no SANs or usages, and key_usage
+must be set empty; only for legacy clients that
+cannot parse version 3.`,
+			},
+
+			"utf8_subject": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, all subject attributes other than the
+country and serial number are encoded as UTF8String,
+rather than as PrintableString where possible.`,
+			},
+
+			"organization": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, the O (Organization) values of issued
+certificates, in a comma-delimited list, in place
+of those of the CA.`,
+			},
+
+			"ou": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, the OU (OrganizationalUnit) values of issued
+certificates, in a comma-delimited list, in place
+of those of the CA.`,
+			},
+
+			"country": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, the C (Country) values of issued
+certificates, in a comma-delimited list, in place
+of those of the CA.`,
+			},
+
+			"locality": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, the L (Locality) values of issued
+certificates, in a comma-delimited list, in place
+of those of the CA.`,
+			},
+
+			"province": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, the ST (Province) values of issued
+certificates, in a comma-delimited list, in place
+of those of the CA.`,
+			},
+
+			"street_address": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, the Street Address values of issued
+certificates, in a comma-delimited list, in place
+of those of the CA.`,
+			},
+
+			"postal_code": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "",
+				Description: `If set, the Postal Code values of issued
+certificates, in a comma-delimited list, in place
+of those of the CA.`,
+			},
+
+			"basic_constraints_critical": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: true,
+				Description: `Whether the basic constraints extension, which
+marks certificates as not being CAs, is critical.
+Defaults to true.`,
+			},
+
+			"require_ocsp_stapling": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, certificates carry the TLS feature
+extension with status_request, also known as
+OCSP Must-Staple, so that clients refuse them
+without a stapled OCSP response. Defaults to
+false.`,
+			},
+
+			"subject_key_id_method": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: 1,
+				Description: `How the subject key ID of certificates is computed,
+per RFC 5280 section 4.2.1.2: 1 (the default) for
+the 160-bit SHA-1 hash of the public key, or 2 for
+the 64-bit variant.`,
+			},
+
 			"key_type": &framework.FieldSchema{
 				Type:    framework.TypeString,
 				Default: "rsa",
-				Description: `The type of key to use; defaults to RSA. "rsa"
-and "ec" are the only valid values.`,
+				Description: `The type of key to use; defaults to RSA. "rsa",
+"ec" and "ed25519" are the only valid values.`,
 			},
 
 			"key_bits": &framework.FieldSchema{
@@ -137,7 +587,37 @@ and "ec" are the only valid values.`,
 				Default: 2048,
 				Description: `The number of bits to use. You will almost
 certainly want to change this if you adjust
-the key_type.`,
+the key_type. Ed25519 keys have a fixed size, so
+this must be left unset for them.`,
+			},
+
+			"signature_bits": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: 0,
+				Description: `The size of the hash used when the CA signs
+certificates: 256, 384, or 512. If unset, an
+RSA CA uses 256 and an EC CA the size matching
+its curve. With an EC CA, the hash may not be
+larger than the CA's curve, except that 256 is
+allowed for any curve. Must be unset with an
+Ed25519 CA, which signs with PureEd25519.`,
+			},
+
+			"use_pss": &framework.FieldSchema{
+				Type:    framework.TypeBool,
+				Default: false,
+				Description: `If set, the CA signs certificates with RSA-PSS
+rather than PKCS#1 v1.5 padding, with the hash
+set by signature_bits. Requires an RSA CA.
+Defaults to false.`,
+			},
+
+			"serial_bits": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: defaultSerialBits,
+				Description: `The number of random bits in the serial numbers
+of issued certificates, from 64 to 159. Defaults
+to 159.`,
 			},
 		},
 
@@ -178,6 +658,36 @@ func (b *backend) getRole(s logical.Storage, n string) (*roleEntry, error) {
 		result.LeaseMax = ""
 		modified = true
 	}
+	// Options that default to true are set on entries saved before they
+	// existed, to keep the behavior those entries had
+	var rawResult map[string]interface{}
+	if err := entry.DecodeJSON(&rawResult); err != nil {
+		return nil, err
+	}
+	if _, ok := rawResult["allow_wildcard_certificates"]; !ok {
+		result.AllowWildcardCertificates = true
+		modified = true
+	}
+	if _, ok := rawResult["allow_single_label_domains"]; !ok {
+		result.AllowSingleLabelDomains = true
+		modified = true
+	}
+	if _, ok := rawResult["key_usage"]; !ok {
+		result.KeyUsage = defaultKeyUsage
+		modified = true
+	}
+	if _, ok := rawResult["basic_constraints_critical"]; !ok {
+		result.BasicConstraintsCritical = true
+		modified = true
+	}
+	if _, ok := rawResult["require_cn"]; !ok {
+		result.RequireCN = true
+		modified = true
+	}
+	if _, ok := rawResult["serial_bits"]; !ok {
+		result.SerialBits = defaultSerialBits
+		modified = true
+	}
 	if modified {
 		jsonEntry, err := logical.StorageEntryJSON("role/"+n, &result)
 		if err != nil {
@@ -237,20 +747,74 @@ func (b *backend) pathRoleCreate(
 	name := data.Get("name").(string)
 
 	entry := &roleEntry{
-		MaxTTL:                data.Get("max_ttl").(string),
-		TTL:                   data.Get("ttl").(string),
-		AllowLocalhost:        data.Get("allow_localhost").(bool),
-		AllowedBaseDomain:     data.Get("allowed_base_domain").(string),
-		AllowTokenDisplayName: data.Get("allow_token_displayname").(bool),
-		AllowSubdomains:       data.Get("allow_subdomains").(bool),
-		AllowAnyName:          data.Get("allow_any_name").(bool),
-		EnforceHostnames:      data.Get("enforce_hostnames").(bool),
-		AllowIPSANs:           data.Get("allow_ip_sans").(bool),
-		ServerFlag:            data.Get("server_flag").(bool),
-		ClientFlag:            data.Get("client_flag").(bool),
-		CodeSigningFlag:       data.Get("code_signing_flag").(bool),
-		KeyType:               data.Get("key_type").(string),
-		KeyBits:               data.Get("key_bits").(int),
+		MaxTTL:                      data.Get("max_ttl").(string),
+		TTL:                         data.Get("ttl").(string),
+		MinTTL:                      data.Get("min_ttl").(string),
+		NotBeforeDuration:           data.Get("not_before_duration").(string),
+		MaxTTLIncludesBackdate:      data.Get("max_ttl_includes_backdate").(bool),
+		MinTTLBehavior:              data.Get("min_ttl_behavior").(string),
+		MaxTTLGrace:                 data.Get("max_ttl_grace").(string),
+		AlignValidityToDay:          data.Get("align_validity_to_day").(bool),
+		ValidityTimezone:            data.Get("validity_timezone").(string),
+		CAMinRemaining:              data.Get("ca_min_remaining").(string),
+		CAMinRemainingBehavior:      data.Get("ca_min_remaining_behavior").(string),
+		AllowLocalhost:              data.Get("allow_localhost").(bool),
+		AllowedBaseDomain:           data.Get("allowed_base_domain").(string),
+		AllowedDomains:              data.Get("allowed_domains").(string),
+		AllowGlobDomains:            data.Get("allow_glob_domains").(bool),
+		AllowTokenDisplayName:       data.Get("allow_token_displayname").(bool),
+		AllowSubdomains:             data.Get("allow_subdomains").(bool),
+		AllowBareDomains:            data.Get("allow_bare_domains").(bool),
+		AllowAnyName:                data.Get("allow_any_name").(bool),
+		EnforceHostnames:            data.Get("enforce_hostnames").(bool),
+		AllowWildcardCertificates:   data.Get("allow_wildcard_certificates").(bool),
+		AllowSingleLabelDomains:     data.Get("allow_single_label_domains").(bool),
+		RequireCN:                   data.Get("require_cn").(bool),
+		ExcludeCNFromSANs:           data.Get("exclude_cn_from_sans").(bool),
+		DropDisallowedSANs:          data.Get("drop_disallowed_sans").(bool),
+		PreserveTrailingDot:         data.Get("preserve_trailing_dot").(bool),
+		AllowIPSANs:                 data.Get("allow_ip_sans").(bool),
+		AllowURISANs:                data.Get("allow_uri_sans").(bool),
+		AllowedIPRanges:             data.Get("allowed_ip_ranges").(string),
+		MaxSANs:                     data.Get("max_sans").(int),
+		AllowedURISANs:              data.Get("allowed_uri_sans").(string),
+		AllowedOtherSANs:            data.Get("allowed_other_sans").(string),
+		AllowedResolutionCIDRs:      data.Get("allowed_resolution_cidrs").(string),
+		DNSResolver:                 data.Get("dns_resolver").(string),
+		DNSResolveTimeout:           data.Get("dns_resolve_timeout").(string),
+		ServerFlag:                  data.Get("server_flag").(bool),
+		ClientFlag:                  data.Get("client_flag").(bool),
+		CodeSigningFlag:             data.Get("code_signing_flag").(bool),
+		AnyExtKeyUsage:              data.Get("any_ext_key_usage").(bool),
+		KeyUsage:                    data.Get("key_usage").(string),
+		ExtKeyUsageOIDs:             data.Get("ext_key_usage_oids").(string),
+		PolicyIdentifiers:           data.Get("policy_identifiers").(string),
+		EmptyUsageBehavior:          data.Get("empty_usage_behavior").(string),
+		AppendRandomToCN:            data.Get("append_random_to_cn").(bool),
+		RandomCNLength:              data.Get("random_cn_length").(int),
+		PrivateKeyUsageNotBefore:    data.Get("private_key_usage_not_before").(string),
+		PrivateKeyUsageNotAfter:     data.Get("private_key_usage_not_after").(string),
+		NonceOID:                    data.Get("nonce_oid").(string),
+		ArchiveIssuedCertificates:   data.Get("archive_issued_certificates").(bool),
+		ProvenanceExtensionOID:      data.Get("provenance_extension_oid").(string),
+		ProvenanceExtensionTemplate: data.Get("provenance_extension_template").(string),
+		X509Version:                 data.Get("x509_version").(int),
+		UTF8Subject:                 data.Get("utf8_subject").(bool),
+		Organization:                data.Get("organization").(string),
+		OU:                          data.Get("ou").(string),
+		Country:                     data.Get("country").(string),
+		Locality:                    data.Get("locality").(string),
+		Province:                    data.Get("province").(string),
+		StreetAddress:               data.Get("street_address").(string),
+		PostalCode:                  data.Get("postal_code").(string),
+		BasicConstraintsCritical:    data.Get("basic_constraints_critical").(bool),
+		RequireOCSPStapling:         data.Get("require_ocsp_stapling").(bool),
+		SubjectKeyIDMethod:          data.Get("subject_key_id_method").(int),
+		KeyType:                     data.Get("key_type").(string),
+		KeyBits:                     data.Get("key_bits").(int),
+		SignatureBits:               data.Get("signature_bits").(int),
+		UsePSS:                      data.Get("use_pss").(bool),
+		SerialBits:                  data.Get("serial_bits").(int),
 	}
 
 	if len(entry.MaxTTL) == 0 {
@@ -266,11 +830,51 @@ func (b *backend) pathRoleCreate(
 			return logical.ErrorResponse(fmt.Sprintf(
 				"Invalid ttl: %s", err)), nil
 		}
+		if maxTTL <= 0 {
+			return logical.ErrorResponse("\"max_ttl\" must be greater than zero"), nil
+		}
 	}
 	if maxTTL > maxSystemTTL {
 		return logical.ErrorResponse("Requested max TTL is higher than backend maximum"), nil
 	}
 
+	if len(entry.MaxTTLGrace) != 0 {
+		grace, err := time.ParseDuration(entry.MaxTTLGrace)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf(
+				"Invalid max_ttl_grace: %s", err)), nil
+		}
+		if grace <= 0 {
+			return logical.ErrorResponse("\"max_ttl_grace\" must be greater than zero"), nil
+		}
+
+		// If the max TTL is being lowered, remember the previous one so
+		// that it can still be honored until the grace period ends
+		oldRole, err := b.getRole(req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if oldRole != nil {
+			oldMaxTTL := maxSystemTTL
+			if len(oldRole.MaxTTL) != 0 {
+				oldMaxTTL, err = time.ParseDuration(oldRole.MaxTTL)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid max_ttl in existing role: %s", err)
+				}
+			}
+			switch oldGraceMaxTTL := oldRole.graceMaxTTL(); {
+			case oldGraceMaxTTL > oldMaxTTL && oldGraceMaxTTL > maxTTL:
+				// A grace period that is still running is kept as it
+				// is, so that writing the role again doesn't extend it
+				entry.GraceMaxTTL = oldRole.GraceMaxTTL
+				entry.GraceExpiry = oldRole.GraceExpiry
+			case oldMaxTTL > maxTTL:
+				entry.GraceMaxTTL = oldMaxTTL.String()
+				entry.GraceExpiry = time.Now().Add(grace)
+			}
+		}
+	}
+
 	if len(entry.TTL) == 0 {
 		entry.TTL = data.Get("lease").(string)
 	}
@@ -281,6 +885,9 @@ func (b *backend) pathRoleCreate(
 			return logical.ErrorResponse(fmt.Sprintf(
 				"Invalid ttl: %s", err)), nil
 		}
+		if ttl <= 0 {
+			return logical.ErrorResponse("\"ttl\" must be greater than zero"), nil
+		}
 	}
 	if ttl > maxTTL {
 		// If they are using the system default, cap it to the role max;
@@ -292,6 +899,180 @@ func (b *backend) pathRoleCreate(
 		}
 	}
 
+	if len(entry.MinTTL) != 0 {
+		minTTL, err := time.ParseDuration(entry.MinTTL)
+		if err != nil || minTTL <= 0 {
+			return logical.ErrorResponse("\"min_ttl\" must be a duration greater than zero"), nil
+		}
+		if minTTL > maxTTL {
+			return logical.ErrorResponse("\"min_ttl\" value must be less than \"max_ttl\" and/or backend default max lease TTL value"), nil
+		}
+		if len(entry.TTL) != 0 && ttl < minTTL {
+			return logical.ErrorResponse("\"ttl\" value must be at least \"min_ttl\""), nil
+		}
+	}
+	if len(entry.NotBeforeDuration) == 0 {
+		entry.NotBeforeDuration = "30s"
+	}
+	notBeforeDuration, err := time.ParseDuration(entry.NotBeforeDuration)
+	if err != nil || notBeforeDuration < 0 {
+		return logical.ErrorResponse("\"not_before_duration\" must be a duration of zero or more"), nil
+	}
+	if entry.MaxTTLIncludesBackdate && notBeforeDuration >= maxTTL {
+		return logical.ErrorResponse("\"not_before_duration\" must be less than \"max_ttl\" when \"max_ttl_includes_backdate\" is set"), nil
+	}
+
+	switch entry.MinTTLBehavior {
+	case "":
+		entry.MinTTLBehavior = "reject"
+	case "reject", "bump":
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unknown min_ttl_behavior %s", entry.MinTTLBehavior)), nil
+	}
+
+	switch entry.EmptyUsageBehavior {
+	case "":
+		entry.EmptyUsageBehavior = "none"
+	case "none", "server_client":
+	case "reject":
+		if !entry.ServerFlag && !entry.ClientFlag && !entry.CodeSigningFlag && !entry.AnyExtKeyUsage && len(entry.ExtKeyUsageOIDs) == 0 {
+			return logical.ErrorResponse("At least one of server_flag, client_flag, code_signing_flag, any_ext_key_usage, or ext_key_usage_oids must be set, as empty_usage_behavior is \"reject\""), nil
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unknown empty_usage_behavior %s", entry.EmptyUsageBehavior)), nil
+	}
+
+	if len(entry.CAMinRemaining) != 0 {
+		if minRemaining, err := time.ParseDuration(entry.CAMinRemaining); err != nil || minRemaining <= 0 {
+			return logical.ErrorResponse("\"ca_min_remaining\" must be a duration greater than zero"), nil
+		}
+	}
+	switch entry.CAMinRemainingBehavior {
+	case "":
+		entry.CAMinRemainingBehavior = "reject"
+	case "reject", "warn":
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unknown ca_min_remaining_behavior %s", entry.CAMinRemainingBehavior)), nil
+	}
+
+	if entry.AllowGlobDomains {
+		for _, domain := range splitCommaList(entry.AllowedDomains) {
+			if _, err := path.Match(domain, ""); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("Invalid pattern %s in allowed_domains: %s", domain, err)), nil
+			}
+		}
+	}
+
+	if entry.MaxSANs < 0 {
+		return logical.ErrorResponse("\"max_sans\" must not be negative"), nil
+	}
+
+	if _, err := parseCIDRList(entry.AllowedIPRanges); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_ip_ranges: %s", err)), nil
+	}
+	if _, err := parseCIDRList(entry.AllowedResolutionCIDRs); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_resolution_cidrs: %s", err)), nil
+	}
+	if len(entry.DNSResolver) != 0 {
+		if _, _, err := net.SplitHostPort(entry.DNSResolver); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid dns_resolver: %s", err)), nil
+		}
+	}
+	if len(entry.DNSResolveTimeout) == 0 {
+		entry.DNSResolveTimeout = "5s"
+	}
+	if timeout, err := time.ParseDuration(entry.DNSResolveTimeout); err != nil || timeout <= 0 {
+		return logical.ErrorResponse("\"dns_resolve_timeout\" must be a duration greater than zero"), nil
+	}
+
+	if len(entry.ValidityTimezone) == 0 {
+		entry.ValidityTimezone = "UTC"
+	}
+	if _, err := time.LoadLocation(entry.ValidityTimezone); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid validity_timezone: %s", err)), nil
+	}
+
+	if entry.AppendRandomToCN && (entry.RandomCNLength < 1 || entry.RandomCNLength > 32) {
+		return logical.ErrorResponse("\"random_cn_length\" must be between 1 and 32"), nil
+	}
+
+	// The period can only be checked against the validity of each
+	// certificate, but make sure the values can be parsed
+	if _, err := parsePrivateKeyUsageTime(entry.PrivateKeyUsageNotBefore, time.Now()); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid private_key_usage_not_before: %s", err)), nil
+	}
+	if _, err := parsePrivateKeyUsageTime(entry.PrivateKeyUsageNotAfter, time.Now()); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid private_key_usage_not_after: %s", err)), nil
+	}
+
+	if _, err := parseKeyUsage(entry.KeyUsage); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid key_usage: %s", err)), nil
+	}
+
+	if _, err := parseOIDList(entry.ExtKeyUsageOIDs); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid ext_key_usage_oids: %s", err)), nil
+	}
+
+	if _, err := parseOIDList(entry.PolicyIdentifiers); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Invalid policy_identifiers: %s", err)), nil
+	}
+	for _, allowed := range splitCommaList(entry.AllowedOtherSANs) {
+		if allowed == "*" {
+			continue
+		}
+		if _, err := parseOtherSAN(allowed); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid allowed_other_sans: %s", err)), nil
+		}
+	}
+
+	if len(entry.NonceOID) != 0 {
+		if _, err := parseExtensionOID(entry.NonceOID); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid nonce_oid: %s", err)), nil
+		}
+	}
+
+	if len(entry.ProvenanceExtensionOID) != 0 {
+		if _, err := parseExtensionOID(entry.ProvenanceExtensionOID); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid provenance_extension_oid: %s", err)), nil
+		}
+		if len(entry.ProvenanceExtensionTemplate) == 0 {
+			return logical.ErrorResponse("\"provenance_extension_template\" must be set along with \"provenance_extension_oid\""), nil
+		}
+		if _, err := parseProvenanceTemplate(entry.ProvenanceExtensionTemplate); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("Invalid provenance_extension_template: %s", err)), nil
+		}
+	} else if len(entry.ProvenanceExtensionTemplate) != 0 {
+		return logical.ErrorResponse("\"provenance_extension_oid\" must be set along with \"provenance_extension_template\""), nil
+	}
+
+	switch entry.X509Version {
+	case 0:
+		entry.X509Version = 3
+	case 3:
+	case 1:
+		// Anything that would need an extension has to be off
+		switch {
+		case entry.ServerFlag, entry.ClientFlag, entry.CodeSigningFlag, entry.AnyExtKeyUsage, entry.EmptyUsageBehavior == "server_client", len(entry.KeyUsage) != 0, len(entry.ExtKeyUsageOIDs) != 0:
+			return logical.ErrorResponse("Version 1 certificates cannot carry usages; server_flag, client_flag, code_signing_flag, and any_ext_key_usage must be false, and key_usage and ext_key_usage_oids empty"), nil
+		case len(entry.PrivateKeyUsageNotBefore) != 0, len(entry.PrivateKeyUsageNotAfter) != 0, len(entry.NonceOID) != 0, len(entry.ProvenanceExtensionOID) != 0, len(entry.PolicyIdentifiers) != 0, entry.RequireOCSPStapling:
+			return logical.ErrorResponse("Version 1 certificates cannot carry extensions such as a private key usage period, nonce, provenance, certificate policies, or OCSP Must-Staple"), nil
+		case !entry.RequireCN:
+			return logical.ErrorResponse("Version 1 certificates carry their name only in the common name; require_cn must be true"), nil
+		case entry.UsePSS:
+			return logical.ErrorResponse("Version 1 certificates cannot be signed with RSA-PSS; use_pss must be false"), nil
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported x509_version %d; must be 1 or 3", entry.X509Version)), nil
+	}
+
+	switch entry.SubjectKeyIDMethod {
+	case 0:
+		entry.SubjectKeyIDMethod = 1
+	case 1, 2:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported subject_key_id_method %d; must be 1 or 2", entry.SubjectKeyIDMethod)), nil
+	}
+
 	if len(entry.KeyType) == 0 {
 		entry.KeyType = "rsa"
 	}
@@ -301,6 +1082,11 @@ func (b *backend) pathRoleCreate(
 
 	switch entry.KeyType {
 	case "rsa":
+	case "ed25519":
+		if keyBits, ok := data.GetOk("key_bits"); ok && keyBits.(int) != 0 {
+			return logical.ErrorResponse(fmt.Sprintf("Ed25519 keys have a fixed size; key_bits must not be set, but was %d", keyBits.(int))), nil
+		}
+		entry.KeyBits = 0
 	case "ec":
 		switch entry.KeyBits {
 		case 224:
@@ -314,6 +1100,31 @@ func (b *backend) pathRoleCreate(
 		return logical.ErrorResponse(fmt.Sprintf("Unknown key type %s", entry.KeyType)), nil
 	}
 
+	fipsEnabled, err := b.fipsEnabled(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if fipsEnabled {
+		if err := checkFIPSKey(entry.KeyType, entry.KeyBits); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	switch entry.SignatureBits {
+	case 0, 256, 384, 512:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported signature_bits %d; must be 256, 384, or 512", entry.SignatureBits)), nil
+	}
+
+	// At least 64 bits of entropy are required by the CA/Browser Forum
+	// baseline requirements, and serial numbers may be at most 20 octets
+	if entry.SerialBits == 0 {
+		entry.SerialBits = defaultSerialBits
+	}
+	if entry.SerialBits < 64 || entry.SerialBits > defaultSerialBits {
+		return logical.ErrorResponse(fmt.Sprintf("Unsupported serial_bits %d; must be between 64 and %d", entry.SerialBits, defaultSerialBits)), nil
+	}
+
 	// Store it
 	jsonEntry, err := logical.StorageEntryJSON("role/"+name, entry)
 	if err != nil {
@@ -323,26 +1134,116 @@ func (b *backend) pathRoleCreate(
 		return nil, err
 	}
 
+	if entry.AnyExtKeyUsage {
+		resp := &logical.Response{}
+		resp.AddWarning("any_ext_key_usage makes certificates issued against this role valid for any purpose, including ones the relying party did not intend; prefer the specific usage flags where possible")
+		return resp, nil
+	}
+
 	return nil, nil
 }
 
 type roleEntry struct {
-	LeaseMax              string `json:"lease_max" structs:"lease_max" mapstructure:"lease_max"`
-	Lease                 string `json:"lease" structs:"lease" mapstructure:"lease"`
-	MaxTTL                string `json:"max_ttl" structs:"max_ttl" mapstructure:"max_ttl"`
-	TTL                   string `json:"ttl" structs:"ttl" mapstructure:"ttl"`
-	AllowLocalhost        bool   `json:"allow_localhost" structs:"allow_localhost" mapstructure:"allow_localhost"`
-	AllowedBaseDomain     string `json:"allowed_base_domain" structs:"allowed_base_domain" mapstructure:"allowed_base_domain"`
-	AllowTokenDisplayName bool   `json:"allow_token_displayname" structs:"allow_token_displayname" mapstructure:"allow_token_displayname"`
-	AllowSubdomains       bool   `json:"allow_subdomains" structs:"allow_subdomains" mapstructure:"allow_subdomains"`
-	AllowAnyName          bool   `json:"allow_any_name" structs:"allow_any_name" mapstructure:"allow_any_name"`
-	EnforceHostnames      bool   `json:"enforce_hostnames" structs:"enforce_hostnames" mapstructure:"enforce_hostnames"`
-	AllowIPSANs           bool   `json:"allow_ip_sans" structs:"allow_ip_sans" mapstructure:"allow_ip_sans"`
-	ServerFlag            bool   `json:"server_flag" structs:"server_flag" mapstructure:"server_flag"`
-	ClientFlag            bool   `json:"client_flag" structs:"client_flag" mapstructure:"client_flag"`
-	CodeSigningFlag       bool   `json:"code_signing_flag" structs:"code_signing_flag" mapstructure:"code_signing_flag"`
-	KeyType               string `json:"key_type" structs:"key_type" mapstructure:"key_type"`
-	KeyBits               int    `json:"key_bits" structs:"key_bits" mapstructure:"key_bits"`
+	LeaseMax                    string    `json:"lease_max" structs:"lease_max" mapstructure:"lease_max"`
+	Lease                       string    `json:"lease" structs:"lease" mapstructure:"lease"`
+	MaxTTL                      string    `json:"max_ttl" structs:"max_ttl" mapstructure:"max_ttl"`
+	TTL                         string    `json:"ttl" structs:"ttl" mapstructure:"ttl"`
+	MinTTL                      string    `json:"min_ttl" structs:"min_ttl" mapstructure:"min_ttl"`
+	MinTTLBehavior              string    `json:"min_ttl_behavior" structs:"min_ttl_behavior" mapstructure:"min_ttl_behavior"`
+	NotBeforeDuration           string    `json:"not_before_duration" structs:"not_before_duration" mapstructure:"not_before_duration"`
+	MaxTTLIncludesBackdate      bool      `json:"max_ttl_includes_backdate" structs:"max_ttl_includes_backdate" mapstructure:"max_ttl_includes_backdate"`
+	MaxTTLGrace                 string    `json:"max_ttl_grace" structs:"max_ttl_grace" mapstructure:"max_ttl_grace"`
+	GraceMaxTTL                 string    `json:"grace_max_ttl" structs:"grace_max_ttl" mapstructure:"grace_max_ttl"`
+	GraceExpiry                 time.Time `json:"grace_expiry" structs:"grace_expiry,omitnested" mapstructure:"grace_expiry"`
+	AlignValidityToDay          bool      `json:"align_validity_to_day" structs:"align_validity_to_day" mapstructure:"align_validity_to_day"`
+	ValidityTimezone            string    `json:"validity_timezone" structs:"validity_timezone" mapstructure:"validity_timezone"`
+	CAMinRemaining              string    `json:"ca_min_remaining" structs:"ca_min_remaining" mapstructure:"ca_min_remaining"`
+	CAMinRemainingBehavior      string    `json:"ca_min_remaining_behavior" structs:"ca_min_remaining_behavior" mapstructure:"ca_min_remaining_behavior"`
+	AllowLocalhost              bool      `json:"allow_localhost" structs:"allow_localhost" mapstructure:"allow_localhost"`
+	AllowedBaseDomain           string    `json:"allowed_base_domain" structs:"allowed_base_domain" mapstructure:"allowed_base_domain"`
+	AllowedDomains              string    `json:"allowed_domains" structs:"allowed_domains" mapstructure:"allowed_domains"`
+	AllowGlobDomains            bool      `json:"allow_glob_domains" structs:"allow_glob_domains" mapstructure:"allow_glob_domains"`
+	AllowTokenDisplayName       bool      `json:"allow_token_displayname" structs:"allow_token_displayname" mapstructure:"allow_token_displayname"`
+	AllowSubdomains             bool      `json:"allow_subdomains" structs:"allow_subdomains" mapstructure:"allow_subdomains"`
+	AllowBareDomains            bool      `json:"allow_bare_domains" structs:"allow_bare_domains" mapstructure:"allow_bare_domains"`
+	AllowAnyName                bool      `json:"allow_any_name" structs:"allow_any_name" mapstructure:"allow_any_name"`
+	EnforceHostnames            bool      `json:"enforce_hostnames" structs:"enforce_hostnames" mapstructure:"enforce_hostnames"`
+	AllowWildcardCertificates   bool      `json:"allow_wildcard_certificates" structs:"allow_wildcard_certificates" mapstructure:"allow_wildcard_certificates"`
+	AllowSingleLabelDomains     bool      `json:"allow_single_label_domains" structs:"allow_single_label_domains" mapstructure:"allow_single_label_domains"`
+	RequireCN                   bool      `json:"require_cn" structs:"require_cn" mapstructure:"require_cn"`
+	ExcludeCNFromSANs           bool      `json:"exclude_cn_from_sans" structs:"exclude_cn_from_sans" mapstructure:"exclude_cn_from_sans"`
+	DropDisallowedSANs          bool      `json:"drop_disallowed_sans" structs:"drop_disallowed_sans" mapstructure:"drop_disallowed_sans"`
+	PreserveTrailingDot         bool      `json:"preserve_trailing_dot" structs:"preserve_trailing_dot" mapstructure:"preserve_trailing_dot"`
+	AllowIPSANs                 bool      `json:"allow_ip_sans" structs:"allow_ip_sans" mapstructure:"allow_ip_sans"`
+	AllowURISANs                bool      `json:"allow_uri_sans" structs:"allow_uri_sans" mapstructure:"allow_uri_sans"`
+	AllowedIPRanges             string    `json:"allowed_ip_ranges" structs:"allowed_ip_ranges" mapstructure:"allowed_ip_ranges"`
+	MaxSANs                     int       `json:"max_sans" structs:"max_sans" mapstructure:"max_sans"`
+	AllowedURISANs              string    `json:"allowed_uri_sans" structs:"allowed_uri_sans" mapstructure:"allowed_uri_sans"`
+	AllowedOtherSANs            string    `json:"allowed_other_sans" structs:"allowed_other_sans" mapstructure:"allowed_other_sans"`
+	AllowedResolutionCIDRs      string    `json:"allowed_resolution_cidrs" structs:"allowed_resolution_cidrs" mapstructure:"allowed_resolution_cidrs"`
+	DNSResolver                 string    `json:"dns_resolver" structs:"dns_resolver" mapstructure:"dns_resolver"`
+	DNSResolveTimeout           string    `json:"dns_resolve_timeout" structs:"dns_resolve_timeout" mapstructure:"dns_resolve_timeout"`
+	ServerFlag                  bool      `json:"server_flag" structs:"server_flag" mapstructure:"server_flag"`
+	ClientFlag                  bool      `json:"client_flag" structs:"client_flag" mapstructure:"client_flag"`
+	CodeSigningFlag             bool      `json:"code_signing_flag" structs:"code_signing_flag" mapstructure:"code_signing_flag"`
+	AnyExtKeyUsage              bool      `json:"any_ext_key_usage" structs:"any_ext_key_usage" mapstructure:"any_ext_key_usage"`
+	KeyUsage                    string    `json:"key_usage" structs:"key_usage" mapstructure:"key_usage"`
+	ExtKeyUsageOIDs             string    `json:"ext_key_usage_oids" structs:"ext_key_usage_oids" mapstructure:"ext_key_usage_oids"`
+	PolicyIdentifiers           string    `json:"policy_identifiers" structs:"policy_identifiers" mapstructure:"policy_identifiers"`
+	EmptyUsageBehavior          string    `json:"empty_usage_behavior" structs:"empty_usage_behavior" mapstructure:"empty_usage_behavior"`
+	AppendRandomToCN            bool      `json:"append_random_to_cn" structs:"append_random_to_cn" mapstructure:"append_random_to_cn"`
+	RandomCNLength              int       `json:"random_cn_length" structs:"random_cn_length" mapstructure:"random_cn_length"`
+	PrivateKeyUsageNotBefore    string    `json:"private_key_usage_not_before" structs:"private_key_usage_not_before" mapstructure:"private_key_usage_not_before"`
+	PrivateKeyUsageNotAfter     string    `json:"private_key_usage_not_after" structs:"private_key_usage_not_after" mapstructure:"private_key_usage_not_after"`
+	NonceOID                    string    `json:"nonce_oid" structs:"nonce_oid" mapstructure:"nonce_oid"`
+	ArchiveIssuedCertificates   bool      `json:"archive_issued_certificates" structs:"archive_issued_certificates" mapstructure:"archive_issued_certificates"`
+	ProvenanceExtensionOID      string    `json:"provenance_extension_oid" structs:"provenance_extension_oid" mapstructure:"provenance_extension_oid"`
+	ProvenanceExtensionTemplate string    `json:"provenance_extension_template" structs:"provenance_extension_template" mapstructure:"provenance_extension_template"`
+	X509Version                 int       `json:"x509_version" structs:"x509_version" mapstructure:"x509_version"`
+	UTF8Subject                 bool      `json:"utf8_subject" structs:"utf8_subject" mapstructure:"utf8_subject"`
+	Organization                string    `json:"organization" structs:"organization" mapstructure:"organization"`
+	OU                          string    `json:"ou" structs:"ou" mapstructure:"ou"`
+	Country                     string    `json:"country" structs:"country" mapstructure:"country"`
+	Locality                    string    `json:"locality" structs:"locality" mapstructure:"locality"`
+	Province                    string    `json:"province" structs:"province" mapstructure:"province"`
+	StreetAddress               string    `json:"street_address" structs:"street_address" mapstructure:"street_address"`
+	PostalCode                  string    `json:"postal_code" structs:"postal_code" mapstructure:"postal_code"`
+	BasicConstraintsCritical    bool      `json:"basic_constraints_critical" structs:"basic_constraints_critical" mapstructure:"basic_constraints_critical"`
+	RequireOCSPStapling         bool      `json:"require_ocsp_stapling" structs:"require_ocsp_stapling" mapstructure:"require_ocsp_stapling"`
+	SubjectKeyIDMethod          int       `json:"subject_key_id_method" structs:"subject_key_id_method" mapstructure:"subject_key_id_method"`
+	KeyType                     string    `json:"key_type" structs:"key_type" mapstructure:"key_type"`
+	KeyBits                     int       `json:"key_bits" structs:"key_bits" mapstructure:"key_bits"`
+	SignatureBits               int       `json:"signature_bits" structs:"signature_bits" mapstructure:"signature_bits"`
+	UsePSS                      bool      `json:"use_pss" structs:"use_pss" mapstructure:"use_pss"`
+	SerialBits                  int       `json:"serial_bits" structs:"serial_bits" mapstructure:"serial_bits"`
+}
+
+// Returns the subject attributes set on the role, which replace those of
+// the CA in issued certificates. A value repeated in a list, which
+// attribute matching would not tell apart, only appears once.
+func (r *roleEntry) subjectAttributes() pkix.Name {
+	return pkix.Name{
+		Organization:       dedupeNames(splitCommaList(r.Organization)),
+		OrganizationalUnit: dedupeNames(splitCommaList(r.OU)),
+		Country:            dedupeNames(splitCommaList(r.Country)),
+		Locality:           dedupeNames(splitCommaList(r.Locality)),
+		Province:           dedupeNames(splitCommaList(r.Province)),
+		StreetAddress:      dedupeNames(splitCommaList(r.StreetAddress)),
+		PostalCode:         dedupeNames(splitCommaList(r.PostalCode)),
+	}
+}
+
+// Returns the previous max TTL of the role if it is still within the grace
+// period following a change, or zero otherwise
+func (r *roleEntry) graceMaxTTL() time.Duration {
+	if len(r.GraceMaxTTL) == 0 || time.Now().After(r.GraceExpiry) {
+		return 0
+	}
+	graceMaxTTL, err := time.ParseDuration(r.GraceMaxTTL)
+	if err != nil {
+		return 0
+	}
+	return graceMaxTTL
 }
 
 const pathRoleHelpSyn = `
@@ -0,0 +1,150 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func pathSignSelfIssued(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "root/sign-self-issued",
+		Fields: map[string]*framework.FieldSchema{
+			"certificate": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `PEM-format self-issued CA certificate to sign`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.WriteOperation: b.pathSignSelfIssuedWrite,
+		},
+
+		HelpSynopsis:    pathSignSelfIssuedHelpSyn,
+		HelpDescription: pathSignSelfIssuedHelpDesc,
+	}
+}
+
+func (b *backend) pathSignSelfIssuedWrite(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	certs := parsePEMCertificates(data.Get("certificate").(string))
+	if len(certs) != 1 {
+		return userErrorResponse(fmt.Sprintf("Exactly one certificate must be given, but %d were found", len(certs)))
+	}
+	cert := certs[0]
+
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return userErrorResponse("The given certificate is not a CA certificate")
+	}
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return userErrorResponse("The given certificate is not self-issued")
+	}
+	// The self-signature proves that the caller holds the private key, so
+	// that no one can have this CA vouch for a key they don't control
+	if err := cert.CheckSignatureFrom(cert); err != nil {
+		return userErrorResponse(fmt.Sprintf("The given certificate is not signed with its own key: %s", err))
+	}
+
+	signingBundle, caErr := fetchCAInfo(req)
+	switch caErr.(type) {
+	case certutil.UserError:
+		return userErrorResponse(fmt.Sprintf("Could not fetch the CA certificate: %s", caErr))
+	case certutil.InternalError:
+		return nil, fmt.Errorf("Error fetching CA certificate: %s", caErr)
+	}
+
+	fipsEnabled, err := b.fipsEnabled(req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if fipsEnabled {
+		if err := checkFIPSCAKey(signingBundle.Certificate.PublicKey); err != nil {
+			return certErrorResponse(err)
+		}
+		if err := checkFIPSPublicKey(cert.PublicKey); err != nil {
+			return userErrorResponse(fmt.Sprintf("The key of the given certificate is not allowed in FIPS mode: %s", err))
+		}
+	}
+
+	sigAlg, err := signatureAlgorithm(signingBundle.PrivateKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// The serial number is replaced, as the one the other CA chose may
+	// already be in use here; everything else is kept, including the
+	// subject, subject key ID, and basic constraints, so that the result
+	// chains to this CA in place of the original
+	serialNumber, err := generateSerialNumber(req.Storage, defaultSerialBits)
+	if err != nil {
+		return nil, err
+	}
+	template := *cert
+	template.SerialNumber = serialNumber
+	template.SignatureAlgorithm = sigAlg
+	template.AuthorityKeyId = nil
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, signingBundle.Certificate, cert.PublicKey, signingBundle.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to sign certificate: %s", err)
+	}
+
+	signedCert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse signed certificate: %s", err)
+	}
+
+	serial := certutil.GetOctalFormatted(serialNumber.Bytes(), ":")
+	if err := storeIssuedCert(req.Storage, serial, certBytes); err != nil {
+		return nil, fmt.Errorf("Unable to store certificate locally: %s", err)
+	}
+
+	// Cross-signed CAs are published to the issuance log like any other
+	// certificate, with no role
+	if err := logIssuance(b, req, signedCert, ""); err != nil {
+		discardIssuedCert(b, req.Storage, serial)
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"certificate": string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: certBytes,
+			})),
+			"issuing_ca": string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: signingBundle.CertificateBytes,
+			})),
+			"serial_number": serial,
+		},
+	}
+	if cert.NotAfter.After(signingBundle.Certificate.NotAfter) {
+		resp.AddWarning(fmt.Sprintf("The signed certificate is valid until %s, after this CA expires", cert.NotAfter.Format("2006-01-02")))
+	}
+	return resp, nil
+}
+
+const pathSignSelfIssuedHelpSyn = `
+Cross-sign another self-issued CA certificate with this CA.
+`
+
+const pathSignSelfIssuedHelpDesc = `
+This signs a self-issued CA certificate, such as another root, with this
+CA's key, so that clients trusting this CA can also verify certificates
+issued by the other one; this allows a root to be rotated without
+distributing the new root first. The certificate must be signed with its
+own key, and in FIPS mode that key must be FIPS-approved.
+
+The subject, public key, subject key ID, validity, and basic constraints
+of the given certificate are kept; only the serial number, issuer, and
+signature are replaced. The signed certificate is stored, so it can be
+revoked like any other, and published to the issuance log, if one is
+configured. A root token is required.
+`
@@ -0,0 +1,138 @@
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_signSelfIssued(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	signSelfIssued := func(certPEM string) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "root/sign-self-issued",
+			Storage:   storage,
+			Data: map[string]interface{}{
+				"certificate": certPEM,
+			},
+		})
+		if err != nil {
+			t.Fatalf("bad: err: %v", err)
+		}
+		return resp
+	}
+
+	signingBundle, err := fetchCAInfo(&logical.Request{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherPEM := generateTestCA(t, "Vault Testing CA 2")
+	other := parsePEMCertificates(otherPEM)[0]
+	resp := signSelfIssued(otherPEM)
+	if isErrorResponse(resp) {
+		t.Fatalf("bad: %#v", resp)
+	}
+	crossPEM := resp.Data["certificate"].(string)
+	cross := parseIssuedCert(t, resp)
+	if !bytes.Equal(cross.RawSubject, other.RawSubject) || !bytes.Equal(cross.SubjectKeyId, other.SubjectKeyId) {
+		t.Fatalf("expected the subject and subject key ID to be kept")
+	}
+	if !cross.BasicConstraintsValid || !cross.IsCA {
+		t.Fatalf("expected the basic constraints to be kept")
+	}
+	if cross.SerialNumber.Cmp(other.SerialNumber) == 0 {
+		t.Fatalf("expected a new serial number")
+	}
+	if err := cross.CheckSignatureFrom(signingBundle.Certificate); err != nil {
+		t.Fatalf("bad signature: %s", err)
+	}
+	if entry, err := storage.Get("certs/" + resp.Data["serial_number"].(string)); err != nil || entry == nil {
+		t.Fatalf("expected the signed certificate to be stored: %v", err)
+	}
+
+	// Only self-issued CA certificates are signed
+	_, issued := issueWithRole(t, b, storage, map[string]interface{}{
+		"allow_any_name": true,
+	}, map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	if resp := signSelfIssued(issued.Data["certificate"].(string)); !isErrorResponse(resp) {
+		t.Fatalf("expected a leaf certificate to be refused")
+	}
+	if resp := signSelfIssued(crossPEM); !isErrorResponse(resp) {
+		t.Fatalf("expected a certificate with another issuer to be refused")
+	}
+	if resp := signSelfIssued(otherPEM + otherPEM); !isErrorResponse(resp) {
+		t.Fatalf("expected more than one certificate to be refused")
+	}
+
+	// Creates a self-issued CA certificate for the given public key,
+	// signed with the given private key
+	selfIssued := func(pub crypto.PublicKey, signer crypto.Signer) string {
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Vault Testing CA 3"},
+			NotBefore:             time.Now().Add(-time.Minute),
+			NotAfter:              time.Now().Add(24 * time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		certBytes, err := x509.CreateCertificate(rand.Reader, template, template, pub, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}))
+	}
+
+	// A certificate not signed with its own key proves nothing about who
+	// holds that key
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = signSelfIssued(selfIssued(key.Public(), otherKey))
+	if msg := userErrorMessage(resp); !strings.Contains(msg, "not signed with its own key") {
+		t.Fatalf("expected a certificate with a bad self-signature to be refused, got: %#v", resp)
+	}
+
+	// In FIPS mode, the key of the given certificate must be allowed
+	if _, err := b.HandleRequest(&logical.Request{
+		Operation: logical.WriteOperation,
+		Path:      "config/fips",
+		Storage:   storage,
+		Data: map[string]interface{}{
+			"enabled": true,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = signSelfIssued(selfIssued(weakKey.Public(), weakKey))
+	if msg := userErrorMessage(resp); !strings.Contains(msg, "key_bits of 1024") {
+		t.Fatalf("expected a 1024-bit key to be refused in FIPS mode, got: %#v", resp)
+	}
+	if resp := signSelfIssued(selfIssued(key.Public(), key)); isErrorResponse(resp) {
+		t.Fatalf("bad: %#v", resp)
+	}
+}
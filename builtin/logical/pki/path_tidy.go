@@ -0,0 +1,241 @@
+package pki
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// The state of the most recent tidy operation, kept in memory so that it
+// can be read back while and after the sweep runs in the background
+type tidyStatus struct {
+	State                   string `json:"state" structs:"state" mapstructure:"state"`
+	Error                   string `json:"error" structs:"error" mapstructure:"error"`
+	SafetyBuffer            string `json:"safety_buffer" structs:"safety_buffer" mapstructure:"safety_buffer"`
+	TidyCertStore           bool   `json:"tidy_cert_store" structs:"tidy_cert_store" mapstructure:"tidy_cert_store"`
+	TidyRevokedCerts        bool   `json:"tidy_revoked_certs" structs:"tidy_revoked_certs" mapstructure:"tidy_revoked_certs"`
+	TimeStarted             int64  `json:"time_started" structs:"time_started" mapstructure:"time_started"`
+	TimeFinished            int64  `json:"time_finished" structs:"time_finished" mapstructure:"time_finished"`
+	CertStoreDeletedCount   int    `json:"cert_store_deleted_count" structs:"cert_store_deleted_count" mapstructure:"cert_store_deleted_count"`
+	RevokedCertDeletedCount int    `json:"revoked_cert_deleted_count" structs:"revoked_cert_deleted_count" mapstructure:"revoked_cert_deleted_count"`
+}
+
+func pathTidy(b *backend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy",
+		Fields: map[string]*framework.FieldSchema{
+			"tidy_cert_store": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, expired certificates are removed from
+the certificate store; defaults to false`,
+				Default: false,
+			},
+			"tidy_revoked_certs": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, expired certificates are removed from
+the list of revoked certificates, and so from the
+CRL; defaults to false`,
+				Default: false,
+			},
+			"safety_buffer": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `How long after a certificate expires it is kept
+before being removed, to allow for clock skew;
+defaults to 72 hours`,
+				Default: "72h",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:  b.pathTidyRead,
+			logical.WriteOperation: b.pathTidyWrite,
+		},
+
+		HelpSynopsis:    pathTidyHelpSyn,
+		HelpDescription: pathTidyHelpDesc,
+	}
+}
+
+func (b *backend) pathTidyRead(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.tidyStatusLock.Lock()
+	defer b.tidyStatusLock.Unlock()
+
+	if b.tidyStatus == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: structs.New(b.tidyStatus).Map(),
+	}, nil
+}
+
+func (b *backend) pathTidyWrite(
+	req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	safetyBuffer := data.Get("safety_buffer").(string)
+	bufferDur, err := time.ParseDuration(safetyBuffer)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("Given safety_buffer could not be decoded: %s", err)), nil
+	}
+	if bufferDur < 0 {
+		return logical.ErrorResponse(fmt.Sprintf("The safety_buffer must not be negative, but was given %s", safetyBuffer)), nil
+	}
+
+	status := &tidyStatus{
+		State:            "running",
+		SafetyBuffer:     safetyBuffer,
+		TidyCertStore:    data.Get("tidy_cert_store").(bool),
+		TidyRevokedCerts: data.Get("tidy_revoked_certs").(bool),
+		TimeStarted:      time.Now().Unix(),
+	}
+	if !status.TidyCertStore && !status.TidyRevokedCerts {
+		return logical.ErrorResponse("At least one of tidy_cert_store or tidy_revoked_certs must be set"), nil
+	}
+
+	b.tidyStatusLock.Lock()
+	if b.tidyStatus != nil && b.tidyStatus.State == "running" {
+		b.tidyStatusLock.Unlock()
+		return logical.ErrorResponse("A tidy operation is already running"), nil
+	}
+	b.tidyStatus = status
+	b.tidyStatusLock.Unlock()
+
+	// The sweep can take a while with many certificates, so it outlives
+	// the request; only the storage is used from it
+	tidyReq := &logical.Request{Storage: req.Storage}
+	go func() {
+		err := b.tidy(tidyReq, status, bufferDur)
+
+		b.tidyStatusLock.Lock()
+		defer b.tidyStatusLock.Unlock()
+		status.TimeFinished = time.Now().Unix()
+		if err != nil {
+			status.State = "error"
+			status.Error = err.Error()
+			b.Logger().Printf("[ERR] pki: tidy failed: %s", err)
+			return
+		}
+		status.State = "finished"
+		b.Logger().Printf("[INFO] pki: tidy removed %d expired certificates and %d expired revoked certificates",
+			status.CertStoreDeletedCount, status.RevokedCertDeletedCount)
+	}()
+
+	resp := &logical.Response{}
+	resp.AddWarning(`Tidying is running in the background; read "tidy" for its progress`)
+	return resp, nil
+}
+
+// Removes certificates that expired more than the safety buffer ago from
+// the certificate store and the list of revoked certificates, as asked by
+// the status, counting them in it as it goes. The CRL is rebuilt if any
+// revoked certificates were removed.
+func (b *backend) tidy(req *logical.Request, status *tidyStatus, safetyBuffer time.Duration) error {
+	cutoff := time.Now().Add(-safetyBuffer)
+
+	if status.TidyCertStore {
+		serials, err := req.Storage.List("certs/")
+		if err != nil {
+			return fmt.Errorf("Error fetching list of certs: %s", err)
+		}
+		for _, serial := range serials {
+			entry, err := req.Storage.Get("certs/" + serial)
+			if err != nil {
+				return fmt.Errorf("Error fetching certificate %s: %s", serial, err)
+			}
+			// Revoked in the meantime
+			if entry == nil {
+				continue
+			}
+
+			cert, err := x509.ParseCertificate(entry.Value)
+			if err != nil {
+				return fmt.Errorf("Unable to parse stored certificate with serial %s: %s", serial, err)
+			}
+			if !cert.NotAfter.Before(cutoff) {
+				continue
+			}
+
+			if err := req.Storage.Delete("certs/" + serial); err != nil {
+				return fmt.Errorf("Error deleting certificate %s: %s", serial, err)
+			}
+			if err := req.Storage.Delete("cert_metadata/" + serial); err != nil {
+				return fmt.Errorf("Error deleting metadata of certificate %s: %s", serial, err)
+			}
+			b.tidyStatusLock.Lock()
+			status.CertStoreDeletedCount++
+			b.tidyStatusLock.Unlock()
+		}
+	}
+
+	if status.TidyRevokedCerts {
+		b.revokeStorageLock.Lock()
+		defer b.revokeStorageLock.Unlock()
+
+		serials, err := req.Storage.List("revoked/")
+		if err != nil {
+			return fmt.Errorf("Error fetching list of revoked certs: %s", err)
+		}
+		deleted := false
+		for _, serial := range serials {
+			entry, err := req.Storage.Get("revoked/" + serial)
+			if err != nil {
+				return fmt.Errorf("Unable to fetch revoked cert with serial %s: %s", serial, err)
+			}
+			if entry == nil {
+				continue
+			}
+
+			var revInfo revocationInfo
+			if err := entry.DecodeJSON(&revInfo); err != nil {
+				return fmt.Errorf("Error decoding revocation entry for serial %s: %s", serial, err)
+			}
+			cert, err := x509.ParseCertificate(revInfo.CertificateBytes)
+			if err != nil {
+				return fmt.Errorf("Unable to parse stored revoked certificate with serial %s: %s", serial, err)
+			}
+			if !cert.NotAfter.Before(cutoff) {
+				continue
+			}
+
+			if err := req.Storage.Delete("revoked/" + serial); err != nil {
+				return fmt.Errorf("Error deleting revoked certificate %s: %s", serial, err)
+			}
+			if err := req.Storage.Delete("cert_metadata/" + serial); err != nil {
+				return fmt.Errorf("Error deleting metadata of certificate %s: %s", serial, err)
+			}
+			deleted = true
+			b.tidyStatusLock.Lock()
+			status.RevokedCertDeletedCount++
+			b.tidyStatusLock.Unlock()
+		}
+
+		if deleted {
+			if err := buildCRL(b, req); err != nil {
+				return fmt.Errorf("Error rebuilding the CRL: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+const pathTidyHelpSyn = `
+Remove expired certificates from storage.
+`
+
+const pathTidyHelpDesc = `
+Issued and revoked certificates are kept in storage until they are
+removed here. Writing to this endpoint starts removing those that expired
+more than "safety_buffer" ago: from the certificate store if
+"tidy_cert_store" is set, and from the list of revoked certificates, and
+so the CRL, if "tidy_revoked_certs" is set. The CRL is rebuilt once any
+revoked certificates have been removed.
+
+This runs in the background. Reading this endpoint returns the state of
+the most recent run and how many certificates it has removed. A root
+token is required.
+`
@@ -0,0 +1,146 @@
+package pki
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_tidy(t *testing.T) {
+	b, storage := createBackendWithCA(t)
+
+	request := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: op,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bad: %s %s: resp: %#v, err: %v", op, path, resp, err)
+		}
+		return resp
+	}
+	tidy := func(data map[string]interface{}) map[string]interface{} {
+		request(logical.WriteOperation, "tidy", data)
+		for i := 0; i < 100; i++ {
+			resp := request(logical.ReadOperation, "tidy", nil)
+			if resp.Data["state"] != "running" {
+				return resp.Data
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("tidy did not finish")
+		return nil
+	}
+
+	signingBundle, err := fetchCAInfo(&logical.Request{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stores a certificate that expired the given time ago, as issued or
+	// as revoked
+	store := func(prefix string, expiredFor time.Duration) string {
+		parsedBundle, err := createCertificate(&certCreationBundle{
+			SigningBundle: signingBundle,
+			CACert:        signingBundle.Certificate,
+			CommonNames:   []string{"expired.example.com"},
+			KeyType:       "rsa",
+			KeyBits:       2048,
+			TTL:           -expiredFor,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial := certutil.GetOctalFormatted(parsedBundle.Certificate.SerialNumber.Bytes(), ":")
+		entry := &logical.StorageEntry{
+			Key:   prefix + serial,
+			Value: parsedBundle.CertificateBytes,
+		}
+		if prefix == "revoked/" {
+			entry, err = logical.StorageEntryJSON(prefix+serial, revocationInfo{
+				CertificateBytes: parsedBundle.CertificateBytes,
+				RevocationTime:   time.Now().Add(-expiredFor - time.Hour).Unix(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := storage.Put(entry); err != nil {
+			t.Fatal(err)
+		}
+		return serial
+	}
+	exists := func(key string) bool {
+		entry, err := storage.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entry != nil
+	}
+
+	request(logical.WriteOperation, "roles/test", map[string]interface{}{
+		"allow_any_name": true,
+	})
+	valid := parseIssuedCert(t, request(logical.WriteOperation, "issue/test", map[string]interface{}{
+		"common_name": "valid.example.com",
+	}))
+	validSerial := certutil.GetOctalFormatted(valid.SerialNumber.Bytes(), ":")
+	oldCert := store("certs/", 100*time.Hour)
+	recentCert := store("certs/", time.Hour)
+	oldRevoked := store("revoked/", 100*time.Hour)
+	recentRevoked := store("revoked/", time.Hour)
+
+	if resp := request(logical.ReadOperation, "tidy", nil); resp != nil {
+		t.Fatalf("expected no status before tidying, got %#v", resp)
+	}
+
+	// Only the certificate store
+	status := tidy(map[string]interface{}{
+		"tidy_cert_store": true,
+	})
+	if status["state"] != "finished" || status["cert_store_deleted_count"] != 1 || status["revoked_cert_deleted_count"] != 0 {
+		t.Fatalf("bad status: %#v", status)
+	}
+	if exists("certs/"+oldCert) || !exists("certs/"+recentCert) || !exists("certs/"+validSerial) || !exists("revoked/"+oldRevoked) {
+		t.Fatalf("bad storage after tidying the certificate store")
+	}
+
+	// Revoked certificates, which are removed from the CRL too
+	status = tidy(map[string]interface{}{
+		"tidy_revoked_certs": true,
+		"safety_buffer":      "30m",
+	})
+	if status["state"] != "finished" || status["cert_store_deleted_count"] != 0 || status["revoked_cert_deleted_count"] != 2 {
+		t.Fatalf("bad status: %#v", status)
+	}
+	if exists("revoked/"+oldRevoked) || exists("revoked/"+recentRevoked) || !exists("certs/"+recentCert) {
+		t.Fatalf("bad storage after tidying revoked certificates")
+	}
+	crl, err := x509.ParseCRL(request(logical.ReadOperation, "crl", nil).Data[logical.HTTPRawBody].([]byte))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.TBSCertList.RevokedCertificates) != 0 {
+		t.Fatalf("expected an empty CRL, got %v", crl.TBSCertList.RevokedCertificates)
+	}
+
+	for _, data := range []map[string]interface{}{
+		{},
+		{"tidy_cert_store": true, "safety_buffer": "-1h"},
+		{"tidy_cert_store": true, "safety_buffer": "soon"},
+	} {
+		resp, err := b.HandleRequest(&logical.Request{
+			Operation: logical.WriteOperation,
+			Path:      "tidy",
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || !resp.IsError() {
+			t.Fatalf("expected %#v to be rejected, got: %#v, %v", data, resp, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package pki
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/helper/certutil"
+)
+
+// Looks up the addresses of a host; a variable so tests can stub out DNS
+var lookupIPAddr = func(ctx context.Context, resolver *net.Resolver, host string) ([]net.IPAddr, error) {
+	return resolver.LookupIPAddr(ctx, host)
+}
+
+// Parses a comma-delimited list of CIDRs
+func parseCIDRList(cidrs string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, cidr := range strings.Split(cidrs, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// Resolves each of the given names and returns a UserError if any of them
+// resolves to an address outside of the role's allowed CIDRs. Names that
+// do not exist are allowed, as are wildcard names, which cannot be
+// resolved. This is advisory only: the records can change at any time
+// after the check.
+func checkSANResolution(role *roleEntry, names []string) error {
+	if len(role.AllowedResolutionCIDRs) == 0 {
+		return nil
+	}
+
+	allowed, err := parseCIDRList(role.AllowedResolutionCIDRs)
+	if err != nil {
+		return certutil.InternalError{Err: fmt.Sprintf("Error parsing allowed_resolution_cidrs: %s", err)}
+	}
+
+	timeout, err := time.ParseDuration(role.DNSResolveTimeout)
+	if err != nil {
+		return certutil.InternalError{Err: fmt.Sprintf("Error parsing dns_resolve_timeout: %s", err)}
+	}
+
+	resolver := &net.Resolver{}
+	if len(role.DNSResolver) != 0 {
+		server := role.DNSResolver
+		resolver.PreferGo = true
+		resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		}
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "*") {
+			continue
+		}
+		// IP addresses given as names are checked as they are
+		if ip := net.ParseIP(name); ip != nil {
+			if !ipInNets(ip, allowed) {
+				return certutil.UserError{Err: fmt.Sprintf("Name %s is outside of the allowed address ranges", name)}
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		addrs, err := lookupIPAddr(ctx, resolver, name)
+		cancel()
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				continue
+			}
+			return certutil.UserError{Err: fmt.Sprintf("Unable to resolve %s to check it against the allowed address ranges: %s", name, err)}
+		}
+
+		for _, addr := range addrs {
+			if !ipInNets(addr.IP, allowed) {
+				return certutil.UserError{Err: fmt.Sprintf("Name %s resolves to %s, which is outside of the allowed address ranges", name, addr.IP)}
+			}
+		}
+	}
+
+	return nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
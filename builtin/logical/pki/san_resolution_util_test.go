@@ -0,0 +1,83 @@
+package pki
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBackend_sanResolution(t *testing.T) {
+	records := map[string][]string{
+		"internal.example.com": {"10.0.0.5"},
+		"mixed.example.com":    {"10.0.0.6", "203.0.113.7"},
+		"public.example.com":   {"203.0.113.8"},
+	}
+	var lookups []string
+	defer func(orig func(context.Context, *net.Resolver, string) ([]net.IPAddr, error)) {
+		lookupIPAddr = orig
+	}(lookupIPAddr)
+	lookupIPAddr = func(ctx context.Context, resolver *net.Resolver, host string) ([]net.IPAddr, error) {
+		lookups = append(lookups, host)
+		ips, ok := records[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+
+	b, storage := createBackendWithCA(t)
+
+	roleData := map[string]interface{}{
+		"allow_any_name": true,
+	}
+	issue := func(cn, altNames string) (string, bool) {
+		_, resp := issueWithRole(t, b, storage, roleData, map[string]interface{}{
+			"common_name": cn,
+			"alt_names":   altNames,
+		})
+		if msg := userErrorMessage(resp); len(msg) != 0 {
+			return msg, false
+		}
+		return "", true
+	}
+
+	// Off by default
+	if msg, ok := issue("public.example.com", ""); !ok {
+		t.Fatalf("expected issuance without the check: %s", msg)
+	}
+	if len(lookups) != 0 {
+		t.Fatalf("no lookups expected, got %v", lookups)
+	}
+
+	roleData["allowed_resolution_cidrs"] = "10.0.0.0/8, 192.168.0.0/16"
+
+	if msg, ok := issue("internal.example.com", ""); !ok {
+		t.Fatalf("expected an internal name to be allowed: %s", msg)
+	}
+	if msg, ok := issue("public.example.com", ""); ok || !strings.Contains(msg, "203.0.113.8") {
+		t.Fatalf("expected a public name to be rejected, got: %q", msg)
+	}
+	// Every address and every SAN is checked
+	if msg, ok := issue("internal.example.com", "mixed.example.com"); ok || !strings.Contains(msg, "203.0.113.7") {
+		t.Fatalf("expected a name with a public address to be rejected, got: %q", msg)
+	}
+	// Names that don't resolve, and wildcards, are let through
+	lookups = nil
+	if msg, ok := issue("new.example.com", "*.example.com"); !ok {
+		t.Fatalf("expected unresolvable names to be allowed: %s", msg)
+	}
+	if len(lookups) != 1 || lookups[0] != "new.example.com" {
+		t.Fatalf("bad lookups: %v", lookups)
+	}
+
+	roleData["allowed_resolution_cidrs"] = "10.0.0.0/33"
+	roleResp, _ := issueWithRole(t, b, storage, roleData, nil)
+	if !roleResp.IsError() {
+		t.Fatalf("expected an invalid CIDR to be rejected")
+	}
+}
@@ -0,0 +1,132 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/vault/helper/certutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// The body POSTed to the SAN webhook
+type sanWebhookRequest struct {
+	Role        string   `json:"role"`
+	DisplayName string   `json:"display_name"`
+	CommonName  string   `json:"common_name"`
+	AltNames    []string `json:"alt_names"`
+	IPSANs      []string `json:"ip_sans"`
+	URISANs     []string `json:"uri_sans"`
+	OtherSANs   []string `json:"other_sans"`
+}
+
+// The body expected back from the SAN webhook
+type sanWebhookResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+// Asks the configured SAN webhook, if any, whether the given names may be
+// issued. A denial is returned as a UserError. Failing to get an answer is
+// returned as an InternalError, unless the webhook is configured to fail
+// open, in which case a warning is returned instead.
+func checkSANWebhook(b *backend, req *logical.Request, roleName, commonName string, altNames []string, ipSANs []net.IP, uriSANs []*url.URL, otherSANs []otherSAN) (string, error) {
+	config, err := b.SANWebhook(req.Storage)
+	if err != nil {
+		return "", certutil.InternalError{Err: fmt.Sprintf("Error fetching SAN webhook configuration: %s", err)}
+	}
+	if config == nil || len(config.URL) == 0 {
+		return "", nil
+	}
+
+	webhookReq := &sanWebhookRequest{
+		Role:        roleName,
+		DisplayName: req.DisplayName,
+		CommonName:  commonName,
+		AltNames:    altNames,
+		IPSANs:      []string{},
+		URISANs:     []string{},
+		OtherSANs:   []string{},
+	}
+	for _, ip := range ipSANs {
+		webhookReq.IPSANs = append(webhookReq.IPSANs, ip.String())
+	}
+	for _, uri := range uriSANs {
+		webhookReq.URISANs = append(webhookReq.URISANs, uri.String())
+	}
+	for _, san := range otherSANs {
+		webhookReq.OtherSANs = append(webhookReq.OtherSANs, san.String())
+	}
+
+	webhookResp, err := callSANWebhook(config, webhookReq)
+	if err != nil {
+		if config.FailOpen {
+			b.Logger().Printf("[WARN] pki: SAN webhook failed, allowing issuance as it is configured to fail open: %s", err)
+			return fmt.Sprintf("The SAN webhook could not be consulted and was skipped: %s", err), nil
+		}
+		return "", certutil.InternalError{Err: fmt.Sprintf("Error consulting SAN webhook: %s", err)}
+	}
+
+	if !webhookResp.Allowed {
+		if len(webhookResp.Reason) != 0 {
+			return "", certutil.UserError{Err: fmt.Sprintf("Requested names were denied by the SAN webhook: %s", webhookResp.Reason)}
+		}
+		return "", certutil.UserError{Err: "Requested names were denied by the SAN webhook"}
+	}
+
+	return "", nil
+}
+
+func callSANWebhook(config *sanWebhookConfig, webhookReq *sanWebhookRequest) (*sanWebhookResponse, error) {
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout: %s", err)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TLSSkipVerify,
+	}
+	if len(config.CACertificate) != 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(config.CACertificate)) {
+			return nil, fmt.Errorf("could not parse configured CA certificate")
+		}
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	body, err := json.Marshal(webhookReq)
+	if err != nil {
+		return nil, err
+	}
+
+	httpResp, err := client.Post(config.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", httpResp.StatusCode)
+	}
+
+	var webhookResp sanWebhookResponse
+	if err := json.NewDecoder(io.LimitReader(httpResp.Body, 64*1024)).Decode(&webhookResp); err != nil {
+		return nil, fmt.Errorf("could not decode response: %s", err)
+	}
+
+	return &webhookResp, nil
+}
@@ -0,0 +1,167 @@
+package pki
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestBackend_sanWebhook(t *testing.T) {
+	var lastRequest sanWebhookRequest
+	var commonNames []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&lastRequest); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		commonNames = append(commonNames, lastRequest.CommonName)
+		resp := sanWebhookResponse{Allowed: true}
+		for _, name := range append(append(append(lastRequest.AltNames, lastRequest.CommonName), lastRequest.URISANs...), lastRequest.OtherSANs...) {
+			if strings.Contains(name, "deny.") {
+				resp = sanWebhookResponse{Allowed: false, Reason: name + " is on the deny list"}
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer ts.Close()
+
+	b, storage := createBackendWithCA(t)
+
+	write := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(&logical.Request{
+			Operation:   logical.WriteOperation,
+			Path:        path,
+			Storage:     storage,
+			DisplayName: "test-token",
+			Data:        data,
+		})
+	}
+
+	resp, err := write("roles/test", map[string]interface{}{
+		"allowed_base_domain": "example.com",
+		"allow_uri_sans":      true,
+		"allowed_other_sans":  "*",
+		"max_ttl":             "12h",
+	})
+	if err != nil || isErrorResponse(resp) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+
+	resp, err = write("config/san_webhook", map[string]interface{}{
+		"url": ts.URL,
+	})
+	if err != nil || isErrorResponse(resp) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+
+	// Allowed by both the role and the webhook
+	resp, err = write("issue/test", map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "bar.example.com",
+		"ip_sans":     "127.0.0.1",
+		"uri_sans":    "spiffe://example.com/web",
+		"other_sans":  "1.3.6.1.4.1.311.20.2.3;utf-8:alice@example.com",
+	})
+	if err != nil || isErrorResponse(resp) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+	if lastRequest.Role != "test" || lastRequest.DisplayName != "test-token" ||
+		lastRequest.CommonName != "foo.example.com" ||
+		len(lastRequest.AltNames) != 1 || lastRequest.AltNames[0] != "bar.example.com" ||
+		len(lastRequest.IPSANs) != 1 || lastRequest.IPSANs[0] != "127.0.0.1" ||
+		len(lastRequest.URISANs) != 1 || lastRequest.URISANs[0] != "spiffe://example.com/web" ||
+		len(lastRequest.OtherSANs) != 1 || lastRequest.OtherSANs[0] != "1.3.6.1.4.1.311.20.2.3;UTF8:alice@example.com" {
+		t.Fatalf("bad webhook request: %#v", lastRequest)
+	}
+
+	// Denied by the webhook
+	resp, err = write("issue/test", map[string]interface{}{
+		"common_name": "foo.example.com",
+		"alt_names":   "deny.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := userErrorMessage(resp); !strings.Contains(msg, "deny.example.com is on the deny list") {
+		t.Fatalf("expected a denial, got: %#v", resp)
+	}
+
+	// URI and other SANs are checked by the webhook too
+	for _, issueData := range []map[string]interface{}{
+		{"uri_sans": "spiffe://deny.example.com/web"},
+		{"other_sans": "1.3.6.1.4.1.311.20.2.3;UTF8:alice@deny.example.com"},
+	} {
+		issueData["common_name"] = "foo.example.com"
+		resp, err = write("issue/test", issueData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg := userErrorMessage(resp); !strings.Contains(msg, "deny.example.com") {
+			t.Fatalf("expected %#v to be denied, got: %#v", issueData, resp)
+		}
+	}
+
+	// Names rejected by the role never reach the webhook
+	lastRequest = sanWebhookRequest{}
+	resp, err = write("issue/test", map[string]interface{}{
+		"common_name": "foo.example.net",
+	})
+	if err != nil || !isErrorResponse(resp) {
+		t.Fatalf("expected a role error, got: resp: %#v, err: %v", resp, err)
+	}
+	if lastRequest.CommonName != "" {
+		t.Fatalf("webhook should not have been called")
+	}
+
+	// The webhook sees the common name as requested, before any random
+	// component is added, and then as it is issued
+	resp, err = write("roles/test", map[string]interface{}{
+		"allowed_base_domain": "example.com",
+		"max_ttl":             "12h",
+		"append_random_to_cn": true,
+	})
+	if err != nil || isErrorResponse(resp) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+	commonNames = nil
+	resp, err = write("issue/test", map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	if err != nil || isErrorResponse(resp) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+	if cn := parseIssuedCert(t, resp).Subject.CommonName; cn == "foo.example.com" || len(commonNames) != 2 || commonNames[0] != "foo.example.com" || commonNames[1] != cn {
+		t.Fatalf("bad common names: certificate %s, webhook %v", cn, commonNames)
+	}
+
+	// Unreachable webhook fails closed by default
+	ts.Close()
+	resp, err = write("issue/test", map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	if err == nil {
+		t.Fatalf("expected an error with an unreachable webhook, got: %#v", resp)
+	}
+
+	// ...and fails open when configured to
+	resp, err = write("config/san_webhook", map[string]interface{}{
+		"url":       ts.URL,
+		"fail_open": true,
+	})
+	if err != nil || isErrorResponse(resp) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+	resp, err = write("issue/test", map[string]interface{}{
+		"common_name": "foo.example.com",
+	})
+	if err != nil || isErrorResponse(resp) {
+		t.Fatalf("bad: resp: %#v, err: %v", resp, err)
+	}
+	if len(resp.Warnings()) != 1 {
+		t.Fatalf("expected a warning about the skipped webhook, got: %#v", resp.Warnings())
+	}
+}
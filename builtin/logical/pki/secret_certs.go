@@ -55,5 +55,5 @@ func (b *backend) secretCredsRevoke(
 	b.revokeStorageLock.Lock()
 	defer b.revokeStorageLock.Unlock()
 
-	return revokeCert(b, req, serial)
+	return revokeCert(b, req, serial, 0)
 }
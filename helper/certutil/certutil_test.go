@@ -2,7 +2,11 @@ package certutil
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"strings"
 	"testing"
@@ -147,6 +151,67 @@ func TestCertBundleParsing(t *testing.T) {
 	}
 }
 
+// Tests that the CA chain survives a round trip through both bundle types
+func TestCertBundleCAChain(t *testing.T) {
+	cbut := refreshRSACertBundle()
+	cbut.CAChain = []string{issuingCaPem}
+
+	pcbut, err := cbut.ToParsedCertBundle()
+	if err != nil {
+		t.Fatalf("Error converting to parsed cert bundle: %s", err)
+	}
+	if len(pcbut.CAChain) != 1 || !pcbut.CAChain[0].Equal(pcbut.IssuingCA) {
+		t.Fatalf("Parsed bundle CA chain does not match")
+	}
+
+	cb, err := pcbut.ToCertBundle()
+	if err != nil {
+		t.Fatalf("Error converting to cert bundle: %s", err)
+	}
+	if len(cb.CAChain) != 1 || cb.CAChain[0] != issuingCaPem {
+		t.Fatalf("Bundle CA chain does not match")
+	}
+}
+
+// Tests that an Ed25519 private key, which has no PEM type of its own,
+// is detected and kept as PKCS #8 through a round trip
+func TestEd25519PrivateKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPem := strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	})))
+
+	cbut := &CertBundle{
+		PrivateKey: keyPem,
+	}
+	pcbut, err := cbut.ToParsedCertBundle()
+	if err != nil {
+		t.Fatalf("Error converting to parsed cert bundle: %s", err)
+	}
+	if pcbut.PrivateKeyType != Ed25519PrivateKey || cbut.PrivateKeyType != "ed25519" {
+		t.Fatalf("Parsed bundle has wrong private key type")
+	}
+	if signer, ok := pcbut.PrivateKey.(ed25519.PrivateKey); !ok || !signer.Equal(priv) {
+		t.Fatalf("Parsed bundle private key does not match")
+	}
+
+	cb, err := pcbut.ToCertBundle()
+	if err != nil {
+		t.Fatalf("Error converting to cert bundle: %s", err)
+	}
+	if cb.PrivateKeyType != "ed25519" || cb.PrivateKey != keyPem {
+		t.Fatalf("Bundle private key does not match")
+	}
+}
+
 func compareCertBundleToParsedCertBundle(cbut *CertBundle, pcbut *ParsedCertBundle) error {
 	if cbut == nil {
 		return fmt.Errorf("Got nil bundle")
@@ -3,6 +3,7 @@ package certutil
 import (
 	"bytes"
 	"crypto"
+	"crypto/ed25519"
 	"crypto/sha1"
 	"crypto/x509"
 	"encoding/json"
@@ -60,6 +61,20 @@ func GetSubjKeyID(privateKey crypto.Signer) ([]byte, error) {
 	return subjKeyID[:], nil
 }
 
+// Ed25519 keys have no format of their own, so they are kept as PKCS #8;
+// this parses one, failing if it holds any other type of key
+func parseEd25519PrivateKey(der []byte) (ed25519.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("PKCS #8 key is not an Ed25519 key")
+	}
+	return edKey, nil
+}
+
 // ParsePKIMap takes a map (for instance, the Secret.Data
 // returned from the PKI backend) and returns a ParsedCertBundle.
 func ParsePKIMap(data map[string]interface{}) (*ParsedCertBundle, error) {
@@ -131,6 +146,14 @@ func ParsePEMBundle(pemBundle string) (*ParsedCertBundle, error) {
 			parsedBundle.PrivateKeyBytes = pemBlock.Bytes
 			parsedBundle.PrivateKey = signer
 
+		} else if signer, err := parseEd25519PrivateKey(pemBlock.Bytes); err == nil {
+			if parsedBundle.PrivateKeyType != UnknownPrivateKey {
+				return nil, UserError{"More than one private key given; provide only one private key in the bundle"}
+			}
+			parsedBundle.PrivateKeyType = Ed25519PrivateKey
+			parsedBundle.PrivateKeyBytes = pemBlock.Bytes
+			parsedBundle.PrivateKey = signer
+
 		} else if certificates, err := x509.ParseCertificates(pemBlock.Bytes); err == nil {
 			switch len(certificates) {
 			case 0:
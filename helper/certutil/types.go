@@ -35,6 +35,7 @@ const (
 	UnknownPrivateKey = iota
 	RSAPrivateKey
 	ECPrivateKey
+	Ed25519PrivateKey
 
 	TLSUnknown TLSUsage = 0
 	TLSServer  TLSUsage = 1 << iota
@@ -62,13 +63,15 @@ func (e InternalError) Error() string {
 
 // CertBundle contains a key type, a PEM-encoded private key,
 // a PEM-encoded certificate, and a string-encoded serial number,
-// returned from a successful Issue request
+// returned from a successful Issue request. CAChain holds the PEM-encoded
+// certificates from the issuing CA up to, but not including, the root.
 type CertBundle struct {
-	PrivateKeyType string `json:"private_key_type" structs:"private_key_type" mapstructure:"private_key_type"`
-	Certificate    string `json:"certificate" structs:"certificate" mapstructure:"certificate"`
-	IssuingCA      string `json:"issuing_ca" structs:"issuing_ca" mapstructure:"issuing_ca"`
-	PrivateKey     string `json:"private_key" structs:"private_key" mapstructure:"private_key"`
-	SerialNumber   string `json:"serial_number" structs:"serial_number" mapstructure:"serial_number"`
+	PrivateKeyType string   `json:"private_key_type" structs:"private_key_type" mapstructure:"private_key_type"`
+	Certificate    string   `json:"certificate" structs:"certificate" mapstructure:"certificate"`
+	IssuingCA      string   `json:"issuing_ca" structs:"issuing_ca" mapstructure:"issuing_ca"`
+	CAChain        []string `json:"ca_chain,omitempty" structs:"ca_chain" mapstructure:"ca_chain"`
+	PrivateKey     string   `json:"private_key" structs:"private_key" mapstructure:"private_key"`
+	SerialNumber   string   `json:"serial_number" structs:"serial_number" mapstructure:"serial_number"`
 }
 
 // ParsedCertBundle contains a key type, a DER-encoded private key,
@@ -79,6 +82,8 @@ type ParsedCertBundle struct {
 	PrivateKey       crypto.Signer
 	IssuingCABytes   []byte
 	IssuingCA        *x509.Certificate
+	CAChainBytes     [][]byte
+	CAChain          []*x509.Certificate
 	CertificateBytes []byte
 	Certificate      *x509.Certificate
 }
@@ -102,6 +107,8 @@ func (c *CertBundle) ToParsedCertBundle() (*ParsedCertBundle, error) {
 			result.PrivateKeyType = ECPrivateKey
 		case "rsa":
 			result.PrivateKeyType = RSAPrivateKey
+		case "ed25519":
+			result.PrivateKeyType = Ed25519PrivateKey
 		default:
 			// Try to figure it out and correct
 			if _, err := x509.ParseECPrivateKey(pemBlock.Bytes); err == nil {
@@ -110,6 +117,9 @@ func (c *CertBundle) ToParsedCertBundle() (*ParsedCertBundle, error) {
 			} else if _, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes); err == nil {
 				result.PrivateKeyType = RSAPrivateKey
 				c.PrivateKeyType = "rsa"
+			} else if _, err := parseEd25519PrivateKey(pemBlock.Bytes); err == nil {
+				result.PrivateKeyType = Ed25519PrivateKey
+				c.PrivateKeyType = "ed25519"
 			} else {
 				return nil, UserError{fmt.Sprintf("Unknown private key type in bundle: %s", c.PrivateKeyType)}
 			}
@@ -145,6 +155,19 @@ func (c *CertBundle) ToParsedCertBundle() (*ParsedCertBundle, error) {
 		}
 	}
 
+	for _, chainCert := range c.CAChain {
+		pemBlock, _ = pem.Decode([]byte(chainCert))
+		if pemBlock == nil {
+			return nil, UserError{"Error decoding CA chain from cert bundle"}
+		}
+		cert, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return nil, UserError{fmt.Sprintf("Error parsing CA chain certificate: %s", err)}
+		}
+		result.CAChainBytes = append(result.CAChainBytes, pemBlock.Bytes)
+		result.CAChain = append(result.CAChain, cert)
+	}
+
 	if len(c.SerialNumber) == 0 && len(c.Certificate) > 0 {
 		c.SerialNumber = GetOctalFormatted(result.Certificate.SerialNumber.Bytes(), ":")
 	}
@@ -174,6 +197,12 @@ func (p *ParsedCertBundle) ToCertBundle() (*CertBundle, error) {
 		result.IssuingCA = strings.TrimSpace(string(pem.EncodeToMemory(&block)))
 	}
 
+	result.CAChain = make([]string, 0, len(p.CAChainBytes))
+	for _, chainBytes := range p.CAChainBytes {
+		block.Bytes = chainBytes
+		result.CAChain = append(result.CAChain, strings.TrimSpace(string(pem.EncodeToMemory(&block))))
+	}
+
 	if p.PrivateKeyBytes != nil && len(p.PrivateKeyBytes) > 0 {
 		block.Bytes = p.PrivateKeyBytes
 		switch p.PrivateKeyType {
@@ -183,6 +212,9 @@ func (p *ParsedCertBundle) ToCertBundle() (*CertBundle, error) {
 		case ECPrivateKey:
 			result.PrivateKeyType = "ec"
 			block.Type = "EC PRIVATE KEY"
+		case Ed25519PrivateKey:
+			result.PrivateKeyType = "ed25519"
+			block.Type = "PRIVATE KEY"
 		default:
 			return nil, InternalError{"Could not determine private key type when creating block"}
 		}
@@ -217,8 +249,14 @@ func (p *ParsedCertBundle) getSigner() (crypto.Signer, error) {
 			return nil, UserError{fmt.Sprintf("Unable to parse CA's private RSA key: %s", err)}
 		}
 
+	case Ed25519PrivateKey:
+		signer, err = parseEd25519PrivateKey(p.PrivateKeyBytes)
+		if err != nil {
+			return nil, UserError{fmt.Sprintf("Unable to parse CA's private Ed25519 key: %s", err)}
+		}
+
 	default:
-		return nil, UserError{"Unable to determine type of private key; only RSA and EC are supported"}
+		return nil, UserError{"Unable to determine type of private key; only RSA, EC and Ed25519 are supported"}
 	}
 	return signer, nil
 }